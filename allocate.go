@@ -0,0 +1,19 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// AllocateIDs returns a range of n integer IDs with the given kind and parent
+// combination. It is the same as datastore.AllocateIDs and is only provided so
+// that code using nds does not need to call the datastore package directly.
+// It never touches memcache as no entities are read or written.
+//
+// kind cannot be empty; parent may be nil. The IDs in the range [low, high)
+// will not be used by the datastore's automatic ID sequence and may be passed
+// to datastore.NewKey without conflict.
+func AllocateIDs(c context.Context, kind string, parent *datastore.Key,
+	n int) (low, high int64, err error) {
+	return datastore.AllocateIDs(c, kind, parent, n)
+}
@@ -0,0 +1,40 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestAllocateIDs(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	low, high, err := nds.AllocateIDs(c, "Entity", nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if high-low != 10 {
+		t.Fatal("incorrect ID range", low, high)
+	}
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", low, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The automatic ID sequence must not reuse allocated IDs.
+	key, err = nds.Put(c, datastore.NewIncompleteKey(c, "Entity", nil),
+		&testEntity{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := key.IntID(); id >= low && id < high {
+		t.Fatal("automatic ID in allocated range", id)
+	}
+}
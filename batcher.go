@@ -0,0 +1,146 @@
+package nds
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Batcher coalesces the Get and GetMulti calls made on it within a short
+// window into a single GetMulti. This saves memcache and datastore calls when
+// many goroutines of a request get entities independently, often of the same
+// keys. Keys requested by more than one call are got once.
+//
+// A Batcher should be created for each request and is safe for concurrent
+// use. It must not be used within transactions as its GetMulti calls are made
+// with the context it was created with.
+type Batcher struct {
+	c      context.Context
+	window time.Duration
+
+	mu      sync.Mutex
+	pending []*batchRequest
+}
+
+// batchRequest is a Get or GetMulti call waiting for a Batcher to flush.
+type batchRequest struct {
+	keys []*datastore.Key
+	vals reflect.Value
+	err  error
+	done chan struct{}
+}
+
+// NewBatcher returns a Batcher that gets entities with c. Calls are delayed by
+// up to window so that calls made by other goroutines can join them.
+func NewBatcher(c context.Context, window time.Duration) *Batcher {
+	return &Batcher{
+		c:      c,
+		window: window,
+	}
+}
+
+// GetMulti works just like GetMulti except that the entities are got along
+// with those of other calls made on b. It returns an appengine.MultiError
+// holding only the errors of keys, just as if it had been called alone.
+func (b *Batcher) GetMulti(keys []*datastore.Key, vals interface{}) error {
+	v := reflect.ValueOf(vals)
+	if err := checkKeysValues(keys, v); err != nil {
+		return err
+	}
+	if err := checkNilInterfaces(v); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	req := &batchRequest{
+		keys: keys,
+		vals: v,
+		done: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, req)
+	if len(b.pending) == 1 {
+		time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+
+	<-req.done
+	return req.err
+}
+
+// Get works just like Get except that the entity is got along with those of
+// other calls made on b.
+func (b *Batcher) Get(key *datastore.Key, val interface{}) error {
+	// GetMulti catches nil interface; we need to catch nil ptr here.
+	if val == nil {
+		return datastore.ErrInvalidEntityType
+	}
+
+	err := b.GetMulti([]*datastore.Key{key}, []interface{}{val})
+	if me, ok := err.(appengine.MultiError); ok {
+		return me[0]
+	}
+	return err
+}
+
+// flush gets the entities of every pending call and scatters them back.
+func (b *Batcher) flush() {
+	b.mu.Lock()
+	reqs := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	// Entities are cached as for the types of the vals of every call getting
+	// them, not the property lists they are got into.
+	index := map[string]int{}
+	keys := []*datastore.Key{}
+	noCache := [][]string{}
+	for _, req := range reqs {
+		for i, key := range req.keys {
+			encoded := key.Encode()
+			j, ok := index[encoded]
+			if !ok {
+				j = len(keys)
+				index[encoded] = j
+				keys = append(keys, key)
+				noCache = append(noCache, nil)
+			}
+			noCache[j] = mergeNoCacheProperties(noCache[j],
+				noCacheProperties(req.vals.Index(i)))
+		}
+	}
+
+	pls := make([]datastore.PropertyList, len(keys))
+	err := getMultiSources(b.c, keys, pls, getMultiExtras{noCache: noCache})
+	me, isMultiErr := err.(appengine.MultiError)
+
+	for _, req := range reqs {
+		if err != nil && !isMultiErr {
+			req.err = err
+			close(req.done)
+			continue
+		}
+
+		errs, errsNil := make(appengine.MultiError, len(req.keys)), true
+		for i, key := range req.keys {
+			j := index[key.Encode()]
+			if isMultiErr && me[j] != nil {
+				errs[i] = me[j]
+			} else if err := setValue(req.vals.Index(i), pls[j]); err != nil {
+				errs[i] = err
+			}
+			errsNil = errsNil && errs[i] == nil
+		}
+		if !errsNil {
+			req.err = errs
+		}
+		close(req.done)
+	}
+}
@@ -0,0 +1,111 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestBatcher(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2],
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var getKeys [][]string
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		mu.Lock()
+		getKeys = append(getKeys, keys)
+		mu.Unlock()
+		return memcache.GetMulti(c, keys)
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	b := nds.NewBatcher(c, 100*time.Millisecond)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	entities := make([]testEntity, 10)
+	for i := range entities {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = b.Get(keys[i%len(keys)], &entities[i])
+		}(i)
+	}
+
+	var multiErr error
+	multiEntities := make([]testEntity, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		multiErr = b.GetMulti(keys[1:], multiEntities)
+	}()
+	wg.Wait()
+
+	for i, err := range errs {
+		switch i % len(keys) {
+		case 2:
+			if err != datastore.ErrNoSuchEntity {
+				t.Fatal("expected datastore.ErrNoSuchEntity", err)
+			}
+		default:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entities[i].IntVal != int64(i%len(keys)+1) {
+				t.Fatal("incorrect IntVal", entities[i].IntVal)
+			}
+		}
+	}
+
+	if me, ok := multiErr.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", multiErr)
+	} else if len(me) != 2 || me[0] != nil ||
+		me[1] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if multiEntities[0].IntVal != 2 {
+		t.Fatal("incorrect IntVal", multiEntities[0].IntVal)
+	}
+
+	// All calls are got by a single GetMulti of the deduplicated keys, which
+	// gets from memcache before and after locking.
+	if len(getKeys) != 2 || len(getKeys[0]) != len(keys) {
+		t.Fatal("expected one GetMulti of all keys", getKeys)
+	}
+}
+
+func TestBatcherArgs(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	b := nds.NewBatcher(c, time.Millisecond)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if err := b.Get(key, nil); err != datastore.ErrInvalidEntityType {
+		t.Fatal("expected datastore.ErrInvalidEntityType", err)
+	}
+	if err := b.GetMulti([]*datastore.Key{key}, 1); err == nil {
+		t.Fatal("expected vals error")
+	}
+}
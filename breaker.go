@@ -0,0 +1,108 @@
+package nds
+
+import (
+	"sync"
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+// breaker is a circuit breaker that stops GetMulti and Exists from using
+// memcache while memcache is failing.
+type breaker struct {
+	sync.Mutex
+
+	// threshold is the number of consecutive failures within window that
+	// opens the breaker. A threshold of zero disables the breaker.
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+}
+
+var timeNow = time.Now
+
+// SetCircuitBreaker enables a circuit breaker for memcache. Once threshold
+// consecutive memcache calls fail within window, Get, GetMulti and Exists read
+// directly from the datastore for cooldown. After cooldown memcache is used
+// again; one further failure opens the breaker for another cooldown while a
+// success closes it.
+//
+// Put, PutMulti, Delete, DeleteMulti and RunInTransaction always lock memcache
+// so that stale entities are never cached, whether or not the breaker is open.
+//
+// A threshold of zero or less, the default, disables the breaker. Calling
+// SetCircuitBreaker closes the breaker.
+func SetCircuitBreaker(threshold int, window, cooldown time.Duration) {
+	b := &breaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+	}
+	updateConfig(func(cfg *config) {
+		cfg.breaker = b
+	})
+}
+
+// memcacheAllowed reports whether the circuit breaker allows memcache to be
+// read.
+func memcacheAllowed() bool {
+	return loadConfig().breaker.allow()
+}
+
+// allow reports whether memcache should be read.
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	return !timeNow().Before(b.openUntil)
+}
+
+// observe records the result of a memcache call. Errors of individual items,
+// such as cache misses, are reported in an appengine.MultiError and show that
+// memcache is working.
+func (b *breaker) observe(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if _, ok := err.(appengine.MultiError); ok || err == nil {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+
+	t := timeNow()
+	if !b.openUntil.IsZero() {
+		// Failing after a cooldown opens the breaker again straight away.
+		b.openUntil = t.Add(b.cooldown)
+		return
+	}
+
+	if b.failures == 0 || t.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = t
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = t.Add(b.cooldown)
+	}
+}
+
+// observeMemcache passes the result of a memcache call for count keys to the
+// circuit breaker. Calls with no keys do not contact memcache so say nothing
+// about its health.
+func observeMemcache(count int, err error) {
+	if count > 0 {
+		loadConfig().breaker.observe(err)
+	}
+}
@@ -0,0 +1,122 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	currentTime := time.Now()
+	nds.SetTimeNow(func() time.Time { return currentTime })
+	defer nds.SetTimeNow(time.Now)
+
+	nds.SetCircuitBreaker(2, time.Minute, time.Minute)
+	defer nds.SetCircuitBreaker(0, 0, 0)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	getCalls := 0
+	memcacheFail := true
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		getCalls++
+		if memcacheFail {
+			return nil, errors.New("expected error")
+		}
+		return memcache.GetMulti(c, keys)
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	get := func() {
+		entity := &testEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		} else if entity.IntVal != 1 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+	}
+
+	// Two failures open the breaker.
+	get()
+	get()
+	if getCalls != 2 {
+		t.Fatal("expected two memcache calls", getCalls)
+	}
+
+	// Memcache is not used while the breaker is open.
+	get()
+	if getCalls != 2 {
+		t.Fatal("expected no memcache calls", getCalls)
+	}
+
+	// A failure after the cooldown opens the breaker again.
+	currentTime = currentTime.Add(2 * time.Minute)
+	get()
+	get()
+	if getCalls != 3 {
+		t.Fatal("expected one memcache call", getCalls)
+	}
+
+	// A success after the cooldown closes the breaker.
+	currentTime = currentTime.Add(2 * time.Minute)
+	memcacheFail = false
+	get()
+	get()
+	if getCalls < 5 {
+		t.Fatal("expected memcache calls", getCalls)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	currentTime := time.Now()
+	nds.SetTimeNow(func() time.Time { return currentTime })
+	defer nds.SetTimeNow(time.Now)
+
+	nds.SetCircuitBreaker(2, time.Minute, time.Minute)
+	defer nds.SetCircuitBreaker(0, 0, 0)
+
+	getCalls := 0
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		getCalls++
+		return nil, errors.New("expected error")
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	// Failures further apart than the window do not open the breaker.
+	for i := 0; i < 3; i++ {
+		err := nds.Get(c, key, &testEntity{})
+		if err != datastore.ErrNoSuchEntity {
+			t.Fatal("expected no such entity", err)
+		}
+		currentTime = currentTime.Add(2 * time.Minute)
+	}
+	if getCalls != 3 {
+		t.Fatal("expected three memcache calls", getCalls)
+	}
+}
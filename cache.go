@@ -0,0 +1,107 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// Cache is the shared cache nds stores entities and locks in. The default
+// uses App Engine memcache. Other implementations, such as one backed by
+// Redis, can be set with SetCache. Package ndstest provides an in-memory Cache
+// for tests.
+//
+// The lock protocol that keeps the cache consistent with the datastore depends
+// on every method behaving exactly like its memcache equivalent. Items are
+// handled as memcache.Item values and per item errors are returned in an
+// appengine.MultiError aligned with the items or keys of the call, using the
+// memcache error values:
+//
+// AddMulti stores each item only if its key is not in the cache, otherwise
+// giving memcache.ErrNotStored.
+//
+// CompareAndSwapMulti stores each item only if its key has not been changed,
+// deleted or expired since the item was returned by GetMulti. It gives
+// memcache.ErrCASConflict if the key was changed and memcache.ErrNotStored if
+// it was deleted or expired. nds only ever passes items that were returned by
+// GetMulti, with their Value, Flags and Expiration changed. The identity of
+// the got version can be kept in the Object field of the returned items as
+// nds never uses it.
+//
+// DeleteMulti deletes each key, giving memcache.ErrCacheMiss for keys that
+// are not in the cache.
+//
+// GetMulti returns the items of the keys that are in the cache. Keys that are
+// not in the cache are omitted from the map without an error.
+//
+// SetMulti stores each item unconditionally.
+//
+// A Cache must behave as a single store. A cache layered over another that it
+// only updates on a best effort basis, such as a secondary cache in another
+// region, breaks the lock protocol: a lock or deletion missed by one layer
+// leaves a stale entity for GetMulti to find there. Use GetMultiRaw and
+// PrimeCacheRaw to warm a standby cache instead, and switch to it with
+// SetCache.
+//
+// nds passes every call to the Cache, including calls with no items or keys,
+// such as the AddMulti of a GetMulti whose keys were all cached. These must
+// succeed without error, GetMulti returning no items. App Engine memcache
+// skips them without contacting the service. A Cache wrapping another one in
+// tests therefore sees the exact calls nds makes.
+//
+// An Expiration of zero means an item never expires. Otherwise it is a
+// duration of at least one second. Item values are at most 1MB and no call
+// writes more than 32MB in total. All methods must be safe for concurrent use.
+type Cache interface {
+	AddMulti(c context.Context, items []*memcache.Item) error
+	CompareAndSwapMulti(c context.Context, items []*memcache.Item) error
+	DeleteMulti(c context.Context, keys []string) error
+	GetMulti(c context.Context, keys []string) (map[string]*memcache.Item,
+		error)
+	SetMulti(c context.Context, items []*memcache.Item) error
+}
+
+// appengineCache is the default Cache. It uses App Engine memcache via the
+// memcache function variables so that they can still be substituted in tests.
+type appengineCache struct{}
+
+func (appengineCache) AddMulti(c context.Context,
+	items []*memcache.Item) error {
+	return memcacheAddMulti(c, items)
+}
+
+func (appengineCache) CompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+	return memcacheCompareAndSwapMulti(c, items)
+}
+
+func (appengineCache) DeleteMulti(c context.Context, keys []string) error {
+	return memcacheDeleteMulti(c, keys)
+}
+
+func (appengineCache) GetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+	return memcacheGetMulti(c, keys)
+}
+
+func (appengineCache) SetMulti(c context.Context,
+	items []*memcache.Item) error {
+	return memcacheSetMulti(c, items)
+}
+
+// SetCache sets the Cache nds uses in place of App Engine memcache. A nil
+// cache restores the default. Entities cached in one Cache are not seen by
+// another, so all code reading and writing the same entities must use the
+// same Cache.
+//
+// SetCache should be called during initialization, before any other nds
+// function. Locks taken in one Cache do not protect the entities cached in
+// another, so changing the Cache while entities are being written can leave
+// stale entities cached.
+func SetCache(c Cache) {
+	if c == nil {
+		c = appengineCache{}
+	}
+	updateConfig(func(cfg *config) {
+		cfg.cache = c
+	})
+}
@@ -0,0 +1,237 @@
+package nds_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// mapCache is a Cache that stores items in a map. The version of each got
+// item is kept in its Object field for CompareAndSwapMulti.
+type mapCache struct {
+	mu       sync.Mutex
+	items    map[string]memcache.Item
+	versions map[string]int
+	version  int
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{
+		items:    map[string]memcache.Item{},
+		versions: map[string]int{},
+	}
+}
+
+func (m *mapCache) store(item *memcache.Item) {
+	m.version++
+	m.items[item.Key] = memcache.Item{
+		Key:   item.Key,
+		Value: append([]byte(nil), item.Value...),
+		Flags: item.Flags,
+	}
+	m.versions[item.Key] = m.version
+}
+
+func (m *mapCache) AddMulti(c context.Context,
+	items []*memcache.Item) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs, errsNil := make(appengine.MultiError, len(items)), true
+	for i, item := range items {
+		if _, ok := m.items[item.Key]; ok {
+			errs[i] = memcache.ErrNotStored
+			errsNil = false
+			continue
+		}
+		m.store(item)
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+func (m *mapCache) CompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs, errsNil := make(appengine.MultiError, len(items)), true
+	for i, item := range items {
+		version, ok := m.versions[item.Key]
+		switch {
+		case !ok:
+			errs[i] = memcache.ErrNotStored
+		case item.Object != version:
+			errs[i] = memcache.ErrCASConflict
+		default:
+			m.store(item)
+			continue
+		}
+		errsNil = false
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+func (m *mapCache) DeleteMulti(c context.Context, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, key := range keys {
+		if _, ok := m.items[key]; !ok {
+			errs[i] = memcache.ErrCacheMiss
+			errsNil = false
+			continue
+		}
+		delete(m.items, key)
+		delete(m.versions, key)
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+func (m *mapCache) GetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := map[string]*memcache.Item{}
+	for _, key := range keys {
+		if item, ok := m.items[key]; ok {
+			item.Object = m.versions[key]
+			items[key] = &item
+		}
+	}
+	return items, nil
+}
+
+func (m *mapCache) SetMulti(c context.Context,
+	items []*memcache.Item) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, item := range items {
+		m.store(item)
+	}
+	return nil
+}
+
+func TestSetCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	mc := newMapCache()
+	nds.SetCache(mc)
+	defer nds.SetCache(nil)
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKey := nds.MemcacheKey(c, key)
+	if item, ok := mc.items[memcacheKey]; !ok {
+		t.Fatal("entity not cached")
+	} else if item.Flags != nds.ItemFlagEntity {
+		t.Fatal("expected entity item", item.Flags)
+	}
+	if _, err := memcache.Get(c, memcacheKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected memcache.ErrCacheMiss", err)
+	}
+
+	// Get from the cache.
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		return errors.New("should not be called")
+	})
+	entity := testEntity{}
+	err := nds.Get(c, key, &entity)
+	nds.SetDatastoreGetMulti(datastore.GetMulti)
+	if err != nil {
+		t.Fatal(err)
+	} else if entity.IntVal != 1 {
+		t.Fatal("incorrect entity", entity)
+	}
+
+	// A put must invalidate the cache.
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &entity); err != nil {
+		t.Fatal(err)
+	} else if entity.IntVal != 2 {
+		t.Fatal("incorrect entity", entity)
+	}
+
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key,
+		&entity); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
+
+func TestSetCacheCompareAndSwap(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	mc := newMapCache()
+	nds.SetCache(mc)
+	defer nds.SetCache(nil)
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock the entity while it is being read from the datastore, as a
+	// concurrent put would.
+	memcacheKey := nds.MemcacheKey(c, key)
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		mc.SetMulti(c, []*memcache.Item{{
+			Key:   memcacheKey,
+			Flags: nds.ItemFlagLock,
+			Value: []byte("lock"),
+		}})
+		return datastore.GetMulti(c, keys, vals)
+	})
+	err := nds.Get(c, key, &testEntity{})
+	nds.SetDatastoreGetMulti(datastore.GetMulti)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item := mc.items[memcacheKey]; item.Flags != nds.ItemFlagLock {
+		t.Fatal("expected the lock to remain", item.Flags)
+	}
+}
@@ -0,0 +1,170 @@
+package nds
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// memcacheMaxItemSize is the maximum size of a memcache item value. Marshalled
+// entities larger than this are split into chunks of this size or smaller.
+const memcacheMaxItemSize = 1000000
+
+// SetMaxCachedEntitySize sets the size in bytes above which marshalled
+// entities are not cached in memcache at all. Such entities are always read
+// from the datastore, which avoids filling memcache with items that are soon
+// evicted. A small ItemFlagTooLarge item is cached in their place for the lock
+// time, so that reads meanwhile go to the datastore without locking memcache.
+// Entities larger than a single memcache item but within the size are still
+// cached in chunks, which expire with the entity expiration of the context or,
+// if it has none, after the lock time. A size of zero or less, the default,
+// caches entities of any size. The size is compared after compression.
+func SetMaxCachedEntitySize(size int) {
+	updateConfig(func(cfg *config) {
+		cfg.maxCachedEntitySize = size
+	})
+}
+
+// exceedsMaxCachedEntitySize reports whether data, a marshalled entity, is too
+// large to be cached.
+func exceedsMaxCachedEntitySize(data []byte) bool {
+	size := loadConfig().maxCachedEntitySize
+	return size > 0 && len(data) > size
+}
+
+// chunkManifestSize is the size of a chunkedEntityItem value excluding the
+// lock value it is created from.
+const chunkManifestSize = 4 + sha1.Size
+
+// createChunkKey creates the memcache key of chunk index of an entity cached
+// under memcacheKey. The lock value of the writer is part of the key so that
+// concurrent writers never overwrite each other's chunks.
+func createChunkKey(memcacheKey string, lock []byte, index int) string {
+	return limitMemcacheKey(memcacheKey + ":" + hex.EncodeToString(lock) +
+		":" + strconv.Itoa(index))
+}
+
+// createChunkItems splits data into chunk items and returns them along with
+// the manifest value that must be stored under memcacheKey in their place.
+// lock must be the lock value memcacheKey is locked with.
+func createChunkItems(memcacheKey string, lock, data []byte) (
+	[]byte, []*memcache.Item) {
+
+	count := (len(data)-1)/memcacheMaxItemSize + 1
+	chunks := make([]*memcache.Item, count)
+	for i := range chunks {
+		lo := i * memcacheMaxItemSize
+		hi := (i + 1) * memcacheMaxItemSize
+		if hi > len(data) {
+			hi = len(data)
+		}
+		chunks[i] = &memcache.Item{
+			Key:   createChunkKey(memcacheKey, lock, i),
+			Flags: chunkItem,
+			Value: data[lo:hi],
+		}
+	}
+
+	manifest := make([]byte, chunkManifestSize, chunkManifestSize+len(lock))
+	binary.LittleEndian.PutUint32(manifest, uint32(count))
+	hash := sha1.Sum(data)
+	copy(manifest[4:], hash[:])
+	manifest = append(manifest, lock...)
+	return manifest, chunks
+}
+
+// maxChunkCount is the most chunks an entity is split into when no size is set
+// with SetMaxCachedEntitySize. Datastore entities are limited to about 1MB so
+// their marshalled forms are far smaller.
+const maxChunkCount = 32
+
+// parseChunkManifest returns the chunk count, data hash and lock value stored
+// in a chunkedEntityItem value. Counts of more chunks than a cached entity can
+// have are invalid, so that a corrupt manifest cannot cause large allocations.
+func parseChunkManifest(manifest []byte) (int, []byte, []byte, error) {
+	if len(manifest) <= chunkManifestSize {
+		return 0, nil, nil, errors.New("nds: invalid chunk manifest")
+	}
+	maxCount := maxChunkCount
+	if size := loadConfig().maxCachedEntitySize; size > 0 {
+		maxCount = (size-1)/memcacheMaxItemSize + 1
+	}
+	count := int(binary.LittleEndian.Uint32(manifest))
+	if count < 1 || count > maxCount {
+		return 0, nil, nil, fmt.Errorf("nds: invalid chunk manifest count %d",
+			count)
+	}
+	return count, manifest[4:chunkManifestSize],
+		manifest[chunkManifestSize:], nil
+}
+
+// loadChunks replaces each chunkedEntityItem in items with an entityItem
+// holding the reassembled value of its chunks. If the chunks of an item cannot
+// all be loaded, or they do not match the manifest, the item is left as a
+// chunkedEntityItem, which callers replace by compare and swap in the same way
+// as an entity item that cannot be unmarshalled. Removing it would leave the
+// manifest in memcache, where it stops the key being locked and cached again.
+func loadChunks(c context.Context, items map[string]*memcache.Item) {
+
+	chunkKeys := []string{}
+	for memcacheKey, item := range items {
+		if item.Flags != chunkedEntityItem {
+			continue
+		}
+		count, _, lock, err := parseChunkManifest(item.Value)
+		if err != nil {
+			logEvent(c, LogWarning, "nds:loadChunks parseChunkManifest",
+				"error", err)
+			continue
+		}
+		for i := 0; i < count; i++ {
+			chunkKeys = append(chunkKeys,
+				createChunkKey(memcacheKey, lock, i))
+		}
+	}
+
+	if len(chunkKeys) == 0 {
+		return
+	}
+
+	chunks, err := tracedMemcacheGetMulti(c, chunkKeys)
+	if err != nil {
+		logEvent(c, LogWarning, "nds:loadChunks GetMulti", "error", err)
+		chunks = map[string]*memcache.Item{}
+	}
+
+	for memcacheKey, item := range items {
+		if item.Flags != chunkedEntityItem {
+			continue
+		}
+		count, hash, lock, err := parseChunkManifest(item.Value)
+		if err != nil {
+			continue
+		}
+
+		buf := bytes.Buffer{}
+		for i := 0; i < count; i++ {
+			chunk, ok := chunks[createChunkKey(memcacheKey, lock, i)]
+			if !ok {
+				break
+			}
+			buf.Write(chunk.Value)
+		}
+
+		if sum := sha1.Sum(buf.Bytes()); !bytes.Equal(sum[:], hash) {
+			logEvent(c, LogWarning, "nds:loadChunks missing or corrupt chunks",
+				"key", memcacheKey)
+			continue
+		}
+
+		item.Flags = entityItem
+		item.Value = buf.Bytes()
+	}
+}
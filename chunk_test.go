@@ -0,0 +1,396 @@
+package nds_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+type largeTestEntity struct {
+	Data []byte
+}
+
+func newLargeTestEntity() *largeTestEntity {
+	// Random data is incompressible so it will be chunked.
+	data := make([]byte, 1010000)
+	for i := range data {
+		data[i] = byte(rand.Int())
+	}
+	return &largeTestEntity{data}
+}
+
+func TestGetChunkedEntity(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	entity := newLargeTestEntity()
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.Get(c, key, &largeTestEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.ChunkedEntityItem {
+		t.Fatal("expected chunked entity item", item.Flags)
+	}
+
+	entityFromCache := true
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if len(keys) != 0 {
+			entityFromCache = false
+		}
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	getEntity := &largeTestEntity{}
+	if err := nds.Get(c, key, getEntity); err != nil {
+		t.Fatal(err)
+	}
+
+	if !entityFromCache {
+		t.Fatal("entity not obtained from cache")
+	}
+
+	if !bytes.Equal(getEntity.Data, entity.Data) {
+		t.Fatal("incorrect data")
+	}
+}
+
+func TestGetChunkedEntityMissingChunk(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	entity := newLargeTestEntity()
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.Get(c, key, &largeTestEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose all chunks.
+	memcacheKey := nds.MemcacheKey(c, key)
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		items, err := memcache.GetMulti(c, keys)
+		if err != nil {
+			return nil, err
+		}
+		for k := range items {
+			if k != memcacheKey {
+				delete(items, k)
+			}
+		}
+		return items, nil
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	entityFromDatastore := false
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if len(keys) != 0 {
+			entityFromDatastore = true
+		}
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	getEntity := &largeTestEntity{}
+	if err := nds.Get(c, key, getEntity); err != nil {
+		t.Fatal(err)
+	}
+
+	if !entityFromDatastore {
+		t.Fatal("entity not obtained from datastore")
+	}
+
+	if !bytes.Equal(getEntity.Data, entity.Data) {
+		t.Fatal("incorrect data")
+	}
+}
+
+func TestGetChunkedEntityDeletedChunk(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	entity := newLargeTestEntity()
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache, recording the chunk keys.
+	memcacheKey := nds.MemcacheKey(c, key)
+	chunkKeys := []string{}
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			if item.Key != memcacheKey {
+				chunkKeys = append(chunkKeys, item.Key)
+			}
+		}
+		return memcache.SetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+	if err := nds.Get(c, key, &largeTestEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunkKeys) < 2 {
+		t.Fatal("expected chunks", chunkKeys)
+	}
+
+	// Evict one chunk, leaving the manifest.
+	if err := memcache.Delete(c, chunkKeys[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	datastoreGets := 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if len(keys) != 0 {
+			datastoreGets++
+		}
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	// The first get reads the datastore and caches the entity again, so the
+	// second is served from memcache.
+	for i := 0; i < 2; i++ {
+		getEntity := &largeTestEntity{}
+		if err := nds.Get(c, key, getEntity); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(getEntity.Data, entity.Data) {
+			t.Fatal("incorrect data")
+		}
+	}
+	if datastoreGets != 1 {
+		t.Fatal("expected one datastore get", datastoreGets)
+	}
+
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.ChunkedEntityItem {
+		t.Fatal("expected chunked entity item", item.Flags)
+	}
+}
+
+func TestGetChunkedEntityChunkExpiration(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	entity := newLargeTestEntity()
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKey := nds.MemcacheKey(c, key)
+	var expirations []time.Duration
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			if item.Key != memcacheKey {
+				expirations = append(expirations, item.Expiration)
+			}
+		}
+		return memcache.SetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	hour, err := nds.WithEntityExpiration(c, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks always expire so that those of failed writes do not stay.
+	for _, test := range []struct {
+		c          context.Context
+		expiration time.Duration
+	}{
+		{c, 32 * time.Second},
+		{hour, time.Hour},
+	} {
+		if err := memcache.Flush(c); err != nil {
+			t.Fatal(err)
+		}
+		expirations = nil
+		if err := nds.Get(test.c, key, &largeTestEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if len(expirations) < 2 {
+			t.Fatal("expected chunks", expirations)
+		}
+		for _, expiration := range expirations {
+			if expiration != test.expiration {
+				t.Fatal("incorrect expiration", expiration)
+			}
+		}
+	}
+}
+
+func TestGetChunkedEntityInvalidCount(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	entity := newLargeTestEntity()
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &largeTestEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the chunk count of the manifest.
+	memcacheKey := nds.MemcacheKey(c, key)
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(item.Value, 1<<31)
+	if err := memcache.Set(c, item); err != nil {
+		t.Fatal(err)
+	}
+
+	// No chunks are got for the invalid manifest and it is replaced.
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		if len(keys) > 2 {
+			t.Fatal("unexpected chunk keys", len(keys))
+		}
+		return memcache.GetMulti(c, keys)
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	getEntity := &largeTestEntity{}
+	if err := nds.Get(c, key, getEntity); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(getEntity.Data, entity.Data) {
+		t.Fatal("incorrect data")
+	}
+	if err := nds.Get(c, key, getEntity); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := memcache.Get(c, memcacheKey); err != nil {
+		t.Fatal(err)
+	} else if count := binary.LittleEndian.Uint32(item.Value); count != 2 {
+		t.Fatal("incorrect chunk count", count)
+	}
+}
+
+func TestGetChunkedEntityChunkSetFail(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	entity := newLargeTestEntity()
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		return memcache.ErrServerError
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	if err := nds.Get(c, key, &largeTestEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entity must not have been cached without its chunks.
+	item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags == nds.ChunkedEntityItem {
+		t.Fatal("expected entity not to be cached")
+	}
+}
+
+func TestSetMaxCachedEntitySize(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	nds.SetMaxCachedEntitySize(1000)
+	defer nds.SetMaxCachedEntitySize(0)
+
+	type testEntity struct {
+		Data []byte
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	data := make([]byte, 2000)
+	rand.Read(data)
+	if _, err := nds.PutMulti(c, keys, []testEntity{
+		{[]byte("small")},
+		{data},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		entities := make([]testEntity, 2)
+		if err := nds.GetMulti(c, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(entities[1].Data, data) {
+			t.Fatal("incorrect data")
+		}
+	}
+
+	// Only the small entity is cached.
+	if item, err := memcache.Get(c, nds.MemcacheKey(c, keys[0])); err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity item", item.Flags)
+	}
+	if item, err := memcache.Get(c, nds.MemcacheKey(c, keys[1])); err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.TooLargeItem {
+		t.Fatal("expected too large item", item.Flags)
+	}
+
+	// Reads of the large entity go to the datastore without locking.
+	nds.SetMemcacheAddMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		t.Fatal("unexpected lock")
+		return nil
+	})
+	defer nds.SetMemcacheAddMulti(memcache.AddMulti)
+	entity := &testEntity{}
+	if err := nds.Get(c, keys[1], entity); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entity.Data, data) {
+		t.Fatal("incorrect data")
+	}
+}
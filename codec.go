@@ -0,0 +1,308 @@
+package nds
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// defaultCompressionThreshold is the size in bytes above which marshalled
+// entities are compressed before being stored in memcache.
+const defaultCompressionThreshold = 16 << 10
+
+// Codec marshals and unmarshals the entities nds stores in memcache.
+type Codec interface {
+	// ID identifies the codec. It is stored with every entity the codec
+	// marshals so that an entity is never unmarshalled by a codec that did
+	// not marshal it. IDs less than 16 are reserved for codecs provided by
+	// nds.
+	ID() byte
+
+	Marshal(pl datastore.PropertyList) ([]byte, error)
+	Unmarshal(data []byte, pl *datastore.PropertyList) error
+}
+
+// SetCodec sets the codec used to marshal entities stored in memcache. The
+// default codec uses encoding/gob. Cached entities marshalled by a different
+// codec are treated as cache misses, so changing the codec while an
+// application is serving requests only costs cache misses.
+func SetCodec(c Codec) {
+	updateConfig(func(cfg *config) {
+		cfg.codec = c
+	})
+}
+
+// SetCompressionThreshold sets the size in bytes above which entities are
+// compressed before being stored in memcache. The default is 16KB. Smaller
+// entities are stored uncompressed to save CPU, as are larger entities whose
+// bytes look random, such as those holding compressed or encrypted []byte
+// properties. A negative size disables compression. Entities already cached
+// are unaffected.
+func SetCompressionThreshold(size int) {
+	updateConfig(func(cfg *config) {
+		cfg.compressionThreshold = size
+	})
+}
+
+// SetCacheVersion sets the version stored with every entity cached in
+// memcache. Cached entities of any other version are treated as cache misses
+// and replaced when they are next read from the datastore. Changing the
+// version when deploying a change to the structs entities are loaded into
+// therefore invalidates every cached entity without flushing memcache. The
+// default version is zero.
+//
+// Instances running different versions replace each other's entities, so
+// each change should be deployed to every instance at once.
+func SetCacheVersion(v byte) {
+	updateConfig(func(cfg *config) {
+		cfg.cacheVersion = v
+	})
+}
+
+// Marshalled entities are prefixed with the codec ID followed by one of these
+// tags, so unmarshal knows how the remaining bytes are encoded, and the cache
+// version.
+const (
+	noCompressionTag byte = iota
+	flateCompressionTag
+)
+
+// marshalHeaderSize is the length of the codec ID, compression tag and cache
+// version.
+const marshalHeaderSize = 3
+
+func marshalPropertyList(pl datastore.PropertyList) ([]byte, error) {
+	cfg := loadConfig()
+	if cfg.codecRecorder == nil {
+		data, _, err := encodePropertyList(cfg, pl)
+		return data, err
+	}
+
+	start := timeNow()
+	data, codecSize, err := encodePropertyList(cfg, pl)
+	if err == nil {
+		cfg.codecRecorder(CodecStats{
+			Op:        OpMarshal,
+			Size:      len(data),
+			CodecSize: codecSize,
+			Duration:  timeNow().Sub(start),
+		})
+	}
+	return data, err
+}
+
+// encodePropertyList marshals pl with the codec of cfg and returns the
+// marshalled entity and the size of the codec output within it.
+func encodePropertyList(cfg *config, pl datastore.PropertyList) ([]byte,
+	int, error) {
+
+	codec := cfg.codec
+	data, err := codec.Marshal(pl)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	buf := bytes.Buffer{}
+	buf.Grow(marshalHeaderSize + len(data))
+	buf.WriteByte(codec.ID())
+
+	threshold := cfg.compressionThreshold
+	if threshold < 0 || len(data) <= threshold || looksIncompressible(data) {
+		buf.WriteByte(noCompressionTag)
+		buf.WriteByte(cfg.cacheVersion)
+		buf.Write(data)
+		return buf.Bytes(), len(data), nil
+	}
+
+	buf.WriteByte(flateCompressionTag)
+	buf.WriteByte(cfg.cacheVersion)
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	// Incompressible data is better left alone.
+	if buf.Len()-marshalHeaderSize >= len(data) {
+		buf.Reset()
+		buf.WriteByte(codec.ID())
+		buf.WriteByte(noCompressionTag)
+		buf.WriteByte(cfg.cacheVersion)
+		buf.Write(data)
+	}
+	return buf.Bytes(), len(data), nil
+}
+
+const (
+	// entropySampleSize is how many bytes looksIncompressible samples.
+	entropySampleSize = 4096
+
+	// incompressibleEntropy is the entropy in bits per byte above which
+	// data is not worth compressing.
+	incompressibleEntropy = 7.5
+)
+
+// looksIncompressible reports whether data, such as an entity holding an
+// already compressed or encrypted []byte, is unlikely to compress, so that
+// compressing it can be skipped to save CPU. It estimates the entropy of the
+// bytes of data from an evenly spread sample of them. Data that repeats
+// itself over long distances can compress despite a high entropy, but such
+// data is rare.
+func looksIncompressible(data []byte) bool {
+	stride := len(data) / entropySampleSize
+	if stride < 1 {
+		stride = 1
+	}
+
+	counts := [256]int{}
+	samples := 0
+	for i := 0; i < len(data); i += stride {
+		counts[data[i]]++
+		samples++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(samples)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy > incompressibleEntropy
+}
+
+func unmarshalPropertyList(data []byte, pl *datastore.PropertyList) error {
+	cfg := loadConfig()
+	if cfg.codecRecorder == nil {
+		_, err := decodePropertyList(cfg, data, pl)
+		return err
+	}
+
+	start := timeNow()
+	codecSize, err := decodePropertyList(cfg, data, pl)
+	if err == nil {
+		cfg.codecRecorder(CodecStats{
+			Op:        OpUnmarshal,
+			Size:      len(data),
+			CodecSize: codecSize,
+			Duration:  timeNow().Sub(start),
+		})
+	}
+	return err
+}
+
+// decodePropertyList unmarshals data, a marshalled entity, into pl with the
+// codec of cfg and returns the size of the codec input within it.
+func decodePropertyList(cfg *config, data []byte,
+	pl *datastore.PropertyList) (int, error) {
+
+	if len(data) < marshalHeaderSize {
+		return 0, errors.New("nds: marshalled entity is too short")
+	}
+
+	codec := cfg.codec
+	if data[0] != codec.ID() {
+		return 0, fmt.Errorf("nds: entity marshalled by codec %d not %d",
+			data[0], codec.ID())
+	}
+	if data[2] != cfg.cacheVersion {
+		return 0, fmt.Errorf("nds: entity cached with version %d not %d",
+			data[2], cfg.cacheVersion)
+	}
+
+	switch data[1] {
+	case noCompressionTag:
+		data = data[marshalHeaderSize:]
+		return len(data), codec.Unmarshal(data, pl)
+	case flateCompressionTag:
+		r := flate.NewReader(bytes.NewReader(data[marshalHeaderSize:]))
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return 0, err
+		}
+		return len(data), codec.Unmarshal(data, pl)
+	default:
+		return 0, fmt.Errorf("nds: unknown marshalled entity compression %d",
+			data[1])
+	}
+}
+
+// DecodeCacheItem decodes the value of a memcache item stored by nds with the
+// given flags. It returns datastore.ErrNoSuchEntity for an ItemFlagNone item
+// and an error for flags that do not hold a whole entity. The codec set with
+// SetCodec must be the one used to store the item.
+func DecodeCacheItem(value []byte, flags uint32) (
+	datastore.PropertyList, error) {
+
+	switch flags {
+	case entityItem:
+		pl := datastore.PropertyList{}
+		if err := unmarshal(value, &pl); err != nil {
+			return nil, err
+		}
+		return pl, nil
+	case noneItem:
+		return nil, datastore.ErrNoSuchEntity
+	default:
+		return nil, fmt.Errorf("nds: item flags %d do not hold an entity",
+			flags)
+	}
+}
+
+// RegisterCacheType registers the type of value with encoding/gob so that
+// property values of that type can be stored in memcache by the default codec.
+// nds already registers every property value type supported by the datastore
+// package. Other types, such as those returned by a custom
+// datastore.PropertyLoadSaver, must be registered before entities holding them
+// are cached, otherwise they are read from the datastore every time.
+//
+// Types must be registered identically by every instance of an application
+// that shares memcache, otherwise cached entities can fail to decode. It panics
+// in the same situations as gob.Register.
+//
+// RegisterCacheType should be called during initialization, before any other
+// nds function.
+func RegisterCacheType(value interface{}) {
+	gob.Register(value)
+}
+
+func init() {
+	gob.Register(time.Time{})
+	gob.Register(datastore.ByteString{})
+	gob.Register(&datastore.Key{})
+	gob.Register(appengine.BlobKey(""))
+	gob.Register(appengine.GeoPoint{})
+}
+
+// gobCodec is the default Codec. It uses encoding/gob.
+type gobCodec struct{}
+
+func (gobCodec) ID() byte {
+	return 0
+}
+
+func (gobCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(&pl); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, pl *datastore.PropertyList) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(pl)
+}
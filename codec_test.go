@@ -0,0 +1,221 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// countingCodec marshals a single string property and counts how often it is
+// used.
+type countingCodec struct {
+	id                   byte
+	marshals, unmarshals int
+}
+
+func (cc *countingCodec) ID() byte {
+	return cc.id
+}
+
+func (cc *countingCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	cc.marshals++
+	return []byte(pl[0].Value.(string)), nil
+}
+
+func (cc *countingCodec) Unmarshal(data []byte,
+	pl *datastore.PropertyList) error {
+	cc.unmarshals++
+	*pl = datastore.PropertyList{
+		datastore.Property{Name: "StringVal", Value: string(data)},
+	}
+	return nil
+}
+
+func TestSetCodec(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		StringVal string
+	}
+
+	cc := &countingCodec{id: 16}
+	nds.SetCodec(cc)
+	defer nds.SetCodec(nds.GobCodec)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{"value"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if cc.marshals != 1 {
+		t.Fatal("expected codec to marshal entity", cc.marshals)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if cc.unmarshals != 1 {
+		t.Fatal("expected codec to unmarshal entity", cc.unmarshals)
+	}
+	if entity.StringVal != "value" {
+		t.Fatal("incorrect StringVal", entity.StringVal)
+	}
+}
+
+func TestUnmarshalOtherCodec(t *testing.T) {
+	pl := datastore.PropertyList{
+		datastore.Property{Name: "StringVal", Value: "value"},
+	}
+
+	data, err := nds.MarshalPropertyList(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetCodec(&countingCodec{id: 17})
+	defer nds.SetCodec(nds.GobCodec)
+
+	err = nds.UnmarshalPropertyList(data, &datastore.PropertyList{})
+	if err == nil || !strings.Contains(err.Error(), "codec") {
+		t.Fatal("expected codec mismatch error", err)
+	}
+}
+
+func TestSetCacheVersion(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetCacheVersion(1)
+	defer nds.SetCacheVersion(0)
+
+	datastoreGets := 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		datastoreGets += len(keys)
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	// Entities of the old version are read from the datastore and replaced.
+	for i := 0; i < 2; i++ {
+		entity := testEntity{}
+		if err := nds.Get(c, key, &entity); err != nil {
+			t.Fatal(err)
+		} else if entity.IntVal != 1 {
+			t.Fatal("incorrect entity", entity)
+		}
+	}
+	if datastoreGets != 1 {
+		t.Fatal("expected one datastore get", datastoreGets)
+	}
+
+	item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.DecodeCacheItem(item.Value, item.Flags); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetCacheVersion(0)
+	if _, err := nds.DecodeCacheItem(item.Value,
+		item.Flags); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatal("expected version mismatch error", err)
+	}
+}
+
+type cacheTypeValue struct {
+	A, B int
+}
+
+func TestRegisterCacheType(t *testing.T) {
+	pl := datastore.PropertyList{
+		datastore.Property{Name: "Custom", Value: cacheTypeValue{1, 2}},
+	}
+
+	nds.RegisterCacheType(cacheTypeValue{})
+
+	data, err := nds.MarshalPropertyList(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := got[0].Value.(cacheTypeValue); !ok || v.A != 1 || v.B != 2 {
+		t.Fatal("incorrect value", got[0].Value)
+	}
+}
+
+func TestDecodeCacheItem(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err == nil {
+		t.Fatal("expected no such entity error")
+	}
+
+	item, err := memcache.Get(c, nds.MemcacheKey(c, keys[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.ItemFlagEntity {
+		t.Fatal("expected entity item", item.Flags)
+	}
+	pl, err := nds.DecodeCacheItem(item.Value, item.Flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pl) != 1 || pl[0].Name != "IntVal" || pl[0].Value != int64(1) {
+		t.Fatal("incorrect property list", pl)
+	}
+
+	item, err = memcache.Get(c, nds.MemcacheKey(c, keys[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.DecodeCacheItem(item.Value,
+		item.Flags); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	if _, err := nds.DecodeCacheItem([]byte{1, 2, 3, 4},
+		nds.ItemFlagLock); err == nil {
+		t.Fatal("expected lock item error")
+	}
+}
@@ -0,0 +1,103 @@
+package nds
+
+import (
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	// computeWaitInterval is how long GetOrCompute waits between checks of
+	// an entity locked by another call.
+	computeWaitInterval = 50 * time.Millisecond
+
+	// computeWaitAttempts is how many times GetOrCompute checks a locked
+	// entity before computing it without caching the result.
+	computeWaitAttempts = 20
+)
+
+// GetOrCompute returns the entity cached for key or, on a cache miss, the
+// entity returned by compute, which is then cached. compute is run while
+// holding the memcache lock of key, in the same way as GetMulti reads the
+// datastore, so concurrent calls for the same uncached key do not all run
+// compute. A call that finds key locked by another call waits for up to one
+// second for the entity to be cached before running compute itself without
+// caching the result.
+//
+// compute can return datastore.ErrNoSuchEntity to cache that there is no
+// entity, which GetOrCompute then returns. Any other error is returned without
+// caching anything, and key stays locked until its lock expires.
+//
+// Use key kinds with no datastore entities, as GetMulti returns the cached
+// entities of any key. Put, PutMulti, Delete, DeleteMulti and Invalidate
+// invalidate computed entities just like datastore entities. Transactions,
+// contexts created with WithNoCache and calls made while the circuit breaker
+// is open run compute without using memcache.
+func GetOrCompute(c context.Context, key *datastore.Key,
+	compute func() (datastore.PropertyList, error)) (
+	datastore.PropertyList, error) {
+
+	if key == nil || key.Incomplete() {
+		return nil, datastore.ErrInvalidKey
+	}
+
+	_, inTransaction := transactionFromContext(c)
+	if inTransaction || optionsFromContext(c).noCache || !memcacheAllowed() {
+		return compute()
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	memcacheKey := createMemcacheKey(c, key)
+	for attempt := 1; ; attempt++ {
+		pl := datastore.PropertyList{}
+		cacheItems := []cacheItem{{
+			key:         key,
+			memcacheKey: memcacheKey,
+			val:         reflect.ValueOf(&pl).Elem(),
+			noCache:     keyNoCacheProperties(key, nil),
+			state:       miss,
+		}}
+
+		loadMemcache(memcacheCtx, cacheItems)
+		lockMemcache(memcacheCtx, cacheItems)
+
+		switch cacheItem := &cacheItems[0]; cacheItem.state {
+		case done:
+			if cacheItem.err != nil {
+				return nil, cacheItem.err
+			}
+			return pl, nil
+		case internalLock, unlocked:
+			computed, err := compute()
+			switch err {
+			case nil:
+				setEntityItem(c, cacheItem, computed)
+			case datastore.ErrNoSuchEntity:
+				setNoneItem(c, cacheItem)
+			default:
+				return nil, err
+			}
+			saveMemcache(memcacheCtx, cacheItems)
+			if err != nil {
+				return nil, err
+			}
+			return computed, nil
+		}
+
+		// Only wait for locks held by other calls, not memcache failures.
+		if !cacheItems[0].locked || attempt == computeWaitAttempts {
+			return compute()
+		}
+		select {
+		case <-time.After(computeWaitInterval):
+		case <-c.Done():
+			return nil, c.Err()
+		}
+	}
+}
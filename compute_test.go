@@ -0,0 +1,102 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestGetOrCompute(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	key := datastore.NewKey(c, "Computed", "", 1, nil)
+	computeCount := 0
+	compute := func() (datastore.PropertyList, error) {
+		computeCount++
+		return datastore.PropertyList{
+			{Name: "IntVal", Value: int64(computeCount)},
+		}, nil
+	}
+
+	// Compute and then get from memcache.
+	for i := 0; i < 2; i++ {
+		pl, err := nds.GetOrCompute(c, key, compute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pl) != 1 || pl[0].Value != int64(1) {
+			t.Fatal("incorrect entity", pl)
+		}
+	}
+	if computeCount != 1 {
+		t.Fatal("incorrect compute count", computeCount)
+	}
+
+	// A put invalidates the computed entity.
+	type testEntity struct {
+		IntVal int64
+	}
+	if _, err := nds.Put(c, key, &testEntity{10}); err != nil {
+		t.Fatal(err)
+	}
+	if pl, err := nds.GetOrCompute(c, key, compute); err != nil {
+		t.Fatal(err)
+	} else if pl[0].Value != int64(2) {
+		t.Fatal("incorrect entity", pl)
+	}
+}
+
+func TestGetOrComputeNoSuchEntity(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	key := datastore.NewKey(c, "Computed", "", 1, nil)
+	computeCount := 0
+	compute := func() (datastore.PropertyList, error) {
+		computeCount++
+		return nil, datastore.ErrNoSuchEntity
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := nds.GetOrCompute(c, key,
+			compute); err != datastore.ErrNoSuchEntity {
+			t.Fatal("expected datastore.ErrNoSuchEntity", err)
+		}
+	}
+	if computeCount != 1 {
+		t.Fatal("incorrect compute count", computeCount)
+	}
+}
+
+func TestGetOrComputeError(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	key := datastore.NewKey(c, "Computed", "", 1, nil)
+	computeErr := errors.New("compute error")
+	if _, err := nds.GetOrCompute(c, key,
+		func() (datastore.PropertyList, error) {
+			return nil, computeErr
+		}); err != computeErr {
+		t.Fatal("expected compute error", err)
+	}
+
+	// Nothing is cached but the key stays locked.
+	item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.ItemFlagLock {
+		t.Fatal("expected lock item", item.Flags)
+	}
+
+	if _, err := nds.GetOrCompute(c, nil,
+		func() (datastore.PropertyList, error) {
+			return nil, nil
+		}); err != datastore.ErrInvalidKey {
+		t.Fatal("expected datastore.ErrInvalidKey", err)
+	}
+}
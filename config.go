@@ -0,0 +1,97 @@
+package nds
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// config holds the package settings changed by functions such as SetCodec
+// and SetLogger. The current config is never modified. updateConfig replaces
+// it with a modified copy instead, so the Set functions do not race with
+// calls already using the previous config.
+type config struct {
+	cache                Cache
+	codec                Codec
+	compressionThreshold int
+	cacheVersion         byte
+	keyHasher            KeyHasher
+	logger               Logger
+	statsRecorder        func(s Stats)
+	codecRecorder        func(s CodecStats)
+	simpleCacheKinds     map[string]bool
+	casRetries           int
+	casBackoff           func(attempt int) time.Duration
+	breaker              *breaker
+	maxConcurrentCalls   int
+	maxCachedEntitySize  int
+	shadowReadRate       float64
+	derivedKeys          func(key *datastore.Key) []*datastore.Key
+	transactionBackoff   func(attempt int) time.Duration
+	divergenceHook       func(c context.Context, key *datastore.Key,
+		cached, stored datastore.PropertyList)
+}
+
+var (
+	// currentConfig holds a *config.
+	currentConfig atomic.Value
+
+	// configMutex serialises updateConfig calls so that none are lost.
+	configMutex sync.Mutex
+)
+
+func init() {
+	currentConfig.Store(&config{
+		cache:                appengineCache{},
+		codec:                gobCodec{},
+		compressionThreshold: defaultCompressionThreshold,
+		logger:               appengineLogger,
+		simpleCacheKinds:     map[string]bool{},
+		breaker:              &breaker{},
+		maxConcurrentCalls:   defaultMaxConcurrentCalls,
+	})
+}
+
+// defaultMaxConcurrentCalls is the default limit set with
+// SetMaxConcurrentCalls.
+const defaultMaxConcurrentCalls = 4
+
+// SetMaxConcurrentCalls sets how many batches of keys a single call, such as
+// a GetMulti of more keys than the datastore allows at once, processes at the
+// same time. Each batch makes its memcache and datastore calls in turn, so the
+// limit applies to both. The default is 4 so that one very large call cannot
+// use up the RPC quota of an instance. A limit of zero or less processes every
+// batch at once.
+func SetMaxConcurrentCalls(n int) {
+	updateConfig(func(cfg *config) {
+		cfg.maxConcurrentCalls = n
+	})
+}
+
+// newCallLimiter returns a semaphore limiting how many of count batches are
+// processed at the same time. Send to it before starting a batch and receive
+// from it once the batch is done.
+func newCallLimiter(count int) chan struct{} {
+	if n := loadConfig().maxConcurrentCalls; n > 0 && n < count {
+		return make(chan struct{}, n)
+	}
+	return make(chan struct{}, count)
+}
+
+// loadConfig returns the current config. It must not be modified.
+func loadConfig() *config {
+	return currentConfig.Load().(*config)
+}
+
+// updateConfig replaces the current config with a copy modified by f.
+func updateConfig(f func(cfg *config)) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	cfg := *loadConfig()
+	f(&cfg)
+	currentConfig.Store(&cfg)
+}
@@ -0,0 +1,129 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// TestConcurrentConfig changes settings while GetMulti is in use. Run it with
+// the -race flag to detect data races.
+func TestConcurrentConfig(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := make([]*datastore.Key, 10)
+	entities := make([]testEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+		entities[i] = testEntity{i}
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		nds.SetCodec(nds.GobCodec)
+		nds.SetCompressionThreshold(16 << 10)
+		nds.SetLogger(nds.AppengineLogger)
+		nds.SetStatsRecorder(nil)
+		nds.SetSimpleCacheKinds(nil)
+		nds.SetCASRetries(0, nil)
+		nds.SetCircuitBreaker(0, 0, 0)
+	}()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			nds.SetCodec(nds.GobCodec)
+			nds.SetCompressionThreshold(i % 100)
+			nds.SetLogger(func(c context.Context, level nds.LogLevel,
+				msg string, fields map[string]interface{}) {
+			})
+			nds.SetStatsRecorder(func(s nds.Stats) {})
+			nds.SetSimpleCacheKinds([]string{"Other"})
+			nds.SetCASRetries(i%2, nil)
+			nds.SetCircuitBreaker(10, time.Second, time.Second)
+		}
+	}()
+
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			response := make([]testEntity, len(keys))
+			errs <- nds.GetMulti(c, keys, response)
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestSetMaxConcurrentCalls(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.SetMaxConcurrentCalls(2)
+	defer nds.SetMaxConcurrentCalls(4)
+
+	var mu sync.Mutex
+	calls, maxCalls := 0, 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		mu.Lock()
+		calls++
+		if calls > maxCalls {
+			maxCalls = calls
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		calls--
+		mu.Unlock()
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	keys := make([]*datastore.Key, 5000)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+	}
+	err := nds.GetMulti(nds.WithNoCache(c), keys, make([]testEntity, len(keys)))
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", me[0])
+	}
+
+	if maxCalls != 2 {
+		t.Fatal("incorrect concurrent calls", maxCalls)
+	}
+}
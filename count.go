@@ -0,0 +1,69 @@
+package nds
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Count returns the number of results for q, caching it in memcache for ttl.
+// Counts are cached under a hash of the whole query and the namespace of c so
+// different queries never share a count. Queries are eventually consistent so
+// a count up to ttl old is usually acceptable, but unlike entities, cached
+// counts are not invalidated by Put, PutMulti, Delete and DeleteMulti. ttl
+// must be at least one second as that is the memcache expiration granularity.
+//
+// Count does not cache counts within transactions or contexts created with
+// WithNoCache.
+func Count(c context.Context, q *datastore.Query, ttl time.Duration) (
+	int, error) {
+
+	if ttl < time.Second {
+		return 0, errors.New("nds: count ttl is less than a second")
+	}
+
+	_, useDatastore := transactionFromContext(c)
+	if useDatastore || optionsFromContext(c).noCache ||
+		!memcacheAllowed() {
+		return datastoreCount(q, c)
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return 0, err
+	}
+
+	memcacheKey, ok := createQueryKey(c, "count", q)
+	if !ok {
+		return datastoreCount(q, c)
+	}
+	items, err := tracedMemcacheGetMulti(memcacheCtx, []string{memcacheKey})
+	if err != nil {
+		logEvent(c, LogWarning, "nds:Count GetMulti", "error", err)
+	} else if item, ok := items[memcacheKey]; ok && item.Flags == countItem {
+		if count, err := strconv.Atoi(string(item.Value)); err == nil {
+			return count, nil
+		}
+		logEvent(c, LogWarning, "nds:Count invalid item value",
+			"value", string(item.Value))
+	}
+
+	count, err := datastoreCount(q, c)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tracedMemcacheSetMulti(memcacheCtx, []*memcache.Item{{
+		Key:        memcacheKey,
+		Flags:      countItem,
+		Value:      []byte(strconv.Itoa(count)),
+		Expiration: ttl,
+	}}); err != nil {
+		logEvent(c, LogWarning, "nds:Count SetMulti", "error", err)
+	}
+	return count, nil
+}
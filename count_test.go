@@ -0,0 +1,88 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestCount(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+		datastore.NewKey(c, "Entity", "", 3, parent),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := 0
+	nds.SetDatastoreCount(func(q *datastore.Query,
+		c context.Context) (int, error) {
+		counts++
+		return q.Count(c)
+	})
+	defer nds.SetDatastoreCount((*datastore.Query).Count)
+
+	countQuery := func(q *datastore.Query) int {
+		count, err := nds.Count(c, q, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	q := datastore.NewQuery("Entity").Ancestor(parent)
+	if count := countQuery(q); count != 3 {
+		t.Fatal("incorrect count", count)
+	}
+
+	// The same query is counted from memcache.
+	q = datastore.NewQuery("Entity").Ancestor(parent)
+	if count := countQuery(q); count != 3 {
+		t.Fatal("incorrect count", count)
+	}
+	if counts != 1 {
+		t.Fatal("expected one datastore count", counts)
+	}
+
+	// Different filters are different queries.
+	if count := countQuery(q.Filter("IntVal >", 1)); count != 2 {
+		t.Fatal("incorrect count", count)
+	}
+	if count := countQuery(q.Filter("IntVal >", 2)); count != 1 {
+		t.Fatal("incorrect count", count)
+	}
+
+	// A different ancestor is a different query.
+	other := datastore.NewKey(c, "Parent", "", 2, nil)
+	if count := countQuery(datastore.NewQuery("Entity").
+		Ancestor(other)); count != 0 {
+		t.Fatal("incorrect count", count)
+	}
+	if counts != 4 {
+		t.Fatal("expected four datastore counts", counts)
+	}
+}
+
+func TestCountTTL(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	q := datastore.NewQuery("Entity")
+	if _, err := nds.Count(c, q, time.Millisecond); err == nil {
+		t.Fatal("expected ttl error")
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/memcache"
 )
 
 // deleteMultiLimit is the App Engine datastore limit for the maximum number
@@ -17,11 +16,21 @@ const deleteMultiLimit = 500
 // cache consistency with other NDS methods. It also removes the API limit of
 // 500 entities per request by calling the datastore as many times as required
 // to put all the keys. It does this efficiently and concurrently.
+//
+// The memcache items of keys are locked before the entities are deleted and
+// the locks are left to expire rather than being deleted afterwards. So
+// DeleteMulti never removes a lock taken by a concurrent Put or Invalidate,
+// and no entity is cached for keys until the lock time has passed or they are
+// put again.
 func DeleteMulti(c context.Context, keys []*datastore.Key) error {
 
+	c, record := startStats(c, Stats{Op: OpDelete, Keys: len(keys)})
+	defer record()
+
 	callCount := (len(keys)-1)/deleteMultiLimit + 1
 	errs := make([]error, callCount)
 
+	limiter := newCallLimiter(callCount)
 	var wg sync.WaitGroup
 	wg.Add(callCount)
 	for i := 0; i < callCount; i++ {
@@ -31,8 +40,10 @@ func DeleteMulti(c context.Context, keys []*datastore.Key) error {
 			hi = len(keys)
 		}
 
+		limiter <- struct{}{}
 		go func(i int, keys []*datastore.Key) {
 			errs[i] = deleteMulti(c, keys)
+			<-limiter
 			wg.Done()
 		}(i, keys[lo:hi])
 	}
@@ -45,8 +56,13 @@ func DeleteMulti(c context.Context, keys []*datastore.Key) error {
 	return groupErrors(errs, len(keys), deleteMultiLimit)
 }
 
-// Delete deletes the entity for the given key.
+// Delete deletes the entity for the given key. It locks memcache in the same
+// way as DeleteMulti and returns a plain error rather than an
+// appengine.MultiError.
 func Delete(c context.Context, key *datastore.Key) error {
+	c, record := startStats(c, Stats{Op: OpDelete, Keys: 1})
+	defer record()
+
 	err := deleteMulti(c, []*datastore.Key{key})
 	if me, ok := err.(appengine.MultiError); ok {
 		return me[0]
@@ -56,22 +72,9 @@ func Delete(c context.Context, key *datastore.Key) error {
 
 func deleteMulti(c context.Context, keys []*datastore.Key) error {
 
-	lockMemcacheItems := []*memcache.Item{}
-	for _, key := range keys {
-		// Worst case scenario is that we lock the entity for memcacheLockTime.
-		// datastore.Delete will raise the appropriate error.
-		if key == nil || key.Incomplete() {
-			continue
-		}
-
-		item := &memcache.Item{
-			Key:        createMemcacheKey(key),
-			Flags:      lockItem,
-			Value:      itemLock(),
-			Expiration: memcacheLockTime,
-		}
-		lockMemcacheItems = append(lockMemcacheItems, item)
-	}
+	// Worst case scenario is that we lock the entity for the lock time.
+	// datastore.Delete will raise the appropriate error.
+	lockMemcacheItems := createLockItems(c, keys)
 
 	memcacheCtx, err := memcacheContext(c)
 	if err != nil {
@@ -80,14 +83,19 @@ func deleteMulti(c context.Context, keys []*datastore.Key) error {
 
 	// Make sure we can lock memcache with no errors before deleting.
 	if tx, ok := transactionFromContext(c); ok {
-		tx.Lock()
-		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
-			lockMemcacheItems...)
-		tx.Unlock()
-	} else if err := memcacheSetMulti(memcacheCtx,
+		tx.add(lockMemcacheItems, keys)
+	} else if err := tracedMemcacheSetMulti(memcacheCtx,
 		lockMemcacheItems); err != nil {
 		return err
+	} else {
+		defer invalidateLocalCache(c, keys)
 	}
 
-	return datastoreDeleteMulti(c, keys)
+	// Invalidate the local cache both before and after deleting so that no
+	// concurrent GetMulti can store the old entities in it. Within a
+	// transaction the entities only change when it commits, so
+	// RunInTransaction invalidates them again then.
+	invalidateLocalCache(c, keys)
+
+	return tracedDatastoreDeleteMulti(c, keys)
 }
@@ -142,3 +142,126 @@ func TestDeleteInTransaction(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDeleteMultiConcurrentLock(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer locks the entity while it is being deleted.
+	var token []byte
+	nds.SetDatastoreDeleteMulti(func(c context.Context,
+		keys []*datastore.Key) error {
+		var err error
+		if token, err = nds.Lock(c, key); err != nil {
+			t.Fatal(err)
+		}
+		return datastore.DeleteMulti(c, keys)
+	})
+	defer nds.SetDatastoreDeleteMulti(datastore.DeleteMulti)
+
+	nds.SetMemcacheDeleteMulti(func(c context.Context, keys []string) error {
+		t.Fatal("memcache items deleted")
+		return nil
+	})
+	defer nds.SetMemcacheDeleteMulti(memcache.DeleteMulti)
+
+	if err := nds.DeleteMulti(c, []*datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := nds.VerifyLock(c, key, token); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected lock of other writer to be kept")
+	}
+
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
+
+func TestDeleteMultiInterleavedReads(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader between the lock and the datastore delete reads the entity
+	// from the datastore without caching it.
+	nds.SetDatastoreDeleteMulti(func(c context.Context,
+		keys []*datastore.Key) error {
+		entity := &testEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 1 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+		return datastore.DeleteMulti(c, keys)
+	})
+	if err := nds.DeleteMulti(c, []*datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+	nds.SetDatastoreDeleteMulti(datastore.DeleteMulti)
+
+	item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.LockItem {
+		t.Fatal("expected the delete lock, got flags", item.Flags)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	// A reader that read the entity before it was deleted cannot cache it
+	// as the delete replaced the lock of the reader.
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		err := datastore.GetMulti(c, keys, vals)
+		if err := nds.Delete(c, key); err != nil {
+			t.Fatal(err)
+		}
+		return err
+	})
+	entity := &testEntity{}
+	err = nds.Get(c, key, entity)
+	nds.SetDatastoreGetMulti(datastore.GetMulti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 2 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+	item, err = memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.LockItem {
+		t.Fatal("expected the delete lock, got flags", item.Flags)
+	}
+}
@@ -0,0 +1,56 @@
+package nds
+
+import "google.golang.org/appengine/datastore"
+
+// SetDerivedKeys sets a function returning the keys of the items derived from
+// the entity of key, such as a cached count of the comments of a post. Put,
+// PutMulti, Delete, DeleteMulti, Invalidate and transactions then lock the
+// memcache items of the derived keys whenever they lock the item of key, so
+// derived items share the invalidation lifecycle of their entity. A nil f, the
+// default, derives no keys.
+//
+// Cache derived items with GetOrCompute under derived keys of a kind with no
+// datastore entities. GetOrCompute follows the same locking protocol as
+// GetMulti, so an item computed from an entity that is being changed is never
+// cached. As with entities, derived items are not cached again until the locks
+// taken by Delete, DeleteMulti and Invalidate expire.
+//
+// f must return the same keys for a key on every instance sharing memcache, so
+// it should only depend on key itself. Incomplete keys have no memcache items,
+// so the entities put with them lock no derived items.
+func SetDerivedKeys(f func(key *datastore.Key) []*datastore.Key) {
+	updateConfig(func(cfg *config) {
+		cfg.derivedKeys = f
+	})
+}
+
+// withDerivedKeys returns keys followed by the derived keys of each of them
+// that are not already in keys.
+func withDerivedKeys(keys []*datastore.Key) []*datastore.Key {
+	f := loadConfig().derivedKeys
+	if f == nil {
+		return keys
+	}
+
+	all := append([]*datastore.Key(nil), keys...)
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key != nil && !key.Incomplete() {
+			seen[key.Encode()] = true
+		}
+	}
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		for _, derived := range f(key) {
+			if derived == nil || derived.Incomplete() ||
+				seen[derived.Encode()] {
+				continue
+			}
+			seen[derived.Encode()] = true
+			all = append(all, derived)
+		}
+	}
+	return all
+}
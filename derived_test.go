@@ -0,0 +1,117 @@
+package nds_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestSetDerivedKeys(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	countKey := func(key *datastore.Key) *datastore.Key {
+		return datastore.NewKey(c, "Count", "", key.IntID(), nil)
+	}
+	nds.SetDerivedKeys(func(key *datastore.Key) []*datastore.Key {
+		if key.Kind() != "Entity" {
+			return nil
+		}
+		return []*datastore.Key{countKey(key)}
+	})
+	defer nds.SetDerivedKeys(nil)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	computed := 0
+	compute := func() (datastore.PropertyList, error) {
+		computed++
+		return datastore.PropertyList{
+			{Name: "Count", Value: int64(computed)},
+		}, nil
+	}
+
+	getCount := func() int64 {
+		pl, err := nds.GetOrCompute(c, countKey(key), compute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pl[0].Value.(int64)
+	}
+
+	// The derived item is cached until its entity is put.
+	if count := getCount(); count != 1 {
+		t.Fatal("incorrect count", count)
+	}
+	if count := getCount(); count != 1 {
+		t.Fatal("expected cached count", count)
+	}
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if count := getCount(); count != 2 {
+		t.Fatal("expected recomputed count", count)
+	}
+	if count := getCount(); count != 2 {
+		t.Fatal("expected cached count", count)
+	}
+
+	// Deletes leave the derived item locked so it is computed again.
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if count := getCount(); count != 3 {
+		t.Fatal("expected recomputed count", count)
+	}
+}
+
+func TestLockDerivedKeys(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	derivedKey := datastore.NewKey(c, "Count", "", 1, nil)
+	nds.SetDerivedKeys(func(k *datastore.Key) []*datastore.Key {
+		if k.Kind() != "Entity" {
+			return nil
+		}
+		return []*datastore.Key{derivedKey}
+	})
+	defer nds.SetDerivedKeys(nil)
+
+	token, err := nds.Lock(c, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The derived item is locked with the same token.
+	derivedMemcacheKey := nds.MemcacheKey(c, derivedKey)
+	item, err := memcache.Get(c, derivedMemcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.ItemFlagLock || !bytes.Equal(item.Value, token) {
+		t.Fatal("expected derived lock", item.Flags)
+	}
+	if ok, err := nds.VerifyLock(c, key, token); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected lock to be held")
+	}
+
+	// Losing the derived lock loses the lock.
+	if err := memcache.Delete(c, derivedMemcacheKey); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := nds.VerifyLock(c, key, token); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected lock to be lost")
+	}
+}
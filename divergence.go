@@ -0,0 +1,96 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// SetDivergenceHook sets a function that GetMulti calls when it has read an
+// entity from the datastore under its memcache lock, failed to cache it
+// because the memcache item was changed in the meantime, and found that the
+// item now holds a different entity. cached is the entity held by memcache and
+// stored the one read from the datastore. Either is nil for a key with no
+// entity. Use it to detect invalidation bugs, such as code changing entities
+// without nds. A nil hook, the default, skips the check, which costs an extra
+// memcache call whenever an entity could not be cached.
+//
+// GetMulti always returns the datastore entity. The cached entity is left in
+// memcache rather than replaced, as it may have been cached by another call
+// that read the datastore after a later write, in which case it is newer than
+// stored. Replacing it could therefore make memcache stale. Invalidate the key
+// from the hook to remove a cached entity that is known to be wrong.
+func SetDivergenceHook(hook func(c context.Context, key *datastore.Key,
+	cached, stored datastore.PropertyList)) {
+
+	updateConfig(func(cfg *config) {
+		cfg.divergenceHook = hook
+	})
+}
+
+// checkDivergence passes the entities of cacheItems that could not be cached
+// because their memcache items were changed to the divergence hook, if there
+// is one, when those items now hold different entities.
+func checkDivergence(c, memcacheCtx context.Context, cacheItems []cacheItem) {
+	hook := loadConfig().divergenceHook
+	if hook == nil {
+		return
+	}
+
+	memcacheKeys := []string{}
+	for _, cacheItem := range cacheItems {
+		if isDivergenceCandidate(cacheItem) {
+			memcacheKeys = append(memcacheKeys, cacheItem.memcacheKey)
+		}
+	}
+	if len(memcacheKeys) == 0 {
+		return
+	}
+
+	items, err := tracedMemcacheGetMulti(memcacheCtx, memcacheKeys)
+	if err != nil {
+		logEvent(c, LogWarning, "nds:checkDivergence GetMulti", "error", err)
+		return
+	}
+	loadChunks(memcacheCtx, items)
+
+	for _, cacheItem := range cacheItems {
+		if !isDivergenceCandidate(cacheItem) {
+			continue
+		}
+		item, ok := items[cacheItem.memcacheKey]
+		if !ok {
+			continue
+		}
+		var cached datastore.PropertyList
+		switch item.Flags {
+		case entityItem:
+			cached = datastore.PropertyList{}
+			if err := unmarshal(item.Value, &cached); err != nil {
+				continue
+			}
+		case noneItem:
+		default:
+			// Locks and unknown items hold no entity.
+			continue
+		}
+
+		var stored datastore.PropertyList
+		if cacheItem.pl != nil {
+			stored = removeNoCacheProperties(cacheItem.pl, cacheItem.noCache)
+		}
+		if (cached == nil) != (stored == nil) ||
+			stored != nil && !reflect.DeepEqual(cached, stored) {
+			hook(c, cacheItem.key, cached, cacheItem.pl)
+		}
+	}
+}
+
+// isDivergenceCandidate reports whether cacheItem holds an entity, or the
+// absence of one, read from the datastore that could not be cached because of
+// a failed CompareAndSwap.
+func isDivergenceCandidate(cacheItem cacheItem) bool {
+	return cacheItem.casFailed && (cacheItem.pl != nil ||
+		cacheItem.err == datastore.ErrNoSuchEntity)
+}
@@ -0,0 +1,94 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestSetDivergenceHook(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	var divergedKey *datastore.Key
+	var cached, stored datastore.PropertyList
+	nds.SetDivergenceHook(func(c context.Context, key *datastore.Key,
+		cachedPl, storedPl datastore.PropertyList) {
+		divergedKey, cached, stored = key, cachedPl, storedPl
+	})
+	defer nds.SetDivergenceHook(nil)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Something other than nds caches a different entity while GetMulti holds
+	// the lock.
+	setItem := func(value int64) {
+		data, err := nds.MarshalPropertyList(datastore.PropertyList{
+			{Name: "IntVal", Value: value},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := memcache.Set(c, &memcache.Item{
+			Key:   nds.MemcacheKey(c, key),
+			Flags: nds.EntityItem,
+			Value: data,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var value int64
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		setItem(value)
+		return appengine.MultiError{memcache.ErrCASConflict}
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	// The same entity does not diverge.
+	value = 1
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if divergedKey != nil {
+		t.Fatal("unexpected divergence", cached, stored)
+	}
+	if err := memcache.Delete(c, nds.MemcacheKey(c, key)); err != nil {
+		t.Fatal(err)
+	}
+
+	value = 2
+	entity = &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 1 {
+		t.Fatal("expected datastore entity", entity.IntVal)
+	}
+	if !divergedKey.Equal(key) || cached[0].Value != int64(2) ||
+		stored[0].Value != int64(1) {
+		t.Fatal("incorrect divergence", divergedKey, cached, stored)
+	}
+
+	// The cached entity is left alone.
+	cachedEntity := &testEntity{}
+	nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+	if err := nds.Get(c, key, cachedEntity); err != nil {
+		t.Fatal(err)
+	}
+	if cachedEntity.IntVal != 2 {
+		t.Fatal("expected cached entity", cachedEntity.IntVal)
+	}
+}
@@ -22,6 +22,50 @@ calls to use nds when converting your own code.
 If you mix appengine/datastore and nds API calls then you are liable to get
 stale cache.
 
+Contexts
+
+All nds functions take the same context.Context as
+google.golang.org/appengine, so there is no separate API for the legacy
+appengine.Context type. Code migrating from appengine.Context can pass the
+contexts it gets from appengine.NewContext directly to nds. Cancellation and
+deadlines of a context are honored by the datastore and memcache calls nds
+makes with it.
+
+Firestore in Datastore Mode
+
+The caching strategy only relies on datastore gets by key and transaction
+commits being strongly consistent, which they are in both the legacy datastore
+and Firestore in Datastore mode. Gets and queries within RunInTransaction
+always use the datastore directly, and the memcache locks of the keys a
+transaction changes are taken before it commits and left to expire, whether
+the commit succeeds or is retried. Neither depends on how the datastore
+isolates transactions, so nds needs no changes for Firestore in Datastore mode.
+
+Firestore in Datastore mode applies a write as soon as it is committed, so the
+datastore never retries a write after reporting success. The default memcache
+lock time allows for such retries, so applications using Firestore in Datastore
+mode can safely use a shorter one with WithMemcacheLockTime.
+
+Uncached Fields
+
+Struct fields tagged with nds:"nocache" are saved to and loaded from the
+datastore as usual but are removed from the entities nds caches in memcache,
+which suits fields that are sensitive or cheap to recompute.
+
+	type Account struct {
+		Name  string
+		Token string `nds:"nocache"`
+	}
+
+When an entity is got from memcache such fields are left as they were in the
+destination, so zero values for new destinations. A tagged struct field removes
+all of its nested fields. Types implementing datastore.PropertyLoadSaver cannot
+use the tag. The memcache item of a key is shared by every type its entity is
+got into, so all the struct types used with a kind should tag the same fields.
+Calls that cache entities without loading them into a struct, such as
+PrimeCache and GetMulti into a []datastore.PropertyList, only leave out the
+fields of the types registered for their kinds with RegisterNoCacheKind.
+
 Converting Legacy Code
 
 To convert legacy code you will need to find and replace all invocations of
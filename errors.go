@@ -0,0 +1,150 @@
+package nds
+
+import (
+	"strconv"
+	"strings"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// CacheError is returned when a datastore operation succeeded but nds failed
+// to update memcache afterwards. The datastore is in the expected state and
+// cache consistency is not compromised, although the affected entities may be
+// read from the datastore rather than memcache for a while. Callers can use
+// errors.As to detect a CacheError and choose to ignore it.
+//
+// Put and PutMulti return a CacheError, along with the put keys, when they
+// cannot remove their memcache locks. Get and GetMulti only return a
+// CacheError for contexts created with WithStrictCache, as otherwise memcache
+// failures never affect what they return.
+type CacheError struct {
+	// Err is the memcache error.
+	Err error
+}
+
+func (e *CacheError) Error() string {
+	return "nds: cache error: " + e.Err.Error()
+}
+
+// Unwrap returns the memcache error.
+func (e *CacheError) Unwrap() error {
+	return e.Err
+}
+
+// CodecError is returned when the entity of a key cannot be marshalled for
+// memcache or unmarshalled from it. PutMultiValidate returns it in the
+// appengine.MultiError slot of the key, and GetAll returns it if a query
+// result cannot be cached. Get and GetMulti only log it as they fall back to
+// the datastore.
+type CodecError struct {
+	// Key is the key of the entity.
+	Key *datastore.Key
+
+	// Err is the codec error.
+	Err error
+}
+
+func (e *CodecError) Error() string {
+	msg := "nds: codec error for key " + e.Key.String() + ": " + e.Err.Error()
+	if strings.Contains(e.Err.Error(), "type not registered") {
+		msg += " (register the type with RegisterCacheType)"
+	}
+	return msg
+}
+
+// Unwrap returns the codec error.
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+// KeyError is an error of a single key of a multi key call, as returned by
+// FirstError.
+type KeyError struct {
+	// Index is the index of the key in the keys of the call.
+	Index int
+
+	// Err is the error of the key.
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return "nds: key " + strconv.Itoa(e.Index) + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the key.
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// FirstError returns the first error of err as a *KeyError if err is an
+// appengine.MultiError, for callers that treat any error of a multi key call
+// as failing the whole call. It returns nil for an appengine.MultiError holding
+// no errors, and any other err unchanged.
+func FirstError(err error) error {
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+	for i, e := range me {
+		if e != nil {
+			return &KeyError{Index: i, Err: e}
+		}
+	}
+	return nil
+}
+
+// isCacheMissErrors reports whether err only reports memcache.ErrCacheMiss
+// errors. Deleting an item that has already expired or been evicted
+// gives such an error.
+func isCacheMissErrors(err error) bool {
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err == memcache.ErrCacheMiss
+	}
+	for _, e := range me {
+		if e != nil && e != memcache.ErrCacheMiss {
+			return false
+		}
+	}
+	return true
+}
+
+// FieldMismatchError is returned by Get and GetMulti for contexts created with
+// WithIgnoreFieldMismatch when the only errors are datastore.ErrFieldMismatch.
+// Every entity has been loaded as far as possible so it can usually be
+// ignored.
+type FieldMismatchError struct {
+	// Errs is aligned with the keys of the call. It holds the
+	// *datastore.ErrFieldMismatch of each key that gave one and nil for the
+	// others.
+	Errs appengine.MultiError
+}
+
+func (e *FieldMismatchError) Error() string {
+	return "nds: field mismatch: " + e.Errs.Error()
+}
+
+func isFieldMismatch(err error) bool {
+	_, ok := err.(*datastore.ErrFieldMismatch)
+	return ok
+}
+
+// separateFieldMismatches returns a *FieldMismatchError holding the field
+// mismatches of err if they are its only errors. Otherwise err is returned
+// unchanged, with the field mismatches kept alongside the other errors so
+// that partly loaded entities are never reported as loaded.
+func separateFieldMismatches(err error) error {
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+
+	for _, e := range me {
+		if e != nil && !isFieldMismatch(e) {
+			return me
+		}
+	}
+	return &FieldMismatchError{Errs: me}
+}
@@ -0,0 +1,38 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestFirstError(t *testing.T) {
+	err := nds.FirstError(appengine.MultiError{
+		nil, datastore.ErrNoSuchEntity, datastore.ErrInvalidKey,
+	})
+	keyErr, ok := err.(*nds.KeyError)
+	if !ok {
+		t.Fatal("expected *nds.KeyError", err)
+	}
+	if keyErr.Index != 1 || keyErr.Err != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect key error", keyErr)
+	}
+	if !errors.Is(err, datastore.ErrNoSuchEntity) {
+		t.Fatal("expected datastore.ErrNoSuchEntity to be wrapped")
+	}
+
+	if err := nds.FirstError(appengine.MultiError{nil, nil}); err != nil {
+		t.Fatal("expected nil", err)
+	}
+	if err := nds.FirstError(nil); err != nil {
+		t.Fatal("expected nil", err)
+	}
+
+	expectedErr := errors.New("expected error")
+	if err := nds.FirstError(expectedErr); err != expectedErr {
+		t.Fatal("expected error unchanged", err)
+	}
+}
@@ -0,0 +1,156 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Exists reports whether an entity exists for each of keys. The returned slice
+// is aligned with keys. Keys with no entity are reported as false without an
+// error.
+//
+// Exists uses memcache where possible and never unmarshals cached entities.
+// Keys not found in memcache are checked in the datastore. Exists does not
+// change memcache. Contexts created with WithNoCache check every key in the
+// datastore.
+func Exists(c context.Context, keys []*datastore.Key) ([]bool, error) {
+
+	isNilErr, nilErr := false, make(appengine.MultiError, len(keys))
+	for i, key := range keys {
+		if key == nil {
+			isNilErr = true
+			nilErr[i] = datastore.ErrInvalidKey
+		}
+	}
+	if isNilErr {
+		return nil, nilErr
+	}
+
+	exists := make([]bool, len(keys))
+	if len(keys) == 0 {
+		return exists, nil
+	}
+
+	callCount := (len(keys)-1)/getMultiLimit + 1
+	errs := make([]error, callCount)
+
+	limiter := newCallLimiter(callCount)
+	var wg sync.WaitGroup
+	wg.Add(callCount)
+	for i := 0; i < callCount; i++ {
+		lo := i * getMultiLimit
+		hi := (i + 1) * getMultiLimit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+
+		limiter <- struct{}{}
+		go func(i int, keys []*datastore.Key, exists []bool) {
+			errs[i] = existsMulti(c, keys, exists)
+			<-limiter
+			wg.Done()
+		}(i, keys[lo:hi], exists[lo:hi])
+	}
+	wg.Wait()
+
+	if isErrorsNil(errs) {
+		return exists, nil
+	}
+
+	return exists, groupErrors(errs, len(keys), getMultiLimit)
+}
+
+// presence is a datastore.PropertyLoadSaver that discards all properties. It
+// allows the existence of entities to be checked without decoding them.
+type presence struct{}
+
+func (*presence) Load([]datastore.Property) error {
+	return nil
+}
+
+func (*presence) Save() ([]datastore.Property, error) {
+	return nil, nil
+}
+
+func existsMulti(c context.Context,
+	keys []*datastore.Key, exists []bool) error {
+
+	checkKeys := keys
+	checkIndex := make([]int, len(keys))
+	for i := range checkIndex {
+		checkIndex[i] = i
+	}
+
+	_, useDatastore := transactionFromContext(c)
+	useDatastore = useDatastore || optionsFromContext(c).noCache ||
+		!memcacheAllowed()
+	if !useDatastore {
+		memcacheCtx, err := memcacheContext(c)
+		if err != nil {
+			return err
+		}
+
+		memcacheKeys := make([]string, len(keys))
+		for i, key := range keys {
+			memcacheKeys[i] = createMemcacheKey(c, key)
+		}
+
+		items, err := tracedMemcacheGetMulti(memcacheCtx, memcacheKeys)
+		if err != nil {
+			logEvent(c, LogWarning, "nds:existsMulti GetMulti", "error", err)
+			items = nil
+		}
+
+		checkKeys = make([]*datastore.Key, 0, len(keys))
+		checkIndex = checkIndex[:0]
+		for i, memcacheKey := range memcacheKeys {
+			item, ok := items[memcacheKey]
+			switch {
+			case ok && (item.Flags == entityItem ||
+				item.Flags == chunkedEntityItem || item.Flags == tooLargeItem):
+				exists[i] = true
+			case ok && item.Flags == noneItem:
+				exists[i] = false
+			default:
+				checkKeys = append(checkKeys, keys[i])
+				checkIndex = append(checkIndex, i)
+			}
+		}
+	}
+
+	if len(checkKeys) == 0 {
+		return nil
+	}
+
+	var me appengine.MultiError
+	presences := make([]presence, len(checkKeys))
+	err := tracedDatastoreGetMulti(c, checkKeys, presences)
+	if err == nil {
+		me = make(appengine.MultiError, len(checkKeys))
+	} else if e, ok := err.(appengine.MultiError); ok {
+		me = e
+	} else {
+		return err
+	}
+
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, index := range checkIndex {
+		switch me[i] {
+		case nil:
+			exists[index] = true
+		case datastore.ErrNoSuchEntity:
+			exists[index] = false
+		default:
+			errs[index] = me[i]
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,107 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestExists(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.Put(c, keys[2], &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache with the first two keys only.
+	if err := nds.GetMulti(c, keys[:2], make([]testEntity, 2)); err == nil {
+		t.Fatal("expected no such entity error")
+	}
+
+	// Cached entities must not be unmarshalled.
+	nds.SetUnmarshal(func(data []byte, pl *datastore.PropertyList) error {
+		return errors.New("unexpected unmarshal")
+	})
+	defer nds.SetUnmarshal(nds.UnmarshalPropertyList)
+
+	var datastoreKeys []*datastore.Key
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		datastoreKeys = append(datastoreKeys, keys...)
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	exists, err := nds.Exists(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists[0] || exists[1] || !exists[2] {
+		t.Fatal("incorrect exists", exists)
+	}
+	if len(datastoreKeys) != 1 || !datastoreKeys[0].Equal(keys[2]) {
+		t.Fatal("expected only uncached key from datastore", datastoreKeys)
+	}
+}
+
+func TestExistsMemcacheFail(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		return nil, errors.New("expected error")
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	exists, err := nds.Exists(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists[0] || exists[1] {
+		t.Fatal("incorrect exists", exists)
+	}
+}
+
+func TestExistsNilKey(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	keys := []*datastore.Key{datastore.NewKey(c, "Entity", "", 1, nil), nil}
+	_, err := nds.Exists(c, keys)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != datastore.ErrInvalidKey {
+		t.Fatal("incorrect errors", me)
+	}
+}
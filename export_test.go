@@ -2,6 +2,7 @@ package nds
 
 import (
 	"reflect"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
@@ -11,11 +12,20 @@ import (
 var (
 	MarshalPropertyList   = marshalPropertyList
 	UnmarshalPropertyList = unmarshalPropertyList
+	LooksIncompressible   = looksIncompressible
 
-	NoneItem   = noneItem
-	EntityItem = entityItem
+	GobCodec = gobCodec{}
 
-	MemcacheMaxKeySize = memcacheMaxKeySize
+	AppengineLogger = appengineLogger
+
+	NoneItem          = noneItem
+	EntityItem        = entityItem
+	LockItem          = lockItem
+	ChunkedEntityItem = chunkedEntityItem
+	TooLargeItem      = tooLargeItem
+
+	MemcacheMaxKeySize   = memcacheMaxKeySize
+	MemcacheMaxBatchSize = memcacheMaxBatchSize
 )
 
 func SetMemcacheAddMulti(f func(c context.Context,
@@ -47,6 +57,11 @@ func SetDatastorePutMulti(f func(c context.Context,
 	datastorePutMulti = f
 }
 
+func SetDatastoreDeleteMulti(f func(c context.Context,
+	keys []*datastore.Key) error) {
+	datastoreDeleteMulti = f
+}
+
 func SetDatastoreGetMulti(f func(c context.Context,
 	keys []*datastore.Key, vals interface{}) error) {
 	datastoreGetMulti = f
@@ -64,10 +79,42 @@ func SetValue(val reflect.Value, pl datastore.PropertyList) error {
 	return setValue(val, pl)
 }
 
-func CreateMemcacheKey(key *datastore.Key) string {
-	return createMemcacheKey(key)
-}
-
 func SetMemcacheNamespace(namespace string) {
 	memcacheNamespace = namespace
 }
+
+func BatchItems(items []*memcache.Item) [][]*memcache.Item {
+	return batchItems(items)
+}
+
+func SetTimeNow(f func() time.Time) {
+	timeNow = f
+}
+
+func SetDatastoreCount(f func(q *datastore.Query, c context.Context) (
+	int, error)) {
+	datastoreCount = f
+}
+
+func SetDatastoreGetAll(f func(q *datastore.Query, c context.Context,
+	dst interface{}) ([]*datastore.Key, error)) {
+	datastoreGetAll = f
+}
+
+func ItemLock() []byte {
+	return itemLock()
+}
+
+func CreateQueryKey(c context.Context, kind string,
+	q *datastore.Query) string {
+	key, _ := createQueryKey(c, kind, q)
+	return key
+}
+
+func HasQueryFields(t reflect.Type) bool {
+	return hasQueryFields(t)
+}
+
+func StartStats(c context.Context, s Stats) (context.Context, func()) {
+	return startStats(c, s)
+}
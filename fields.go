@@ -0,0 +1,94 @@
+package nds
+
+import (
+	"reflect"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// GetMultiFields works like GetMulti except that only the properties named in
+// fields are loaded into vals. The other fields of vals are left unchanged. A
+// field of a nested struct is named by its full name, such as "Address.City",
+// and naming the outer field, such as "Address", loads all of its fields.
+//
+// Entities are still read and cached whole, so they are shared with Get and
+// GetMulti. Caching projected entities under separate memcache keys would
+// save memcache bandwidth, but Put, Delete and Invalidate only know the key of
+// the whole entity. They would have no way to lock the projected items so
+// those would be served stale after a write. Projection queries also skip
+// entities whose projected properties are unindexed, so they cannot stand in
+// for a read by key.
+func GetMultiFields(c context.Context, keys []*datastore.Key,
+	vals interface{}, fields []string) error {
+
+	v := reflect.ValueOf(vals)
+	if err := checkKeysValues(keys, v); err != nil {
+		return err
+	}
+	if err := checkNilInterfaces(v); err != nil {
+		return err
+	}
+
+	// Entities are cached as for the type of vals, not the property lists
+	// they are got into.
+	pls := make([]datastore.PropertyList, len(keys))
+	noCache := make([][]string, len(keys))
+	for i := range keys {
+		noCache[i] = noCacheProperties(v.Index(i))
+	}
+	err := getMultiSources(c, keys, pls, getMultiExtras{noCache: noCache})
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+	if !ok {
+		me = make(appengine.MultiError, len(keys))
+	}
+
+	names := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		names[field] = true
+	}
+
+	errsNil := true
+	for i := range keys {
+		if me[i] == nil {
+			me[i] = setValue(v.Index(i), selectFields(pls[i], names))
+		}
+		if me[i] != nil {
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	if optionsFromContext(c).ignoreFieldMismatch {
+		return separateFieldMismatches(me)
+	}
+	return me
+}
+
+// selectFields returns the properties of pl named in names, or belonging to a
+// nested struct named in names.
+func selectFields(pl datastore.PropertyList,
+	names map[string]bool) datastore.PropertyList {
+
+	selected := make(datastore.PropertyList, 0, len(names))
+	for _, p := range pl {
+		for name := p.Name; ; {
+			if names[name] {
+				selected = append(selected, p)
+				break
+			}
+			i := strings.LastIndex(name, ".")
+			if i < 0 {
+				break
+			}
+			name = name[:i]
+		}
+	}
+	return selected
+}
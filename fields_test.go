@@ -0,0 +1,74 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetMultiFields(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type address struct {
+		City   string
+		Street string
+	}
+
+	type testEntity struct {
+		Name    string
+		Detail  string
+		Address address
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{
+		Name:    "name",
+		Detail:  "detail",
+		Address: address{"city", "street"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	entities := make([]testEntity, 2)
+	err := nds.GetMultiFields(c, keys, entities,
+		[]string{"Name", "Address.City"})
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if entities[0] != (testEntity{
+		Name:    "name",
+		Address: address{City: "city"},
+	}) {
+		t.Fatal("incorrect entity", entities[0])
+	}
+
+	// The whole entity has been cached for other reads.
+	entity := &testEntity{}
+	if err := nds.Get(c, keys[0], entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.Detail != "detail" || entity.Address.Street != "street" {
+		t.Fatal("incorrect entity", entity)
+	}
+
+	entities = make([]testEntity, 1)
+	if err := nds.GetMultiFields(c, keys[:1], entities,
+		[]string{"Address"}); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0] != (testEntity{
+		Address: address{"city", "street"},
+	}) {
+		t.Fatal("incorrect entity", entities[0])
+	}
+}
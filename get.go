@@ -2,7 +2,8 @@ package nds
 
 import (
 	"bytes"
-	"encoding/binary"
+	crand "crypto/rand"
+	"errors"
 	"math/rand"
 	"reflect"
 	"sync"
@@ -11,7 +12,6 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
 )
 
@@ -26,7 +26,8 @@ const getMultiLimit = 1000
 //
 // 1) It removes the API limit of 1000 entities per request by
 // calling the datastore as many times as required to fetch all the keys. It
-// does this efficiently and concurrently.
+// does this efficiently and concurrently, up to the limit set with
+// SetMaxConcurrentCalls.
 //
 // 2) GetMulti function will automatically use memcache where possible before
 // accssing the datastore. It uses a caching mechanism similar to the Python
@@ -35,7 +36,30 @@ const getMultiLimit = 1000
 // concurrently.
 //
 // If memcache is not working for any reason, GetMulti will default to using
-// the datastore without compromising cache consistency.
+// the datastore without compromising cache consistency. SetCircuitBreaker can
+// be used to stop GetMulti trying memcache at all while it is failing.
+//
+// GetMulti never waits for a lock held by another call. Locked keys are read
+// from the datastore straight away without updating memcache, and are counted
+// by Stats.LockedKeys, so a lock that is never released only costs datastore
+// reads.
+//
+// Keys with no entity cost no more than keys with one. The lock taken for
+// such a key is replaced by an empty item recording that there is no entity,
+// as set by WithNoSuchEntityExpiration, so the lock does not linger and later
+// gets of the key are served from memcache without reading the datastore.
+//
+// keys can belong to different namespaces, as each key holds its own
+// namespace. The namespace of c is not used, so entities from several
+// namespaces can be got by a single call with one context. The same holds for
+// PutMulti and DeleteMulti. Keys are used exactly as given, both for the
+// datastore and for their memcache keys, so there are no other keys to return.
+// Keys must be complete, as for datastore.GetMulti, so store the complete keys
+// returned by PutMulti to get their entities later.
+//
+// If c is done before the datastore needs to be read, GetMulti returns the
+// entities it got from the cache and reports the context error for each
+// remaining key in an appengine.MultiError.
 //
 // Important: If you use nds.GetMulti, you must also use the NDS put and delete
 // functions in all your code touching the datastore to ensure data consistency.
@@ -51,20 +75,84 @@ const getMultiLimit = 1000
 // datastore.PropertyLoadSaver. If an []I, each element must be a valid dst for
 // Get: it must be a struct pointer or implement datastore.PropertyLoadSaver.
 //
+// nil elements of a []*S are allocated for each entity found, just like
+// datastore.GetMulti, as are nil struct pointers held by the elements of an
+// []I. So vals can be a pre-sized slice of nil pointers. The elements of keys
+// with no entity are left nil. A nil element of an []I has no type to allocate
+// so GetMulti returns datastore.ErrInvalidEntityType for it in an
+// appengine.MultiError without getting any entity.
+//
 // As a special case, datastore.PropertyList is an invalid type for dst, even
 // though a PropertyList is a slice of structs. It is treated as invalid to
 // avoid being mistakenly passed when []datastore.PropertyList was intended.
+// A []datastore.PropertyList is valid and can be used to get entities of any
+// kind without a struct. Each element is appended to in the same way as
+// datastore.GetMulti so elements should be empty.
 func GetMulti(c context.Context,
 	keys []*datastore.Key, vals interface{}) error {
+	return getMultiSources(c, keys, vals, getMultiExtras{})
+}
+
+// getMultiExtras holds the optional inputs and outputs of getMultiSources.
+// Each slice that is not nil is aligned with the keys of the call.
+type getMultiExtras struct {
+	// sources is set to the source of each key.
+	sources []Source
+
+	// noCache holds the nocache property names of each key, for vals that
+	// are not of the type the entities are used as. Otherwise they are those
+	// of the elements of vals.
+	noCache [][]string
+
+	// data is set to each entity marshalled as it is cached in memcache,
+	// for the entities got from or saved to memcache.
+	data [][]byte
+}
+
+// slice returns the extras of the keys from lo to hi.
+func (x getMultiExtras) slice(lo, hi int) getMultiExtras {
+	if x.sources != nil {
+		x.sources = x.sources[lo:hi]
+	}
+	if x.noCache != nil {
+		x.noCache = x.noCache[lo:hi]
+	}
+	if x.data != nil {
+		x.data = x.data[lo:hi]
+	}
+	return x
+}
+
+// getMultiSources is GetMulti that also fills in extras.
+func getMultiSources(c context.Context, keys []*datastore.Key,
+	vals interface{}, extras getMultiExtras) error {
 
 	v := reflect.ValueOf(vals)
 	if err := checkKeysValues(keys, v); err != nil {
 		return err
 	}
+	if err := checkNilInterfaces(v); err != nil {
+		return err
+	}
 
 	callCount := (len(keys)-1)/getMultiLimit + 1
 	errs := make([]error, callCount)
 
+	// Only allocate stats if they are going to be recorded.
+	var stats []Stats
+	var counter *memcacheCallCounter
+	if loadConfig().statsRecorder != nil {
+		stats = make([]Stats, callCount)
+		c, counter = withMemcacheCallCounter(c)
+	}
+
+	// Transactions, uncached contexts and calls made while memcache is
+	// failing use the datastore directly.
+	_, useDatastore := transactionFromContext(c)
+	useDatastore = useDatastore || optionsFromContext(c).noCache ||
+		!memcacheAllowed()
+
+	limiter := newCallLimiter(callCount)
 	var wg sync.WaitGroup
 	wg.Add(callCount)
 	for i := 0; i < callCount; i++ {
@@ -74,27 +162,76 @@ func GetMulti(c context.Context,
 			hi = len(keys)
 		}
 
-		go func(i int, keys []*datastore.Key, vals reflect.Value) {
-			if _, ok := transactionFromContext(c); ok {
-				errs[i] = datastoreGetMulti(c, keys, vals.Interface())
+		limiter <- struct{}{}
+		go func(i int, keys []*datastore.Key, vals reflect.Value,
+			extras getMultiExtras) {
+			var s *Stats
+			if stats != nil {
+				s = &stats[i]
+			}
+			if useDatastore {
+				errs[i] = tracedDatastoreGetMulti(c, keys, vals.Interface())
+				if s != nil {
+					s.Keys, s.CacheMisses = len(keys), len(keys)
+				}
+				if extras.sources != nil {
+					setDatastoreSources(extras.sources, errs[i])
+				}
 			} else {
-				errs[i] = getMulti(c, keys, vals)
+				errs[i] = getMulti(c, keys, vals, s, extras)
 			}
+			<-limiter
 			wg.Done()
-		}(i, keys[lo:hi], v.Slice(lo, hi))
+		}(i, keys[lo:hi], v.Slice(lo, hi), extras.slice(lo, hi))
 	}
 	wg.Wait()
 
+	if stats != nil {
+		total := Stats{Op: OpGet, Tag: optionsFromContext(c).statsTag}
+		for i := range stats {
+			total.add(&stats[i])
+		}
+		total.MemcacheCalls = counter.load()
+		recordStats(total)
+	}
+
 	if isErrorsNil(errs) {
 		return nil
 	}
 
-	return groupErrors(errs, len(keys), getMultiLimit)
+	err := groupErrors(errs, len(keys), getMultiLimit)
+	if optionsFromContext(c).ignoreFieldMismatch {
+		err = separateFieldMismatches(err)
+	}
+	return err
+}
+
+// GetMultiEventual works like GetMulti but caches the entities it reads from
+// the datastore without locking memcache, in the same way as the kinds set
+// with SetSimpleCacheKinds. This saves two memcache calls per cache miss. It
+// is intended for reads, such as analytics, that can accept stale entities.
+//
+// Unlike GetMulti, an entity read just before it is changed by a concurrent
+// Put or Delete can be cached after the change completes. The stale entity is
+// then returned by GetMulti and GetMultiEventual until the entity is changed
+// again or evicted from memcache. Entities are added to memcache rather than
+// set so a lock held by a Put or Delete in progress is never overwritten.
+// Cache misses are still read from the datastore by key, which is always
+// strongly consistent.
+func GetMultiEventual(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+
+	c = withOptions(c, func(o *options) {
+		o.unlocked = true
+	})
+	return GetMulti(c, keys, vals)
 }
 
-// Get loads the entity stored for key into val, which must be a struct pointer.
-// Currently PropertyLoadSaver is not implemented. If there is no such entity
-// for the key, Get returns ErrNoSuchEntity.
+// Get loads the entity stored for key into val, which must be a struct pointer
+// or implement datastore.PropertyLoadSaver. It is a convenience wrapper around
+// GetMulti and uses the same caching strategy. If there is no such entity for
+// the key, Get returns datastore.ErrNoSuchEntity rather than an
+// appengine.MultiError.
 //
 // The values of val's unmatched struct fields are not modified, and matching
 // slice-typed fields are not reset before appending to them. In particular, it
@@ -105,8 +242,10 @@ func GetMulti(c context.Context,
 // unexported in the destination struct. ErrFieldMismatch is only returned if
 // val is a struct pointer.
 func Get(c context.Context, key *datastore.Key, val interface{}) error {
-	// GetMulti catches nil interface; we need to catch nil ptr here.
-	if val == nil {
+	// GetMulti catches nil interface; we need to catch nil ptr here as an
+	// allocated value could not be returned.
+	if v := reflect.ValueOf(val); val == nil ||
+		v.Kind() == reflect.Ptr && v.IsNil() {
 		return datastore.ErrInvalidEntityType
 	}
 
@@ -123,6 +262,10 @@ const (
 	miss cacheState = iota
 	internalLock
 	externalLock
+
+	// unlocked is a miss of a simple cache kind. It is read from the
+	// datastore and added to memcache without a lock.
+	unlocked
 	done
 )
 
@@ -133,8 +276,37 @@ type cacheItem struct {
 	val reflect.Value
 	err error
 
+	// pl is the entity loaded into val.
+	pl datastore.PropertyList
+
+	// noCache holds the nocache property names removed from the cached
+	// entity. They are found when the item is created as val is not always
+	// of the type the entity is used as.
+	noCache []string
+
 	item *memcache.Item
 
+	// locked is true if the item was found locked by another call.
+	locked bool
+
+	// casFailed is true if item could not be saved to memcache because it
+	// was changed after being locked.
+	casFailed bool
+
+	// chunks holds the items an entity too large for item is split into.
+	chunks []*memcache.Item
+
+	// source is where val was got from.
+	source Source
+
+	// size is the size of the marshalled entity got from or saved to
+	// memcache.
+	size int
+
+	// data is the marshalled entity got from or saved to memcache, whole
+	// even if it is chunked.
+	data []byte
+
 	state cacheState
 }
 
@@ -143,15 +315,27 @@ type cacheItem struct {
 // that GetMulti will never get stale results even if the function, datastore or
 // server fails at any point. The caching strategy is borrowed from Python ndb
 // with improvements that eliminate some consistency issues surrounding ndb,
-// including http://goo.gl/3ByVlA.
-func getMulti(c context.Context,
-	keys []*datastore.Key, vals reflect.Value) error {
+// including http://goo.gl/3ByVlA. If stats is not nil it is filled in with the
+// cache usage of the call. extras are filled in as for getMultiSources.
+func getMulti(c context.Context, keys []*datastore.Key, vals reflect.Value,
+	stats *Stats, extras getMultiExtras) error {
+
+	if stats != nil {
+		stats.Keys = len(keys)
+	}
 
 	cacheItems := make([]cacheItem, len(keys))
 	for i, key := range keys {
 		cacheItems[i].key = key
-		cacheItems[i].memcacheKey = createMemcacheKey(key)
+		cacheItems[i].memcacheKey = createMemcacheKey(c, key)
 		cacheItems[i].val = vals.Index(i)
+		if extras.noCache != nil {
+			cacheItems[i].noCache = keyNoCacheProperties(key,
+				extras.noCache[i])
+		} else {
+			cacheItems[i].noCache = keyNoCacheProperties(key,
+				noCacheProperties(vals.Index(i)))
+		}
 		cacheItems[i].state = miss
 	}
 
@@ -160,15 +344,48 @@ func getMulti(c context.Context,
 		return err
 	}
 
+	lc, hasLocalCache := localCacheFromContext(c)
+	var generation uint64
+	if hasLocalCache {
+		generation = lc.load(cacheItems,
+			optionsFromContext(c).ignoreFieldMismatch)
+	}
+
 	loadMemcache(memcacheCtx, cacheItems)
 
 	lockMemcache(memcacheCtx, cacheItems)
 
-	if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
-		return err
-	}
+	// Don't start datastore calls for a context that is already done but
+	// still return the entities that were got from the cache.
+	if err := c.Err(); err != nil {
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state != done {
+				cacheItems[i].err = err
+			}
+		}
+	} else {
+		if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
+			return err
+		}
+
+		saveMemcache(memcacheCtx, cacheItems)
+		checkDivergence(c, memcacheCtx, cacheItems)
 
-	saveMemcache(memcacheCtx, cacheItems)
+		retries := retrySaveMemcache(c, memcacheCtx, cacheItems, vals.Type())
+		if stats != nil {
+			stats.CASRetries = retries
+		}
+
+		if hasLocalCache {
+			lc.save(cacheItems, generation)
+		}
+
+		reads, mismatches := shadowRead(c, cacheItems)
+		if stats != nil {
+			stats.ShadowReads = reads
+			stats.ShadowReadMismatches = mismatches
+		}
+	}
 
 	me, errsNil := make(appengine.MultiError, len(cacheItems)), true
 	for i, cacheItem := range cacheItems {
@@ -178,6 +395,38 @@ func getMulti(c context.Context,
 		}
 	}
 
+	if extras.sources != nil {
+		for i, cacheItem := range cacheItems {
+			extras.sources[i] = cacheItem.resultSource()
+		}
+	}
+	if extras.data != nil {
+		for i, cacheItem := range cacheItems {
+			extras.data[i] = cacheItem.data
+		}
+	}
+
+	if stats != nil {
+		for _, cacheItem := range cacheItems {
+			if cacheItem.state == done {
+				stats.CacheHits++
+				stats.CacheHitBytes += cacheItem.size
+			} else {
+				stats.CacheMisses++
+			}
+			if (cacheItem.state == internalLock && !cacheItem.casFailed) ||
+				cacheItem.state == unlocked {
+				stats.CacheWriteBytes += cacheItem.size
+			}
+			if cacheItem.locked {
+				stats.LockedKeys++
+			}
+			if cacheItem.casFailed {
+				stats.CASFailures++
+			}
+		}
+	}
+
 	if errsNil {
 		return nil
 	}
@@ -186,77 +435,249 @@ func getMulti(c context.Context,
 
 func loadMemcache(c context.Context, cacheItems []cacheItem) {
 
-	memcacheKeys := make([]string, len(cacheItems))
-	for i, cacheItem := range cacheItems {
-		memcacheKeys[i] = cacheItem.memcacheKey
+	ignoreFieldMismatch := optionsFromContext(c).ignoreFieldMismatch
+
+	memcacheKeys := make([]string, 0, len(cacheItems))
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			memcacheKeys = append(memcacheKeys, cacheItem.memcacheKey)
+		}
 	}
 
-	items, err := memcacheGetMulti(c, memcacheKeys)
-	if err != nil {
-		for i := range cacheItems {
-			cacheItems[i].state = externalLock
+	items, err := memcacheGetMultiTimeout(c, memcacheKeys)
+	if err == errMemcacheGetTimeout {
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state == miss {
+				cacheItems[i].state = externalLock
+			}
+		}
+		logEvent(c, LogDebug, "nds:loadMemcache GetMulti", "error", err)
+		return
+	} else if err != nil {
+		strictCache := optionsFromContext(c).strictCache
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state != miss {
+				continue
+			}
+			if strictCache {
+				cacheItems[i].state = done
+				cacheItems[i].err = &CacheError{Err: err}
+			} else {
+				cacheItems[i].state = externalLock
+			}
 		}
-		log.Warningf(c, "nds:loadMemcache GetMulti %s", err)
+		logEvent(c, LogWarning, "nds:loadMemcache GetMulti", "error", err)
 		return
 	}
+	loadChunks(c, items)
 
-	for i, memcacheKey := range memcacheKeys {
-		if item, ok := items[memcacheKey]; ok {
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != miss {
+			continue
+		}
+		if item, ok := items[cacheItem.memcacheKey]; ok {
 			switch item.Flags {
 			case lockItem:
 				cacheItems[i].state = externalLock
+				cacheItems[i].locked = true
 			case noneItem:
 				cacheItems[i].state = done
 				cacheItems[i].err = datastore.ErrNoSuchEntity
+			case tooLargeItem:
+				cacheItems[i].state = externalLock
+			case chunkedEntityItem:
+				// The chunks could not be loaded.
+				replaceUnreadableItem(&cacheItems[i], item)
 			case entityItem:
 				pl := datastore.PropertyList{}
 				if err := unmarshal(item.Value, &pl); err != nil {
-					log.Warningf(c, "nds:loadMemcache unmarshal %s", err)
-					cacheItems[i].state = externalLock
+					logEvent(c, LogWarning, "nds:loadMemcache unmarshal",
+						"error", &CodecError{cacheItem.key, err})
+					replaceUnreadableItem(&cacheItems[i], item)
 					break
 				}
-				if err := setValue(cacheItems[i].val, pl); err == nil {
+				cacheItems[i].size = len(item.Value)
+				cacheItems[i].data = item.Value
+				err := setValue(cacheItems[i].val, pl)
+				if err == nil || ignoreFieldMismatch && isFieldMismatch(err) {
 					cacheItems[i].state = done
+					cacheItems[i].err = err
+					cacheItems[i].pl = pl
+					cacheItems[i].source = SourceMemcache
 				} else {
-					log.Warningf(c, "nds:loadMemcache setValue %s", err)
+					logEvent(c, LogWarning, "nds:loadMemcache setValue",
+						"error", err)
 					cacheItems[i].state = externalLock
 				}
 			default:
-				log.Warningf(c, "nds:loadMemcache unknown item.Flags %d", item.Flags)
+				logEvent(c, LogWarning, "nds:loadMemcache unknown item.Flags",
+					"flags", item.Flags)
 				cacheItems[i].state = externalLock
 			}
 		}
 	}
 }
 
-// itemLock creates a pseudorandom memcache lock value that enables each call of
-// Get/GetMulti to determine if a lock retrieved from memcache is the one it
-// created. This is only important when multiple calls of Get/GetMulti are
-// performed concurrently for the same previously uncached entity.
+// errMemcacheGetTimeout is returned by memcacheGetMultiTimeout when memcache
+// takes longer than the timeout set with WithMemcacheGetTimeout.
+var errMemcacheGetTimeout = errors.New("nds: memcache get timed out")
+
+// memcacheGetMultiTimeout gets the memcache items of keys, giving up with
+// errMemcacheGetTimeout after the timeout set with WithMemcacheGetTimeout. The
+// memcache call is left to finish in the background so that the circuit
+// breaker still observes its result.
+func memcacheGetMultiTimeout(c context.Context, keys []string) (
+	map[string]*memcache.Item, error) {
+
+	timeout := optionsFromContext(c).memcacheGetTimeout
+	if timeout <= 0 {
+		return tracedMemcacheGetMulti(c, keys)
+	}
+
+	type result struct {
+		items map[string]*memcache.Item
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		items, err := tracedMemcacheGetMulti(c, keys)
+		results <- result{items, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.items, r.err
+	case <-timer.C:
+		return nil, errMemcacheGetTimeout
+	}
+}
+
+// replaceUnreadableItem makes cacheItem replace item, an entity item that
+// could not be unmarshalled such as one cached with a different cache
+// version, or a chunked entity item whose chunks could not be loaded, once the
+// entity has been read from the datastore. item is treated
+// as the lock of cacheItem: replacing it by compare and swap fails if any
+// other call changes it first, just as for a lock added by lockMemcache.
+func replaceUnreadableItem(cacheItem *cacheItem, item *memcache.Item) {
+	// The lock value is only used to name chunks.
+	item.Value = itemLock()
+	cacheItem.item = item
+	cacheItem.state = internalLock
+}
+
+// lockTokenSize is the length of the memcache lock values created by itemLock.
+const lockTokenSize = 16
+
+// itemLock creates a random memcache lock value that enables each call of
+// Get/GetMulti, and each writer using Lock, to determine if a lock retrieved
+// from memcache is the one it created. Values are read from crypto/rand and
+// are long enough that two calls locking the same key never create the same
+// value, whichever instances they run on.
 func itemLock() []byte {
-	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, rand.Uint32())
+	b := make([]byte, lockTokenSize)
+	if _, err := crand.Read(b); err != nil {
+		// crypto/rand should never fail, but a lock is still better than a
+		// panic.
+		rand.Read(b)
+	}
 	return b
 }
 
+// lockExpiration returns lockTime with up to 10% randomly added, in whole
+// seconds as that is the memcache expiration granularity. This stops locks of
+// a hot key taken at the same time from all expiring together. If shorten is
+// true up to 10% can also be subtracted, which is only safe for locks taken
+// by GetMulti. Locks taken by writes must outlast datastore retries so they
+// are never shortened.
+func lockExpiration(lockTime time.Duration, shorten bool) time.Duration {
+	jitter := int64(lockTime / 10 / time.Second)
+	if jitter == 0 {
+		return lockTime
+	}
+	if shorten {
+		return lockTime + time.Duration(rand.Int63n(2*jitter+1)-jitter)*
+			time.Second
+	}
+	return lockTime + time.Duration(rand.Int63n(jitter+1))*time.Second
+}
+
+// createLockItems creates the memcache lock items a write takes for keys
+// before changing their entities, followed by those of the keys derived from
+// them with the function set with SetDerivedKeys. Nil and incomplete keys have
+// no memcache items so are skipped.
+func createLockItems(c context.Context,
+	keys []*datastore.Key) []*memcache.Item {
+
+	keys = withDerivedKeys(keys)
+	lockTime := optionsFromContext(c).lockTime
+	items := make([]*memcache.Item, 0, len(keys))
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		items = append(items, &memcache.Item{
+			Key:        createMemcacheKey(c, key),
+			Flags:      lockItem,
+			Value:      itemLock(),
+			Expiration: lockExpiration(lockTime, false),
+		})
+	}
+	return items
+}
+
 func init() {
-	// Seed the pseudorandom number generator to reduce the chance of itemLock
-	// collisions.
+	// Seed the pseudorandom number generator so that instances jitter lock
+	// expirations differently.
 	rand.Seed(time.Now().UnixNano())
 }
 
+// SetSimpleCacheKinds sets the kinds of entities that GetMulti caches without
+// locking memcache. Cache misses of these kinds are read from the datastore
+// and added to memcache, saving two memcache calls per miss. Put, PutMulti,
+// Delete, DeleteMulti and RunInTransaction still lock and invalidate their
+// memcache items as usual.
+//
+// Without a lock, a GetMulti that reads an entity just before it is changed
+// can cache the old entity if it adds it to memcache after the change has
+// completed. It then stays stale until it is evicted or changed again. Only
+// use this for kinds that are rarely written, such as reference data.
+func SetSimpleCacheKinds(kinds []string) {
+	m := make(map[string]bool, len(kinds))
+	for _, kind := range kinds {
+		m[kind] = true
+	}
+	updateConfig(func(cfg *config) {
+		cfg.simpleCacheKinds = m
+	})
+}
+
 func lockMemcache(c context.Context, cacheItems []cacheItem) {
 
+	opts := optionsFromContext(c)
+	lockTime := opts.lockTime
+	ignoreFieldMismatch := opts.ignoreFieldMismatch
+	simpleCacheKinds := loadConfig().simpleCacheKinds
+
 	lockItems := make([]*memcache.Item, 0, len(cacheItems))
 	lockMemcacheKeys := make([]string, 0, len(cacheItems))
 	for i, cacheItem := range cacheItems {
-		if cacheItem.state == miss {
+		if cacheItem.state == miss &&
+			(opts.unlocked || simpleCacheKinds[cacheItem.key.Kind()]) {
+			// The lock value is only used to name chunks.
+			cacheItems[i].item = &memcache.Item{
+				Key:   cacheItem.memcacheKey,
+				Value: itemLock(),
+			}
+			cacheItems[i].state = unlocked
+		} else if cacheItem.state == miss {
 
 			item := &memcache.Item{
 				Key:        cacheItem.memcacheKey,
 				Flags:      lockItem,
 				Value:      itemLock(),
-				Expiration: memcacheLockTime,
+				Expiration: lockExpiration(lockTime, true),
 			}
 			cacheItems[i].item = item
 			lockItems = append(lockItems, item)
@@ -265,12 +686,12 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 	}
 
 	// We don't care if there are errors here.
-	if err := memcacheAddMulti(c, lockItems); err != nil {
-		log.Warningf(c, "nds:lockMemcache AddMulti %s", err)
+	if err := tracedMemcacheAddMulti(c, lockItems); err != nil {
+		logEvent(c, LogWarning, "nds:lockMemcache AddMulti", "error", err)
 	}
 
 	// Get the items again so we can use CAS when updating the cache.
-	items, err := memcacheGetMulti(c, lockMemcacheKeys)
+	items, err := tracedMemcacheGetMulti(c, lockMemcacheKeys)
 
 	// Cache failed so forget about it and just use the datastore.
 	if err != nil {
@@ -279,9 +700,10 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 				cacheItems[i].state = externalLock
 			}
 		}
-		log.Warningf(c, "nds:lockMemcache GetMulti %s", err)
+		logEvent(c, LogWarning, "nds:lockMemcache GetMulti", "error", err)
 		return
 	}
+	loadChunks(c, items)
 
 	// Cache worked so figure out what items we got.
 	for i, cacheItem := range cacheItems {
@@ -294,26 +716,42 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 						cacheItems[i].state = internalLock
 					} else {
 						cacheItems[i].state = externalLock
+						cacheItems[i].locked = true
 					}
 				case noneItem:
 					cacheItems[i].state = done
 					cacheItems[i].err = datastore.ErrNoSuchEntity
+				case tooLargeItem:
+					cacheItems[i].state = externalLock
+				case chunkedEntityItem:
+					// The chunks could not be loaded.
+					replaceUnreadableItem(&cacheItems[i], item)
 				case entityItem:
 					pl := datastore.PropertyList{}
 					if err := unmarshal(item.Value, &pl); err != nil {
-						log.Warningf(c, "nds:lockMemcache unmarshal %s", err)
-						cacheItems[i].state = externalLock
+						logEvent(c, LogWarning, "nds:lockMemcache unmarshal",
+							"error", &CodecError{cacheItem.key, err})
+						replaceUnreadableItem(&cacheItems[i], item)
 						break
 					}
-					if err := setValue(cacheItems[i].val, pl); err == nil {
+					cacheItems[i].size = len(item.Value)
+					cacheItems[i].data = item.Value
+					err := setValue(cacheItems[i].val, pl)
+					if err == nil ||
+						ignoreFieldMismatch && isFieldMismatch(err) {
 						cacheItems[i].state = done
+						cacheItems[i].err = err
+						cacheItems[i].pl = pl
+						cacheItems[i].source = SourceMemcache
 					} else {
-						log.Warningf(c, "nds:lockMemcache setValue %s", err)
+						logEvent(c, LogWarning, "nds:lockMemcache setValue",
+							"error", err)
 						cacheItems[i].state = externalLock
 					}
 				default:
-					log.Warningf(c, "nds:lockMemcache unknown item.Flags %d",
-						item.Flags)
+					logEvent(c, LogWarning,
+						"nds:lockMemcache unknown item.Flags",
+						"flags", item.Flags)
 					cacheItems[i].state = externalLock
 				}
 			} else {
@@ -334,7 +772,7 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 
 	for i, cacheItem := range cacheItems {
 		switch cacheItem.state {
-		case internalLock, externalLock:
+		case internalLock, externalLock, unlocked:
 			keys = append(keys, cacheItem.key)
 			vals = append(vals, datastore.PropertyList{})
 			cacheItemsIndex = append(cacheItemsIndex, i)
@@ -342,7 +780,7 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 	}
 
 	var me appengine.MultiError
-	if err := datastoreGetMulti(c, keys, vals); err == nil {
+	if err := tracedDatastoreGetMulti(c, keys, vals); err == nil {
 		me = make(appengine.MultiError, len(keys))
 	} else if e, ok := err.(appengine.MultiError); ok {
 		me = e
@@ -353,27 +791,25 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 	for i, index := range cacheItemsIndex {
 		switch me[i] {
 		case nil:
+			// An entity that cannot be loaded into its val, such as one
+			// giving datastore.ErrFieldMismatch, only fails its own key. It is
+			// still cached as the error comes from val, not the entity.
 			pl := vals[i]
 			val := cacheItems[index].val
 			if err := setValue(val, pl); err != nil {
-				return err
+				cacheItems[index].err = err
 			}
+			cacheItems[index].pl = pl
+			cacheItems[index].source = SourceDatastore
 
-			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = entityItem
-				cacheItems[index].item.Expiration = 0
-				if data, err := marshal(pl); err == nil {
-					cacheItems[index].item.Value = data
-				} else {
-					cacheItems[index].state = externalLock
-					log.Warningf(c, "nds:loadDatastore marshal %s", err)
-				}
+			if state := cacheItems[index].state; state == internalLock ||
+				state == unlocked {
+				setEntityItem(c, &cacheItems[index], pl)
 			}
 		case datastore.ErrNoSuchEntity:
-			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = noneItem
-				cacheItems[index].item.Expiration = 0
-				cacheItems[index].item.Value = []byte{}
+			if state := cacheItems[index].state; state == internalLock ||
+				state == unlocked {
+				setNoneItem(c, &cacheItems[index])
 			}
 			cacheItems[index].err = datastore.ErrNoSuchEntity
 		default:
@@ -384,16 +820,198 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 	return nil
 }
 
+// setEntityItem sets the memcache item of cacheItem, which must hold a lock,
+// to cache pl. If pl cannot be marshalled or is too large to be cached the
+// item is left locked.
+func setEntityItem(c context.Context, cacheItem *cacheItem,
+	pl datastore.PropertyList) {
+
+	item := cacheItem.item
+	item.Flags = entityItem
+	item.Expiration = optionsFromContext(c).entityExpiration
+	pl = removeNoCacheProperties(pl, cacheItem.noCache)
+	if data, err := marshal(pl); err != nil {
+		cacheItem.state = externalLock
+		logEvent(c, LogWarning, "nds:setEntityItem marshal",
+			"error", &CodecError{cacheItem.key, err})
+	} else if exceedsMaxCachedEntitySize(data) {
+		// Replace the lock so that reads do not wait for it.
+		item.Flags = tooLargeItem
+		item.Expiration = optionsFromContext(c).lockTime
+		item.Value = []byte{}
+		logEvent(c, LogDebug, "nds:setEntityItem entity too large to cache",
+			"size", len(data))
+	} else if len(data) > memcacheMaxItemSize {
+		cacheItem.size = len(data)
+		cacheItem.data = data
+		item.Flags = chunkedEntityItem
+		item.Value, cacheItem.chunks =
+			createChunkItems(item.Key, item.Value, data)
+
+		// Chunks left behind when the manifest cannot be saved must still
+		// expire.
+		expiration := item.Expiration
+		if expiration == 0 {
+			expiration = optionsFromContext(c).lockTime
+		}
+		for _, chunk := range cacheItem.chunks {
+			chunk.Expiration = expiration
+		}
+	} else {
+		cacheItem.size = len(data)
+		cacheItem.data = data
+		item.Value = data
+	}
+}
+
+// setNoneItem sets the memcache item of cacheItem, which must hold a lock, to
+// cache that there is no entity.
+func setNoneItem(c context.Context, cacheItem *cacheItem) {
+	cacheItem.item.Flags = noneItem
+	cacheItem.item.Expiration = optionsFromContext(c).noSuchEntityExpiration
+	cacheItem.item.Value = []byte{}
+}
+
 func saveMemcache(c context.Context, cacheItems []cacheItem) {
 
-	saveItems := make([]*memcache.Item, 0, len(cacheItems))
+	// Chunks must be in memcache before the manifests that refer to them.
+	chunkItems := []*memcache.Item{}
 	for _, cacheItem := range cacheItems {
-		if cacheItem.state == internalLock {
+		if cacheItem.state == internalLock || cacheItem.state == unlocked {
+			chunkItems = append(chunkItems, cacheItem.chunks...)
+		}
+	}
+	for _, batch := range batchItems(chunkItems) {
+		if err := tracedMemcacheSetMulti(c, batch); err != nil {
+			// Leave chunked entities locked so they are not seen as
+			// partially written.
+			for i, cacheItem := range cacheItems {
+				if len(cacheItem.chunks) > 0 {
+					cacheItems[i].state = externalLock
+				}
+			}
+			logEvent(c, LogWarning, "nds:saveMemcache SetMulti", "error", err)
+			break
+		}
+	}
+
+	saveItems := make([]*memcache.Item, 0, len(cacheItems))
+	saveItemsIndex := make([]int, 0, len(cacheItems))
+	addItems := []*memcache.Item{}
+	for i, cacheItem := range cacheItems {
+		switch cacheItem.state {
+		case internalLock:
 			saveItems = append(saveItems, cacheItem.item)
+			saveItemsIndex = append(saveItemsIndex, i)
+		case unlocked:
+			addItems = append(addItems, cacheItem.item)
+		}
+	}
+
+	// Adding rather than setting means a lock taken by a concurrent put or
+	// delete is never overwritten.
+	for _, batch := range batchItems(addItems) {
+		if err := tracedMemcacheAddMulti(c, batch); err != nil {
+			logEvent(c, LogWarning, "nds:saveMemcache AddMulti", "error", err)
+		}
+	}
+
+	offset := 0
+	for _, batch := range batchItems(saveItems) {
+		err := tracedMemcacheCompareAndSwapMulti(c, batch)
+		me, isMultiErr := err.(appengine.MultiError)
+		collisions := 0
+		for i := range batch {
+			if err != nil && (!isMultiErr || me[i] != nil) {
+				cacheItems[saveItemsIndex[offset+i]].casFailed = true
+				collisions++
+			}
+		}
+		offset += len(batch)
+
+		// A MultiError means memcache worked but items were changed by
+		// other calls since they were locked.
+		if isMultiErr {
+			logEvent(c, LogInfo,
+				"nds:saveMemcache CompareAndSwapMulti collision",
+				"collisions", collisions)
+		} else if err != nil {
+			logEvent(c, LogWarning, "nds:saveMemcache CompareAndSwapMulti",
+				"error", err)
+		}
+	}
+}
+
+// SetCASRetries sets how many times GetMulti tries again to cache an entity
+// whose memcache item could not be updated by CompareAndSwap. Each attempt
+// waits for backoff(attempt), if backoff is not nil, then locks the item and
+// reads the entity from the datastore again, exactly as for a cache miss. The
+// entities returned by GetMulti are not changed by retries. The default of
+// zero retries leaves such entities uncached until they are next got.
+//
+// Retries cost extra memcache and datastore calls and delay GetMulti, so they
+// are only worthwhile when the same entities are got far more often than
+// they are written.
+func SetCASRetries(n int, backoff func(attempt int) time.Duration) {
+	updateConfig(func(cfg *config) {
+		cfg.casRetries = n
+		cfg.casBackoff = backoff
+	})
+}
+
+// retrySaveMemcache tries again to cache the entities of cacheItems whose
+// CompareAndSwap failed and returns the number of keys retried. The entities
+// are loaded into new property lists rather than the vals of cacheItems, which
+// already hold the entities got by GetMulti.
+func retrySaveMemcache(c, memcacheCtx context.Context, cacheItems []cacheItem,
+	valsType reflect.Type) int {
+
+	pending := []cacheItem{}
+	for _, cacheItem := range cacheItems {
+		if cacheItem.casFailed {
+			pending = append(pending, cacheItem)
 		}
 	}
 
-	if err := memcacheCompareAndSwapMulti(c, saveItems); err != nil {
-		log.Warningf(c, "nds:saveMemcache CompareAndSwapMulti %s", err)
+	cfg := loadConfig()
+	retries := 0
+	for attempt := 1; attempt <= cfg.casRetries && len(pending) > 0; attempt++ {
+		if backoff := cfg.casBackoff; backoff != nil {
+			select {
+			case <-time.After(backoff(attempt)):
+			case <-c.Done():
+			}
+		}
+		if c.Err() != nil {
+			break
+		}
+
+		for i, failed := range pending {
+			pending[i] = cacheItem{
+				key:         failed.key,
+				memcacheKey: failed.memcacheKey,
+				val:         reflect.New(typeOfPropertyList).Elem(),
+				noCache:     failed.noCache,
+				state:       miss,
+			}
+		}
+		retries += len(pending)
+
+		lockMemcache(memcacheCtx, pending)
+		if err := loadDatastore(c, pending, valsType); err != nil {
+			logEvent(c, LogWarning, "nds:retrySaveMemcache loadDatastore",
+				"error", err)
+			break
+		}
+		saveMemcache(memcacheCtx, pending)
+
+		failed := pending[:0]
+		for _, cacheItem := range pending {
+			if cacheItem.casFailed {
+				failed = append(failed, cacheItem)
+			}
+		}
+		pending = failed
 	}
+	return retries
 }
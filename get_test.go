@@ -4,6 +4,7 @@ import (
 	"io"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/qedus/nds"
 
@@ -11,6 +12,7 @@ import (
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/memcache"
 )
@@ -275,6 +277,52 @@ func TestGetMultiPropertyLoadSaver(t *testing.T) {
 	}
 }
 
+func TestGetMultiPropertyList(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	parentKey := datastore.NewKey(c, "Parent", "parent", 0, nil)
+	nestedKey := datastore.NewKey(c, "Nested", "", 3, parentKey)
+	geoPoint := appengine.GeoPoint{Lat: 1, Lng: 2}
+
+	pls := []datastore.PropertyList{
+		{
+			datastore.Property{Name: "Key", Value: nestedKey},
+			datastore.Property{Name: "GeoPoint", Value: geoPoint},
+		},
+		{
+			datastore.Property{Name: "Multi", Value: "a", Multiple: true},
+			datastore.Property{Name: "Multi", Value: "b", Multiple: true},
+			datastore.Property{Name: "Int", Value: int64(4), NoIndex: true},
+		},
+	}
+	if _, err := nds.PutMulti(c, keys, pls); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from datastore then from cache.
+	for i := 0; i < 2; i++ {
+		getPls := make([]datastore.PropertyList, len(keys))
+		if err := nds.GetMulti(c, keys, getPls); err != nil {
+			t.Fatal(err)
+		}
+
+		if !getPls[0][0].Value.(*datastore.Key).Equal(nestedKey) {
+			t.Fatal("incorrect nested key", getPls[0][0].Value)
+		}
+		if getPls[0][1].Value != geoPoint {
+			t.Fatal("incorrect geo point", getPls[0][1].Value)
+		}
+		if !reflect.DeepEqual(getPls[1], pls[1]) {
+			t.Fatal("incorrect PropertyList", getPls[1])
+		}
+	}
+}
+
 func TestGetMultiNoKeys(t *testing.T) {
 	c, closeFunc := NewContext(t)
 	defer closeFunc()
@@ -1279,3 +1327,588 @@ func TestUnsupportedValueType(t *testing.T) {
 		t.Fatal("expected unsupported value error")
 	}
 }
+
+func TestGetMultiContextDone(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache with the first key only.
+	if err := nds.Get(c, keys[0], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancel the context while the second key is being locked.
+	cc, cancel := context.WithCancel(c)
+	defer cancel()
+	nds.SetMemcacheAddMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		cancel()
+		return memcache.AddMulti(c, items)
+	})
+	defer nds.SetMemcacheAddMulti(memcache.AddMulti)
+
+	datastoreCalled := false
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		datastoreCalled = true
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	entities := make([]testEntity, 2)
+	err := nds.GetMulti(cc, keys, entities)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil || me[1] != context.Canceled {
+		t.Fatal("incorrect errors", me)
+	}
+	if entities[0].IntVal != 1 {
+		t.Fatal("expected cached entity", entities[0].IntVal)
+	}
+	if datastoreCalled {
+		t.Fatal("expected no datastore call")
+	}
+}
+
+func TestGetMultiPartialResults(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	type otherEntity struct {
+		StringVal string
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+		datastore.NewKey(c, "Entity", "", 4, nil),
+	}
+	if _, err := nds.PutMulti(c, []*datastore.Key{keys[0], keys[1], keys[3]},
+		[]testEntity{{1}, {2}, {4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from the datastore and then from memcache.
+	for i := 0; i < 2; i++ {
+		response := []interface{}{
+			&testEntity{}, &otherEntity{}, &testEntity{}, &testEntity{},
+		}
+		err := nds.GetMulti(c, keys, response)
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			t.Fatal("expected appengine.MultiError", err)
+		}
+		if me[0] != nil || me[3] != nil {
+			t.Fatal("expected no errors", me)
+		}
+		if _, ok := me[1].(*datastore.ErrFieldMismatch); !ok {
+			t.Fatal("expected datastore.ErrFieldMismatch", me[1])
+		}
+		if me[2] != datastore.ErrNoSuchEntity {
+			t.Fatal("expected datastore.ErrNoSuchEntity", me[2])
+		}
+		if response[0].(*testEntity).IntVal != 1 ||
+			response[3].(*testEntity).IntVal != 4 {
+			t.Fatal("incorrect entities", response[0], response[3])
+		}
+	}
+}
+
+func TestGetMultiSimpleCacheKinds(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	nds.SetSimpleCacheKinds([]string{"Simple"})
+	defer nds.SetSimpleCacheKinds(nil)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Simple", "", 1, nil),
+		datastore.NewKey(c, "Simple", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		return errors.New("unexpected compare and swap")
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	var addFlags []uint32
+	nds.SetMemcacheAddMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			addFlags = append(addFlags, item.Flags)
+		}
+		return memcache.AddMulti(c, items)
+	})
+	defer nds.SetMemcacheAddMulti(memcache.AddMulti)
+
+	response := make([]testEntity, len(keys))
+	err := nds.GetMulti(c, keys, response)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if len(addFlags) != 2 || addFlags[0] != nds.EntityItem ||
+		addFlags[1] != nds.NoneItem {
+		t.Fatal("expected entities added without locks", addFlags)
+	}
+
+	// Cached without locks.
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		return errors.New("unexpected datastore get")
+	})
+	response = make([]testEntity, len(keys))
+	err = nds.GetMulti(c, keys, response)
+	nds.SetDatastoreGetMulti(datastore.GetMulti)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if response[0].IntVal != 1 {
+		t.Fatal("incorrect IntVal", response[0].IntVal)
+	}
+
+	// Puts still invalidate memcache.
+	if _, err := nds.Put(c, keys[1], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &testEntity{}
+	if err := nds.Get(c, keys[1], entity); err != nil {
+		t.Fatal(err)
+	} else if entity.IntVal != 2 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+}
+
+type mixedEntity interface {
+	Value() int64
+}
+
+type mixedEntityA struct {
+	IntVal int64
+}
+
+func (e *mixedEntityA) Value() int64 {
+	return e.IntVal
+}
+
+type mixedEntityB struct {
+	StringVal string
+	IntVal    int64
+}
+
+func (e *mixedEntityB) Value() int64 {
+	return e.IntVal * 10
+}
+
+func TestGetMultiMixedInterface(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "EntityA", "", 1, nil),
+		datastore.NewKey(c, "EntityB", "", 2, nil),
+	}
+	entities := []mixedEntity{
+		&mixedEntityA{1},
+		&mixedEntityB{"two", 2},
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from the datastore and then from memcache.
+	for i := 0; i < 2; i++ {
+		response := []mixedEntity{&mixedEntityA{}, &mixedEntityB{}}
+		if err := nds.GetMulti(c, keys, response); err != nil {
+			t.Fatal(err)
+		}
+		if response[0].Value() != 1 || response[1].Value() != 20 {
+			t.Fatal("incorrect values", response)
+		}
+		if response[1].(*mixedEntityB).StringVal != "two" {
+			t.Fatal("incorrect StringVal", response[1])
+		}
+	}
+}
+
+func TestGetMultiCASRetries(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var attempts []int
+	nds.SetCASRetries(3, func(attempt int) time.Duration {
+		attempts = append(attempts, attempt)
+		return time.Millisecond
+	})
+	defer nds.SetCASRetries(0, nil)
+
+	// Fail the first two compare and swaps.
+	casCalls := 0
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		casCalls++
+		if casCalls <= 2 {
+			me := make(appengine.MultiError, len(items))
+			for i := range me {
+				me[i] = memcache.ErrCASConflict
+			}
+			return me
+		}
+		return memcache.CompareAndSwapMulti(c, items)
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	sl := &statsLog{}
+	nds.SetStatsRecorder(sl.record)
+	defer nds.SetStatsRecorder(nil)
+
+	response := make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, response); err != nil {
+		t.Fatal(err)
+	}
+	if response[0].IntVal != 1 || response[1].IntVal != 2 {
+		t.Fatal("incorrect entities", response)
+	}
+	if len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Fatal("incorrect attempts", attempts)
+	}
+	if s := sl.last(); s.CASFailures != 2 || s.CASRetries != 4 {
+		t.Fatalf("incorrect stats %+v", s)
+	}
+
+	for _, key := range keys {
+		item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+		if err != nil {
+			t.Fatal(err)
+		} else if item.Flags != nds.ItemFlagEntity {
+			t.Fatal("expected cached entity", item.Flags)
+		}
+	}
+}
+
+func TestGetMultiEventual(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var addFlags []uint32
+	nds.SetMemcacheAddMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			addFlags = append(addFlags, item.Flags)
+		}
+		return memcache.AddMulti(c, items)
+	})
+	defer nds.SetMemcacheAddMulti(memcache.AddMulti)
+
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		return errors.New("unexpected compare and swap")
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	response := make([]testEntity, len(keys))
+	if err := nds.GetMultiEventual(c, keys, response); err != nil {
+		t.Fatal(err)
+	}
+	if response[0].IntVal != 1 || response[1].IntVal != 2 {
+		t.Fatal("incorrect entities", response)
+	}
+	if len(addFlags) != 2 || addFlags[0] != nds.ItemFlagEntity ||
+		addFlags[1] != nds.ItemFlagEntity {
+		t.Fatal("expected entities added without locks", addFlags)
+	}
+
+	// The entities are now cached for GetMulti.
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		return errors.New("unexpected datastore get")
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	response = make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, response); err != nil {
+		t.Fatal(err)
+	}
+	if response[0].IntVal != 1 || response[1].IntVal != 2 {
+		t.Fatal("incorrect entities", response)
+	}
+}
+
+func TestGetMultiIgnoreFieldMismatch(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type savedEntity struct {
+		Tags    []string
+		Removed int64
+	}
+
+	type testEntity struct {
+		Tags []string
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0],
+		&savedEntity{[]string{"a", "b"}, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.Put(c, keys[1],
+		&testEntity{[]string{"c"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ic := nds.WithIgnoreFieldMismatch(c)
+
+	// Get from the datastore and then from memcache.
+	for i := 0; i < 2; i++ {
+		response := make([]testEntity, len(keys))
+		err := nds.GetMulti(ic, keys, response)
+		fme, ok := err.(*nds.FieldMismatchError)
+		if !ok {
+			t.Fatal("expected *nds.FieldMismatchError", err)
+		}
+		if _, ok := fme.Errs[0].(*datastore.ErrFieldMismatch); !ok ||
+			fme.Errs[1] != nil {
+			t.Fatal("incorrect errors", fme.Errs)
+		}
+
+		// Entities must only be loaded once.
+		if len(response[0].Tags) != 2 || len(response[1].Tags) != 1 {
+			t.Fatal("incorrect entities", response)
+		}
+	}
+
+	// Other errors are still returned in an appengine.MultiError, together
+	// with the field mismatches.
+	keys = append(keys, datastore.NewKey(c, "Entity", "", 3, nil))
+	err := nds.GetMulti(ic, keys, make([]testEntity, len(keys)))
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if _, ok := me[0].(*datastore.ErrFieldMismatch); !ok ||
+		me[1] != nil || me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+
+	if err := nds.Get(ic, keys[0], &testEntity{}); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(*nds.FieldMismatchError); !ok {
+		t.Fatal("expected *nds.FieldMismatchError", err)
+	}
+}
+
+func TestGetMultiAllocateValues(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from the datastore and then from memcache.
+	for i := 0; i < 2; i++ {
+		ptrs := make([]*testEntity, len(keys))
+		err := nds.GetMulti(c, keys, ptrs)
+		if me, ok := err.(appengine.MultiError); !ok {
+			t.Fatal("expected appengine.MultiError", err)
+		} else if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+			t.Fatal("incorrect errors", me)
+		}
+		if ptrs[0] == nil || ptrs[0].IntVal != 1 || ptrs[1] != nil {
+			t.Fatal("incorrect entities", ptrs)
+		}
+
+		ifaces := []interface{}{(*testEntity)(nil)}
+		if err := nds.GetMulti(c, keys[:1], ifaces); err != nil {
+			t.Fatal(err)
+		}
+		if e, ok := ifaces[0].(*testEntity); !ok || e == nil ||
+			e.IntVal != 1 {
+			t.Fatal("incorrect entity", ifaces[0])
+		}
+	}
+
+	// Nil interfaces cannot be allocated.
+	ifaces := []interface{}{&testEntity{}, nil}
+	err := nds.GetMulti(c, keys, ifaces)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != datastore.ErrInvalidEntityType {
+		t.Fatal("incorrect errors", me)
+	}
+
+	if err := nds.Get(c, keys[0],
+		(*testEntity)(nil)); err != datastore.ErrInvalidEntityType {
+		t.Fatal("expected datastore.ErrInvalidEntityType", err)
+	}
+}
+
+func TestGetMultiLockNeverReleased(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lock that never expires, as if it was left by a crashed writer.
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.MemcacheKey(c, key),
+		Flags: nds.LockItem,
+		Value: []byte{1, 2, 3, 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	datastoreGets := 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		datastoreGets++
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	// Each get reads the datastore rather than waiting for the lock.
+	for i := 0; i < 3; i++ {
+		entity := &testEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 1 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+	}
+	if datastoreGets != 3 {
+		t.Fatal("incorrect datastore gets", datastoreGets)
+	}
+}
+
+// BenchmarkGetMultiHalfAbsent gets batches of keys of which half have no
+// entity, both when nothing is cached and when every key is cached.
+func BenchmarkGetMultiHalfAbsent(b *testing.B) {
+	c, closeFunc, err := aetest.NewContext()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	const batchSize = 100
+	keys := make([]*datastore.Key, batchSize)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+	}
+	putKeys := []*datastore.Key{}
+	putEntities := []testEntity{}
+	for i := 0; i < batchSize; i += 2 {
+		putKeys = append(putKeys, keys[i])
+		putEntities = append(putEntities, testEntity{int64(i)})
+	}
+	if _, err := nds.PutMulti(c, putKeys, putEntities); err != nil {
+		b.Fatal(err)
+	}
+
+	getMulti := func(b *testing.B) {
+		entities := make([]testEntity, batchSize)
+		err := nds.GetMulti(c, keys, entities)
+		if me, ok := err.(appengine.MultiError); !ok {
+			b.Fatal("expected appengine.MultiError", err)
+		} else if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+			b.Fatal("incorrect errors", me[0], me[1])
+		}
+	}
+
+	b.Run("Uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			if err := memcache.Flush(c); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			getMulti(b)
+		}
+	})
+
+	b.Run("Cached", func(b *testing.B) {
+		getMulti(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			getMulti(b)
+		}
+	})
+}
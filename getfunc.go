@@ -0,0 +1,58 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// GetMultiFunc works like GetMulti but passes each entity to onResult instead
+// of loading it into a slice, so that the entities of many keys can be
+// processed without holding them all in memory. Keys are got in chunks of
+// 1000, one chunk after another, and onResult is called once for each key of a
+// chunk as soon as the chunk has been got, in the order of keys. i is the index
+// of the key in keys, dst is the destination returned by newDst for the key
+// and err is the error of the key, such as datastore.ErrNoSuchEntity.
+//
+// newDst must return a new struct pointer or datastore.PropertyLoadSaver each
+// time it is called. onResult is called from the goroutine that called
+// GetMultiFunc and can keep dst. As with GetMulti, errors of a whole chunk,
+// such as a failed datastore call, are given to each key of the chunk. Any
+// other error is returned without calling onResult for the remaining keys.
+func GetMultiFunc(c context.Context, keys []*datastore.Key,
+	newDst func() interface{},
+	onResult func(i int, dst interface{}, err error)) error {
+
+	for lo := 0; lo < len(keys); lo += getMultiLimit {
+		hi := lo + getMultiLimit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+
+		vals := make([]interface{}, hi-lo)
+		for i := range vals {
+			vals[i] = newDst()
+		}
+
+		err := GetMulti(c, keys[lo:hi], vals)
+		var errs appengine.MultiError
+		switch e := err.(type) {
+		case nil:
+		case appengine.MultiError:
+			errs = e
+		case *FieldMismatchError:
+			errs = e.Errs
+		default:
+			return err
+		}
+
+		for i, val := range vals {
+			var err error
+			if errs != nil {
+				err = errs[i]
+			}
+			onResult(lo+i, val, err)
+		}
+	}
+	return nil
+}
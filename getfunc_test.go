@@ -0,0 +1,77 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetMultiFunc(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	// More keys than a single chunk, with every third entity missing.
+	keys := make([]*datastore.Key, 2500)
+	putKeys := []*datastore.Key{}
+	entities := []testEntity{}
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+		if i%3 != 0 {
+			putKeys = append(putKeys, keys[i])
+			entities = append(entities, testEntity{i})
+		}
+	}
+	if _, err := nds.PutMulti(nds.WithNoCache(c), putKeys,
+		entities); err != nil {
+		t.Fatal(err)
+	}
+
+	next := 0
+	err := nds.GetMultiFunc(c, keys, func() interface{} {
+		return &testEntity{}
+	}, func(i int, dst interface{}, err error) {
+		if i != next {
+			t.Fatalf("expected index %d, got %d", next, i)
+		}
+		next++
+
+		if i%3 == 0 {
+			if err != datastore.ErrNoSuchEntity {
+				t.Fatalf("expected no entity for %d, got %v", i, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dst.(*testEntity).IntVal; got != i {
+			t.Fatalf("expected IntVal %d, got %d", i, got)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != len(keys) {
+		t.Fatalf("expected %d results, got %d", len(keys), next)
+	}
+
+	// Invalid keys only fail themselves.
+	invalidKeys := []*datastore.Key{nil, keys[1]}
+	errs := make([]error, len(invalidKeys))
+	err = nds.GetMultiFunc(c, invalidKeys, func() interface{} {
+		return &testEntity{}
+	}, func(i int, dst interface{}, err error) {
+		errs[i] = err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != datastore.ErrInvalidKey || errs[1] != nil {
+		t.Fatalf("incorrect errors %v", errs)
+	}
+}
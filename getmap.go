@@ -0,0 +1,64 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// GetMap works like GetMulti but returns the entities in a map keyed by the
+// encoded form of their keys, as returned by datastore.Key.Encode, for code
+// that looks entities up by key rather than by index. newDst must return a new
+// struct pointer or datastore.PropertyLoadSaver for each key, into which its
+// entity is loaded.
+//
+// Keys that have no entity are left out of the map and are not errors. Any
+// other error of a key is returned in an appengine.MultiError aligned with
+// keys, and its entity is left out of the map unless the error is a
+// *datastore.ErrFieldMismatch, as the entity is then loaded as far as
+// possible. Errors of the whole call are returned with a nil map.
+func GetMap(c context.Context, keys []*datastore.Key,
+	newDst func() interface{}) (map[string]interface{}, error) {
+
+	vals := make([]interface{}, len(keys))
+	for i := range vals {
+		vals[i] = newDst()
+	}
+
+	err := GetMulti(c, keys, vals)
+	if _, ok := err.(*FieldMismatchError); ok {
+		return newEntityMap(keys, vals, nil), err
+	}
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, e := range me {
+		if e != nil && e != datastore.ErrNoSuchEntity {
+			errs[i] = e
+			errsNil = false
+		}
+	}
+	entities := newEntityMap(keys, vals, me)
+	if errsNil {
+		return entities, nil
+	}
+	return entities, errs
+}
+
+// newEntityMap returns vals keyed by the encoded keys, leaving out the vals
+// whose slots of me hold an error other than a field mismatch. me can be nil.
+func newEntityMap(keys []*datastore.Key, vals []interface{},
+	me appengine.MultiError) map[string]interface{} {
+
+	entities := make(map[string]interface{}, len(keys))
+	for i, key := range keys {
+		if me != nil && me[i] != nil && !isFieldMismatch(me[i]) {
+			continue
+		}
+		entities[key.Encode()] = vals[i]
+	}
+	return entities
+}
@@ -0,0 +1,69 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetMap(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+	type otherEntity struct {
+		StringVal string
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, []*datastore.Key{keys[0], keys[2]},
+		[]testEntity{{1}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	newDst := func() interface{} { return &testEntity{} }
+	entities, err := nds.GetMap(c, keys, newDst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 2 {
+		t.Fatal("incorrect entities", entities)
+	}
+	for _, i := range []int{0, 2} {
+		entity, ok := entities[keys[i].Encode()].(*testEntity)
+		if !ok || entity.IntVal != i+1 {
+			t.Fatalf("incorrect entity %d: %v", i, entities[keys[i].Encode()])
+		}
+	}
+
+	// Other errors are returned for their keys.
+	if _, err := nds.Put(c, keys[1], &otherEntity{"two"}); err != nil {
+		t.Fatal(err)
+	}
+	entities, err = nds.GetMap(c, keys, newDst)
+	me, ok := err.(appengine.MultiError)
+	if !ok || me[0] != nil || me[2] != nil {
+		t.Fatal("expected an error for the second key", err)
+	}
+	if _, ok := me[1].(*datastore.ErrFieldMismatch); !ok {
+		t.Fatal("expected *datastore.ErrFieldMismatch", me[1])
+	}
+	if len(entities) != 3 {
+		t.Fatal("expected partially loaded entity", entities)
+	}
+
+	// Keys that are not valid fail the whole call.
+	if _, err := nds.GetMap(c, keys, func() interface{} {
+		return testEntity{}
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+}
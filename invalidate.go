@@ -0,0 +1,116 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Invalidate removes the cached entities of keys from memcache and the local
+// cache of c without touching the datastore. Use it after entities have been
+// changed in the datastore without nds, for example by another service, so
+// that the changes are seen by Get and GetMulti. This includes keys cached as
+// having no entity. Nil and incomplete keys are ignored.
+//
+// Deleting the memcache items of keys would also delete the locks of any
+// concurrent Put or Delete, allowing a concurrent GetMulti to cache the entity
+// being replaced. Invalidate therefore locks the memcache items in the same way
+// as Put instead, so an entity is not cached again until its lock expires or
+// it is put. A concurrent GetMulti that read an entity before it was
+// invalidated cannot cache it either, as its compare and swap fails once the
+// item has been locked. Invalidate can therefore also be used to force
+// entities to be read from the datastore again, such as after a bulk index
+// rebuild, without deleting them.
+func Invalidate(c context.Context, keys []*datastore.Key) error {
+	for lo := 0; lo < len(keys); lo += putMultiLimit {
+		hi := lo + putMultiLimit
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+		if err := invalidateMemcache(c, keys[lo:hi]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushKind removes the cached entities of kind in the namespace of c from
+// memcache, for example after a schema migration has changed them directly in
+// the datastore. App Engine memcache can only be flushed as a whole, so
+// FlushKind runs a keys only query for kind and invalidates the memcache items
+// of every key it returns. This costs one datastore key read per entity.
+//
+// Items are invalidated in the same way as Invalidate. Entities of kind
+// created while FlushKind runs might not be found by its query, but their
+// memcache items were already invalidated by the put that created them.
+func FlushKind(c context.Context, kind string) error {
+	_, err := invalidateQuery(c, datastore.NewQuery(kind))
+	return err
+}
+
+// InvalidatePrefix invalidates the cached entities of kind that descend from
+// ancestor, such as after migrating the entities of one entity group, and
+// returns how many keys were invalidated. An empty kind matches entities of
+// every kind and a nil ancestor matches entities with any ancestor in the
+// namespace of c. Keys are found by a keys only query and invalidated in
+// batches as they are returned, so memory use is bounded however many entities
+// match. Items are invalidated in the same way as Invalidate.
+//
+// An ancestor query is strongly consistent, so every entity descending from
+// ancestor when InvalidatePrefix is called is found.
+func InvalidatePrefix(c context.Context, kind string,
+	ancestor *datastore.Key) (int, error) {
+
+	q := datastore.NewQuery(kind)
+	if ancestor != nil {
+		q = q.Ancestor(ancestor)
+	}
+	return invalidateQuery(c, q)
+}
+
+// invalidateQuery invalidates the memcache items of the keys returned by q in
+// batches and returns how many were invalidated.
+func invalidateQuery(c context.Context, q *datastore.Query) (int, error) {
+	t := q.KeysOnly().Run(c)
+
+	count := 0
+	keys := make([]*datastore.Key, 0, putMultiLimit)
+	for {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return count, err
+		}
+
+		keys = append(keys, key)
+		if len(keys) == putMultiLimit {
+			if err := invalidateMemcache(c, keys); err != nil {
+				return count, err
+			}
+			count += len(keys)
+			keys = keys[:0]
+		}
+	}
+	if err := invalidateMemcache(c, keys); err != nil {
+		return count, err
+	}
+	return count + len(keys), nil
+}
+
+// invalidateMemcache locks the memcache items of keys so no stale entities can
+// be got from memcache for them.
+func invalidateMemcache(c context.Context, keys []*datastore.Key) error {
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return err
+	}
+
+	items := createLockItems(c, keys)
+	for _, batch := range batchItems(items) {
+		if err := tracedMemcacheSetMulti(memcacheCtx, batch); err != nil {
+			return err
+		}
+	}
+	invalidateLocalCache(c, keys)
+	return nil
+}
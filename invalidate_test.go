@@ -0,0 +1,172 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestFlushKind(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Flush", "", 1, nil),
+		datastore.NewKey(c, "Flush", "", 2, nil),
+		datastore.NewKey(c, "Other", "", 1, nil),
+	}
+	entities := []testEntity{{1}, {2}, {3}}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the entities then change them behind the back of nds.
+	if err := nds.GetMulti(c, keys, make([]testEntity, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.PutMulti(c, keys,
+		[]testEntity{{4}, {5}, {6}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kind queries are eventually consistent so wait for the entities.
+	for i := 0; ; i++ {
+		keys, err := datastore.NewQuery("Flush").KeysOnly().GetAll(c, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) == 2 {
+			break
+		} else if i == 50 {
+			t.Fatal("entities not found by query")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := nds.FlushKind(c, "Flush"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range keys {
+		item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 && item.Flags != nds.ItemFlagLock {
+			t.Fatal("expected flushed item to be locked", item.Flags)
+		} else if i == 2 && item.Flags != nds.ItemFlagEntity {
+			t.Fatal("expected other kind to stay cached", item.Flags)
+		}
+	}
+
+	response := make([]testEntity, 3)
+	if err := nds.GetMulti(c, keys, response); err != nil {
+		t.Fatal(err)
+	}
+	if response[0].IntVal != 4 || response[1].IntVal != 5 ||
+		response[2].IntVal != 3 {
+		t.Fatal("incorrect entities", response)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache an entity and a missing entity.
+	lc := nds.WithLocalCache(c)
+	if err := nds.GetMulti(lc, keys, make([]testEntity, 2)); err == nil {
+		t.Fatal("expected no such entity error")
+	}
+
+	// Change both without nds.
+	if _, err := datastore.PutMulti(c, keys,
+		[]testEntity{{3}, {4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Invalidate(lc, append(keys, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []context.Context{c, lc} {
+		response := make([]testEntity, 2)
+		if err := nds.GetMulti(c, keys, response); err != nil {
+			t.Fatal(err)
+		}
+		if response[0].IntVal != 3 || response[1].IntVal != 4 {
+			t.Fatal("incorrect entities", response)
+		}
+	}
+}
+
+func TestInvalidatePrefix(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	otherParent := datastore.NewKey(c, "Parent", "", 2, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Other", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 1, otherParent),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.GetMulti(c, keys, make([]testEntity, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := nds.InvalidatePrefix(c, "Entity", parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("incorrect count", count)
+	}
+
+	for i, key := range keys {
+		item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && item.Flags != nds.ItemFlagLock {
+			t.Fatal("expected invalidated item to be locked", item.Flags)
+		} else if i > 0 && item.Flags != nds.ItemFlagEntity {
+			t.Fatal("expected other entities to stay cached", item.Flags)
+		}
+	}
+
+	// An empty kind invalidates every kind.
+	if count, err := nds.InvalidatePrefix(c, "", parent); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatal("incorrect count", count)
+	}
+}
@@ -0,0 +1,178 @@
+package nds
+
+import (
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Iterator is the result of running a query with Run. It works just like
+// datastore.Iterator except that it caches the entities it returns.
+type Iterator struct {
+	c           context.Context
+	memcacheCtx context.Context
+	it          *datastore.Iterator
+	cache       bool
+}
+
+// Run runs q just like q.Run but the returned Iterator also caches each whole
+// entity it returns in memcache, so the results of a list view warm the cache
+// for subsequent Get and GetMulti calls of the same entities.
+//
+// An entity is only cached if it is not already in memcache. This means a
+// cached entity or a lock taken by a concurrent Put or Delete is never
+// overwritten. However, entities are cached without a lock, so any query can
+// cache a stale entity. A Put that completes between the query reading an
+// entity and Run caching it leaves the old entity cached, and queries without
+// an ancestor are also eventually consistent so can return an entity as it
+// was before a recent Put. To bound how long such an entity is served, the
+// entities cached by queries expire after at most five minutes, or the
+// expiration set with WithEntityExpiration if that is shorter. Only use Run
+// on entities that can tolerate being stale for that long.
+//
+// Keys only and projection queries return partial entities so their results
+// are never cached. Neither are the results of queries run within
+// transactions or contexts created with WithNoCache.
+func Run(c context.Context, q *datastore.Query) *Iterator {
+	it := &Iterator{
+		c:  c,
+		it: q.Run(c),
+	}
+
+	_, inTransaction := transactionFromContext(c)
+	if inTransaction || optionsFromContext(c).noCache ||
+		!queryReturnsEntities(q) {
+		return it
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		logEvent(c, LogWarning, "nds:Run memcacheContext", "error", err)
+		return it
+	}
+	it.memcacheCtx = memcacheCtx
+	it.cache = true
+	return it
+}
+
+// queryReturnsEntities reports whether q returns whole entities. The fields
+// of datastore.Query are unexported so reflection is used to read them.
+func queryReturnsEntities(q *datastore.Query) bool {
+	v := reflect.ValueOf(q).Elem()
+	keysOnly := v.FieldByName("keysOnly")
+	projection := v.FieldByName("projection")
+	if !keysOnly.IsValid() || !projection.IsValid() {
+		return false
+	}
+	return !keysOnly.Bool() && projection.Len() == 0
+}
+
+// Next returns the key of the next result and loads it into dst, caching it if
+// possible. When there are no more results, datastore.Done is returned. dst
+// must be a struct pointer or implement datastore.PropertyLoadSaver. dst is
+// ignored for keys only queries and can be nil.
+func (t *Iterator) Next(dst interface{}) (*datastore.Key, error) {
+	if !t.cache {
+		return t.it.Next(dst)
+	}
+
+	pl := datastore.PropertyList{}
+	key, err := t.it.Next(&pl)
+	if err != nil {
+		return key, err
+	}
+	t.save(key, removeNoCacheProperties(pl, keyNoCacheProperties(key,
+		noCacheProperties(reflect.ValueOf(dst)))))
+
+	if pls, ok := dst.(datastore.PropertyLoadSaver); ok {
+		return key, pls.Load(pl)
+	}
+	return key, datastore.LoadStruct(dst, pl)
+}
+
+// save adds pl to memcache under key unless it is already cached or locked.
+func (t *Iterator) save(key *datastore.Key, pl datastore.PropertyList) {
+	if !memcacheAllowed() {
+		return
+	}
+
+	data, err := marshal(pl)
+	if err != nil {
+		logEvent(t.c, LogWarning, "nds:Iterator marshal",
+			"error", &CodecError{key, err})
+		return
+	}
+
+	if err := addEntityItems(t.c, t.memcacheCtx, []*datastore.Key{key},
+		[][]byte{data}, queryEntityExpiration(t.c)); err != nil {
+		logEvent(t.c, LogWarning, "nds:Iterator AddMulti", "error", err)
+	}
+}
+
+// maxQueryEntityExpiration is the longest that an entity cached by a query or
+// PrimeCacheRaw stays in memcache, as it is cached without a lock and can be
+// stale.
+const maxQueryEntityExpiration = 5 * time.Minute
+
+// queryEntityExpiration returns the expiration of entities cached by queries
+// and PrimeCacheRaw for c.
+func queryEntityExpiration(c context.Context) time.Duration {
+	expiration := optionsFromContext(c).entityExpiration
+	if expiration == 0 || expiration > maxQueryEntityExpiration {
+		return maxQueryEntityExpiration
+	}
+	return expiration
+}
+
+// addEntityItems adds data, the marshalled entities of keys, to memcache with
+// expiration unless they are already cached or locked. Entities too large for
+// a single memcache item are not cached as chunks can only be stored under a
+// lock.
+func addEntityItems(c, memcacheCtx context.Context, keys []*datastore.Key,
+	data [][]byte, expiration time.Duration) error {
+
+	items := make([]*memcache.Item, 0, len(keys))
+	for i, key := range keys {
+		if len(data[i]) > memcacheMaxItemSize ||
+			exceedsMaxCachedEntitySize(data[i]) {
+			logEvent(c, LogDebug,
+				"nds:addEntityItems entity too large to cache",
+				"size", len(data[i]))
+			continue
+		}
+		items = append(items, &memcache.Item{
+			Key:        createMemcacheKey(c, key),
+			Flags:      entityItem,
+			Value:      data[i],
+			Expiration: expiration,
+		})
+	}
+
+	for _, batch := range batchItems(items) {
+		err := tracedMemcacheAddMulti(memcacheCtx, batch)
+		if err == nil {
+			continue
+		}
+
+		// memcache.ErrNotStored means an entity is already cached or locked.
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			return err
+		}
+		for _, e := range me {
+			if e != nil && e != memcache.ErrNotStored {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Cursor returns a cursor for the current position of the iterator.
+func (t *Iterator) Cursor() (datastore.Cursor, error) {
+	return t.it.Cursor()
+}
@@ -0,0 +1,161 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestRun(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+	}
+
+	// Put directly to the datastore so nothing is cached.
+	if _, err := datastore.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	isCached := func(key *datastore.Key) bool {
+		_, err := memcache.Get(c, nds.MemcacheKey(c, key))
+		if err != nil && err != memcache.ErrCacheMiss {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	// Keys only and projection queries are not cached.
+	for _, q := range []*datastore.Query{
+		datastore.NewQuery("Entity").Ancestor(parent).KeysOnly(),
+		datastore.NewQuery("Entity").Ancestor(parent).Project("IntVal"),
+	} {
+		it := nds.Run(c, q)
+		count := 0
+		for {
+			entity := testEntity{}
+			if _, err := it.Next(&entity); err == datastore.Done {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			count++
+		}
+		if count != len(keys) {
+			t.Fatal("incorrect result count", count)
+		}
+		for _, key := range keys {
+			if isCached(key) {
+				t.Fatal("unexpected cached entity", key)
+			}
+		}
+	}
+
+	it := nds.Run(c, datastore.NewQuery("Entity").Ancestor(parent).
+		Order("IntVal"))
+	for i := 0; ; i++ {
+		entity := testEntity{}
+		key, err := it.Next(&entity)
+		if err == datastore.Done {
+			if i != len(keys) {
+				t.Fatal("incorrect result count", i)
+			}
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if !key.Equal(keys[i]) || entity.IntVal != int64(i+1) {
+			t.Fatal("incorrect result", key, entity)
+		}
+	}
+	if _, err := it.Cursor(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entities can now be got from memcache.
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		return errors.New("should not be called")
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	entities := make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].IntVal != 1 || entities[1].IntVal != 2 {
+		t.Fatal("incorrect entities", entities)
+	}
+}
+
+func TestRunEntityExpiration(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	key := datastore.NewKey(c, "Entity", "", 1, parent)
+	if _, err := datastore.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var expirations []time.Duration
+	nds.SetMemcacheAddMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			expirations = append(expirations, item.Expiration)
+		}
+		return memcache.AddMulti(c, items)
+	})
+	defer nds.SetMemcacheAddMulti(memcache.AddMulti)
+
+	minute, err := nds.WithEntityExpiration(c, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour, err := nds.WithEntityExpiration(c, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Query entities can be stale so their expiration is bounded.
+	for _, test := range []struct {
+		c          context.Context
+		expiration time.Duration
+	}{
+		{c, 5 * time.Minute},
+		{hour, 5 * time.Minute},
+		{minute, time.Minute},
+	} {
+		if err := memcache.Flush(c); err != nil {
+			t.Fatal(err)
+		}
+		expirations = nil
+
+		it := nds.Run(test.c, datastore.NewQuery("Entity").Ancestor(parent))
+		if _, err := it.Next(&testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+		if len(expirations) != 1 || expirations[0] != test.expiration {
+			t.Fatalf("expected expiration %s, got %v", test.expiration,
+				expirations)
+		}
+	}
+}
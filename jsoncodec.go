@@ -0,0 +1,262 @@
+package nds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// JSONCodec is a Codec that marshals entities as JSON so that services written
+// in other languages can share the entities nds caches in memcache. Set it with
+// SetCodec(JSONCodec{}) in every service sharing memcache.
+//
+// Every cached entity starts with a three byte header: the codec ID, which is
+// 1 for JSONCodec, a compression tag and the cache version set with
+// SetCacheVersion. A compression tag of 0 means the rest of the value is the
+// JSON and 1 means it is compressed with raw DEFLATE, as by zlib with a window
+// bits value of -15. Entities are cached with the memcache flags ItemFlagEntity
+// and ItemFlagNone is used for keys that have no entity.
+//
+// The JSON is an array of properties of the form
+//
+//	{"name": "Tags", "multiple": true, "noindex": false,
+//	 "type": "string", "value": "red"}
+//
+// where type and value are one of these:
+//
+//	"null"       null
+//	"int"        a number holding an int64
+//	"bool"       true or false
+//	"string"     a string
+//	"float"      a number
+//	"bytes"      a base64 string holding a []byte
+//	"bytestring" a base64 string holding a datastore.ByteString
+//	"time"       an RFC 3339 string in UTC with up to nanosecond precision
+//	"geopoint"   {"lat": number, "lng": number}
+//	"key"        a string holding the key as encoded by datastore.Key.Encode
+//	"blobkey"    a string holding an appengine.BlobKey
+//	"entity"     {"key": a key string or null, "properties": [...]}
+//
+// Encoded keys are the same as Python's ndb.Key.urlsafe. Floats that JSON
+// cannot represent, such as NaN, make entities fail to marshal, so those
+// entities are read from the datastore every time.
+type JSONCodec struct{}
+
+// ID returns 1.
+func (JSONCodec) ID() byte {
+	return 1
+}
+
+// Marshal marshals pl as JSON.
+func (JSONCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	props, err := toJSONProperties(pl)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(props)
+}
+
+// Unmarshal appends the properties held by data to pl.
+func (JSONCodec) Unmarshal(data []byte, pl *datastore.PropertyList) error {
+	props := []jsonProperty{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&props); err != nil {
+		return err
+	}
+	ps, err := fromJSONProperties(props)
+	if err != nil {
+		return err
+	}
+	*pl = append(*pl, ps...)
+	return nil
+}
+
+type jsonProperty struct {
+	Name     string          `json:"name"`
+	Multiple bool            `json:"multiple"`
+	NoIndex  bool            `json:"noindex"`
+	Type     string          `json:"type"`
+	Value    json.RawMessage `json:"value"`
+}
+
+type jsonGeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+type jsonEntity struct {
+	Key        *string        `json:"key"`
+	Properties []jsonProperty `json:"properties"`
+}
+
+func toJSONProperties(ps []datastore.Property) ([]jsonProperty, error) {
+	props := make([]jsonProperty, len(ps))
+	for i, p := range ps {
+		t, v, err := toJSONValue(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("nds: property %q: %v", p.Name, err)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("nds: property %q: %v", p.Name, err)
+		}
+		props[i] = jsonProperty{
+			Name:     p.Name,
+			Multiple: p.Multiple,
+			NoIndex:  p.NoIndex,
+			Type:     t,
+			Value:    data,
+		}
+	}
+	return props, nil
+}
+
+// toJSONValue returns the JSON type name of v and the value to marshal for it.
+func toJSONValue(v interface{}) (string, interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return "null", nil, nil
+	case int64:
+		return "int", v, nil
+	case bool:
+		return "bool", v, nil
+	case string:
+		return "string", v, nil
+	case float64:
+		return "float", v, nil
+	case []byte:
+		return "bytes", v, nil
+	case datastore.ByteString:
+		return "bytestring", []byte(v), nil
+	case time.Time:
+		return "time", v.UTC().Format(time.RFC3339Nano), nil
+	case appengine.GeoPoint:
+		return "geopoint", jsonGeoPoint{v.Lat, v.Lng}, nil
+	case *datastore.Key:
+		if v == nil {
+			return "null", nil, nil
+		}
+		return "key", v.Encode(), nil
+	case appengine.BlobKey:
+		return "blobkey", string(v), nil
+	case *datastore.Entity:
+		if v == nil {
+			return "null", nil, nil
+		}
+		e := jsonEntity{}
+		if v.Key != nil {
+			key := v.Key.Encode()
+			e.Key = &key
+		}
+		props, err := toJSONProperties(v.Properties)
+		if err != nil {
+			return "", nil, err
+		}
+		e.Properties = props
+		return "entity", e, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+func fromJSONProperties(props []jsonProperty) ([]datastore.Property, error) {
+	ps := make([]datastore.Property, len(props))
+	for i, p := range props {
+		v, err := fromJSONValue(p.Type, p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("nds: property %q: %v", p.Name, err)
+		}
+		ps[i] = datastore.Property{
+			Name:     p.Name,
+			Value:    v,
+			NoIndex:  p.NoIndex,
+			Multiple: p.Multiple,
+		}
+	}
+	return ps, nil
+}
+
+// fromJSONValue returns the property value of type t held by data.
+func fromJSONValue(t string, data json.RawMessage) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	switch t {
+	case "null":
+		return nil, nil
+	case "int":
+		var n json.Number
+		if err := d.Decode(&n); err != nil {
+			return nil, err
+		}
+		return n.Int64()
+	case "bool":
+		var b bool
+		err := d.Decode(&b)
+		return b, err
+	case "string":
+		var s string
+		err := d.Decode(&s)
+		return s, err
+	case "float":
+		var n json.Number
+		if err := d.Decode(&n); err != nil {
+			return nil, err
+		}
+		return n.Float64()
+	case "bytes":
+		var b []byte
+		err := d.Decode(&b)
+		return b, err
+	case "bytestring":
+		var b []byte
+		err := d.Decode(&b)
+		return datastore.ByteString(b), err
+	case "time":
+		var s string
+		if err := d.Decode(&s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case "geopoint":
+		var g jsonGeoPoint
+		err := d.Decode(&g)
+		return appengine.GeoPoint{Lat: g.Lat, Lng: g.Lng}, err
+	case "key":
+		var s string
+		if err := d.Decode(&s); err != nil {
+			return nil, err
+		}
+		return datastore.DecodeKey(s)
+	case "blobkey":
+		var s string
+		err := d.Decode(&s)
+		return appengine.BlobKey(s), err
+	case "entity":
+		var e jsonEntity
+		if err := d.Decode(&e); err != nil {
+			return nil, err
+		}
+		entity := &datastore.Entity{}
+		if e.Key != nil {
+			key, err := datastore.DecodeKey(*e.Key)
+			if err != nil {
+				return nil, err
+			}
+			entity.Key = key
+		}
+		ps, err := fromJSONProperties(e.Properties)
+		if err != nil {
+			return nil, err
+		}
+		entity.Properties = ps
+		return entity, nil
+	default:
+		return nil, fmt.Errorf("unknown value type %q", t)
+	}
+}
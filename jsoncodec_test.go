@@ -0,0 +1,83 @@
+package nds_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestJSONCodec(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	pl := datastore.PropertyList{
+		{Name: "Null"},
+		{Name: "Int", Value: int64(1) << 60},
+		{Name: "Bool", Value: true},
+		{Name: "String", Value: "a", Multiple: true},
+		{Name: "String", Value: "b", Multiple: true},
+		{Name: "Float", Value: 1.5},
+		{Name: "Bytes", Value: []byte{1, 2}, NoIndex: true},
+		{Name: "ByteString", Value: datastore.ByteString("bs")},
+		{Name: "Time", Value: time.Date(2016, 1, 2, 3, 4, 5, 6000,
+			time.UTC)},
+		{Name: "GeoPoint", Value: appengine.GeoPoint{Lat: 1, Lng: 2}},
+		{Name: "Key", Value: key},
+		{Name: "BlobKey", Value: appengine.BlobKey("blob")},
+		{Name: "Entity", Value: &datastore.Entity{
+			Key: key,
+			Properties: []datastore.Property{
+				{Name: "Inner", Value: int64(2)},
+			},
+		}},
+	}
+
+	codec := nds.JSONCodec{}
+	data, err := codec.Marshal(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := datastore.PropertyList{}
+	if err := codec.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pl) {
+		t.Fatalf("incorrect properties\n%v\n%v", got, pl)
+	}
+
+	data, err = codec.Marshal(datastore.PropertyList{
+		{Name: "Tags", Value: "red", Multiple: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"name":"Tags","multiple":true,"noindex":false,` +
+		`"type":"string","value":"red"}]`
+	if string(data) != expected {
+		t.Fatal("incorrect JSON", string(data))
+	}
+
+	nds.SetCodec(codec)
+	defer nds.SetCodec(nds.GobCodec)
+
+	type testEntity struct {
+		IntVal int
+	}
+	if _, err := nds.Put(c, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		entity := &testEntity{}
+		if err := nds.Get(c, key, entity); err != nil {
+			t.Fatal(err)
+		}
+		if entity.IntVal != 3 {
+			t.Fatal("incorrect IntVal", entity.IntVal)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var localCacheKey = "used for *localCache"
+
+// localCache holds the entities got by GetMulti for the life of a context.
+// A nil PropertyList records that the entity does not exist.
+type localCache struct {
+	sync.Mutex
+	entities map[string]datastore.PropertyList
+
+	// generation is incremented whenever entities are invalidated so that a
+	// GetMulti that started before an invalidation does not store what might
+	// be stale entities.
+	generation uint64
+}
+
+// WithLocalCache returns a replacement context that caches entities in memory
+// for the life of the context. Get and GetMulti check this cache before
+// memcache, so getting the same entity several times within a request costs at
+// most one memcache call. Put, PutMulti, Delete and DeleteMulti remove the
+// entities they change from the cache.
+//
+// The cache is safe to use from concurrent goroutines. It is not shared with
+// other contexts so writes made by other requests are not seen by it, even
+// though they are still seen via memcache. Only use it for contexts with a
+// short life, such as a single request.
+func WithLocalCache(c context.Context) context.Context {
+	return context.WithValue(c, &localCacheKey, &localCache{
+		entities: map[string]datastore.PropertyList{},
+	})
+}
+
+func localCacheFromContext(c context.Context) (*localCache, bool) {
+	lc, ok := c.Value(&localCacheKey).(*localCache)
+	return lc, ok
+}
+
+// load sets the value of each cacheItem found in the local cache and returns
+// the cache generation to pass to save. If ignoreFieldMismatch is true then
+// entities giving datastore.ErrFieldMismatch are loaded along with the error.
+func (lc *localCache) load(cacheItems []cacheItem,
+	ignoreFieldMismatch bool) uint64 {
+	lc.Lock()
+	defer lc.Unlock()
+
+	for i := range cacheItems {
+		pl, ok := lc.entities[cacheItems[i].key.Encode()]
+		if !ok {
+			continue
+		}
+		if pl == nil {
+			cacheItems[i].state = done
+			cacheItems[i].err = datastore.ErrNoSuchEntity
+		} else if err := setValue(cacheItems[i].val, pl); err == nil ||
+			ignoreFieldMismatch && isFieldMismatch(err) {
+			cacheItems[i].state = done
+			cacheItems[i].err = err
+			cacheItems[i].pl = pl
+			cacheItems[i].source = SourceLocalCache
+		}
+	}
+	return lc.generation
+}
+
+// save stores the entities got for cacheItems unless the cache has been
+// invalidated since generation.
+func (lc *localCache) save(cacheItems []cacheItem, generation uint64) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	if lc.generation != generation {
+		return
+	}
+
+	for _, cacheItem := range cacheItems {
+		switch {
+		case cacheItem.err == datastore.ErrNoSuchEntity:
+			lc.entities[cacheItem.key.Encode()] = nil
+		case cacheItem.err == nil && cacheItem.pl != nil:
+			lc.entities[cacheItem.key.Encode()] = cacheItem.pl
+		}
+	}
+}
+
+func (lc *localCache) invalidate(keys []*datastore.Key) {
+	lc.Lock()
+	defer lc.Unlock()
+
+	lc.generation++
+	for _, key := range keys {
+		if key != nil && !key.Incomplete() {
+			delete(lc.entities, key.Encode())
+		}
+	}
+}
+
+// invalidateLocalCache removes keys from the local cache of c, if it has one.
+func invalidateLocalCache(c context.Context, keys []*datastore.Key) {
+	if lc, ok := localCacheFromContext(c); ok {
+		lc.invalidate(keys)
+	}
+}
@@ -0,0 +1,159 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithLocalCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	lc := nds.WithLocalCache(c)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(lc, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime the local cache.
+	if err := nds.GetMulti(lc, keys,
+		make([]testEntity, 2)); err == nil {
+		t.Fatal("expected no such entity error")
+	}
+
+	memcacheGets := 0
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		if len(keys) != 0 {
+			memcacheGets++
+		}
+		return memcache.GetMulti(c, keys)
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	entities := make([]testEntity, 2)
+	err := nds.GetMulti(lc, keys, entities)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if entities[0].IntVal != 1 {
+		t.Fatal("incorrect IntVal", entities[0].IntVal)
+	}
+	if memcacheGets != 0 {
+		t.Fatal("expected entities from local cache")
+	}
+
+	// Puts must invalidate the local cache.
+	if _, err := nds.Put(lc, keys[0], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &testEntity{}
+	if err := nds.Get(lc, keys[0], entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 2 {
+		t.Fatal("expected updated entity", entity.IntVal)
+	}
+
+	// Deletes must invalidate the local cache.
+	if err := nds.Delete(lc, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(lc, keys[0],
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity", err)
+	}
+}
+
+func TestWithLocalCacheConcurrent(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	lc := nds.WithLocalCache(c)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				_, errs[i] = nds.Put(lc, key, &testEntity{i})
+			} else {
+				errs[i] = nds.Get(lc, key, &testEntity{})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWithLocalCacheTransaction(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	lc := nds.WithLocalCache(c)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A get made after the put but before the commit stores the old entity
+	// in the local cache, which the commit must remove.
+	if err := nds.RunInTransaction(lc, func(tc context.Context) error {
+		if _, err := nds.Put(tc, key, &testEntity{2}); err != nil {
+			return err
+		}
+		entity := &testEntity{}
+		if err := nds.Get(lc, key, entity); err != nil {
+			return err
+		}
+		if entity.IntVal != 1 {
+			t.Fatal("incorrect entity before commit", entity)
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(lc, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 2 {
+		t.Fatal("incorrect entity after commit", entity)
+	}
+}
@@ -0,0 +1,100 @@
+package nds
+
+import (
+	"bytes"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Lock locks the memcache item of key in the same way as Put does before
+// writing an entity, along with those of the keys derived from it with the
+// function set with SetDerivedKeys, and returns the token identifying the
+// lock. Use it in
+// write flows that change entities without nds, such as with the datastore
+// package directly. No entity is cached for key until the lock expires after
+// the lock time of c, which can be set with WithMemcacheLockTime.
+//
+// The lock can be lost before it expires, for example if another call of Lock,
+// Put or Invalidate replaces it or memcache evicts it. Use VerifyLock with the
+// token to check that it is still held before committing a write. All the
+// items locked by a call share its token.
+func Lock(c context.Context, key *datastore.Key) ([]byte, error) {
+	if key == nil || key.Incomplete() {
+		return nil, datastore.ErrInvalidKey
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	items := createLockItems(c, []*datastore.Key{key})
+	token := items[0].Value
+	for _, item := range items {
+		item.Value = token
+	}
+	if err := tracedMemcacheSetMulti(memcacheCtx, items); err != nil {
+		return nil, err
+	}
+	invalidateLocalCache(c, []*datastore.Key{key})
+	return token, nil
+}
+
+// VerifyLock reports whether the memcache items locked by Lock for key, which
+// include those of its derived keys, are all still the lock identified by
+// token. The lock is checked by compare and
+// swap, which also renews it for the lock time of c, so a true result means the
+// lock was held at the moment of the check and will not expire before the lock
+// time has passed. It can still be lost in the same ways as described for Lock.
+func VerifyLock(c context.Context, key *datastore.Key, token []byte) (
+	bool, error) {
+
+	if key == nil || key.Incomplete() {
+		return false, datastore.ErrInvalidKey
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return false, err
+	}
+
+	memcacheKeys := []string{}
+	for _, k := range withDerivedKeys([]*datastore.Key{key}) {
+		if k != nil && !k.Incomplete() {
+			memcacheKeys = append(memcacheKeys, createMemcacheKey(c, k))
+		}
+	}
+	items, err := tracedMemcacheGetMulti(memcacheCtx, memcacheKeys)
+	if err != nil {
+		return false, err
+	}
+
+	lockTime := optionsFromContext(c).lockTime
+	casItems := make([]*memcache.Item, len(memcacheKeys))
+	for i, memcacheKey := range memcacheKeys {
+		item, ok := items[memcacheKey]
+		if !ok || item.Flags != lockItem || !bytes.Equal(item.Value, token) {
+			return false, nil
+		}
+		item.Expiration = lockExpiration(lockTime, false)
+		casItems[i] = item
+	}
+
+	err = tracedMemcacheCompareAndSwapMulti(memcacheCtx, casItems)
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, e := range me {
+			if e != nil && e != memcache.ErrCASConflict &&
+				e != memcache.ErrNotStored {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
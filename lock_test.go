@@ -0,0 +1,76 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestVerifyLock(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := nds.Lock(c, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The entity must not be cached while it is locked.
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 2 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	if ok, err := nds.VerifyLock(c, key, token); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("expected lock to be held")
+	}
+
+	// Another lock replaces the first.
+	if _, err := nds.Lock(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := nds.VerifyLock(c, key, token); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected lock to be lost")
+	}
+
+	// A put removes the lock.
+	token, err = nds.Lock(c, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.Put(c, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := nds.VerifyLock(c, key, token); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected lock to be lost")
+	}
+
+	if _, err := nds.VerifyLock(c, nil, token); err != datastore.ErrInvalidKey {
+		t.Fatal("expected datastore.ErrInvalidKey", err)
+	}
+}
@@ -0,0 +1,102 @@
+package nds
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// LogLevel is the severity of a message passed to a Logger.
+type LogLevel int
+
+// Log levels in increasing order of severity.
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "Debug"
+	case LogInfo:
+		return "Info"
+	case LogWarning:
+		return "Warning"
+	case LogError:
+		return "Error"
+	default:
+		return "Unknown"
+	}
+}
+
+// Logger receives the messages nds logs. msg identifies the event, such as
+// "nds:loadMemcache GetMulti", and fields holds its details, such as the
+// "error" that caused it. The fields map must not be retained after the
+// Logger returns.
+//
+// nds logs a LogWarning message whenever it falls back to the datastore
+// because of a memcache error, a LogInfo message when memcache items could
+// not be saved because another call changed them, and a LogDebug message
+// whenever a memcache key is hashed because it is too long.
+type Logger func(c context.Context, level LogLevel, msg string,
+	fields map[string]interface{})
+
+// SetLogger sets the Logger nds logs to. The default logs to App Engine using
+// google.golang.org/appengine/log. A nil Logger disables logging. The Logger
+// may be called concurrently so it must be safe for concurrent use.
+func SetLogger(l Logger) {
+	updateConfig(func(cfg *config) {
+		cfg.logger = l
+	})
+}
+
+// appengineLogger is the default Logger. It writes msg followed by the fields
+// sorted by name.
+func appengineLogger(c context.Context, level LogLevel, msg string,
+	fields map[string]interface{}) {
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBufferString(msg)
+	for _, name := range names {
+		fmt.Fprintf(buf, " %s=%v", name, fields[name])
+	}
+
+	switch level {
+	case LogDebug:
+		log.Debugf(c, "%s", buf)
+	case LogInfo:
+		log.Infof(c, "%s", buf)
+	case LogWarning:
+		log.Warningf(c, "%s", buf)
+	default:
+		log.Errorf(c, "%s", buf)
+	}
+}
+
+// logEvent passes msg and the alternating field names and values in keyvals
+// to the Logger, if there is one.
+func logEvent(c context.Context, level LogLevel, msg string,
+	keyvals ...interface{}) {
+
+	l := loadConfig().logger
+	if l == nil {
+		return
+	}
+
+	fields := make(map[string]interface{}, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	l(c, level, msg, fields)
+}
@@ -0,0 +1,109 @@
+package nds_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// logEntry is a message passed to a nds.Logger.
+type logEntry struct {
+	level  nds.LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+type testLogger struct {
+	sync.Mutex
+	entries []logEntry
+}
+
+func (tl *testLogger) log(c context.Context, level nds.LogLevel, msg string,
+	fields map[string]interface{}) {
+	tl.Lock()
+	tl.entries = append(tl.entries, logEntry{level, msg, fields})
+	tl.Unlock()
+}
+
+func (tl *testLogger) find(msg string) (logEntry, bool) {
+	tl.Lock()
+	defer tl.Unlock()
+	for _, entry := range tl.entries {
+		if entry.msg == msg {
+			return entry, true
+		}
+	}
+	return logEntry{}, false
+}
+
+func TestSetLogger(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	tl := &testLogger{}
+	nds.SetLogger(tl.log)
+	defer nds.SetLogger(nds.AppengineLogger)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", randHexString(nds.MemcacheMaxKeySize),
+			0, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := tl.find(
+		"nds:createMemcacheKey hashed oversized key"); !ok {
+		t.Fatal("expected hashed key message")
+	} else if entry.level != nds.LogDebug {
+		t.Fatal("incorrect level", entry.level)
+	}
+
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		return nil, errors.New("expected error")
+	})
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	if entry, ok := tl.find("nds:loadMemcache GetMulti"); !ok {
+		t.Fatal("expected fallback message")
+	} else if entry.level != nds.LogWarning ||
+		entry.fields["error"] == nil {
+		t.Fatal("incorrect fallback message", entry)
+	}
+
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		me := make(appengine.MultiError, len(items))
+		for i := range me {
+			me[i] = memcache.ErrCASConflict
+		}
+		return me
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := tl.find(
+		"nds:saveMemcache CompareAndSwapMulti collision"); !ok {
+		t.Fatal("expected collision message")
+	} else if entry.level != nds.LogInfo ||
+		entry.fields["collisions"] != 2 {
+		t.Fatal("incorrect collision message", entry)
+	}
+}
@@ -1,9 +1,8 @@
 package nds
 
 import (
-	"bytes"
 	"crypto/sha1"
-	"encoding/gob"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"reflect"
@@ -16,18 +15,26 @@ import (
 )
 
 const (
-	// memcachePrefix is the namespace memcache uses to store entities.
-	memcachePrefix = "NDS1:"
-
-	// memcacheLockTime is the maximum length of time a memcache lock will be
-	// held for. 32 seconds is chosen as 30 seconds is the maximum amount of
-	// time an underlying datastore call will retry even if the API reports a
-	// success to the user.
+	// memcachePrefix is the default namespace memcache uses to store entities.
+	// It can be changed for a context with WithMemcachePrefix. The version
+	// number is incremented whenever the format of cached entities changes so
+	// that old cache items are never decoded.
+	memcachePrefix = "NDS4:"
+
+	// memcacheLockTime is the default maximum length of time a memcache lock
+	// will be held for. 32 seconds is chosen as 30 seconds is the maximum
+	// amount of time an underlying datastore call will retry even if the API
+	// reports a success to the user. It can be changed for a context with
+	// WithMemcacheLockTime.
 	memcacheLockTime = 32 * time.Second
 
 	// memcacheMaxKeySize is the maximum size a memcache item key can be. Keys
 	// greater than this size are automatically hashed to a smaller size.
 	memcacheMaxKeySize = 250
+
+	// memcacheMaxBatchSize is the maximum total size of the item values that
+	// can be written by one memcache call.
+	memcacheMaxBatchSize = 32 << 20
 )
 
 var (
@@ -42,6 +49,8 @@ var (
 	datastoreDeleteMulti = datastore.DeleteMulti
 	datastoreGetMulti    = datastore.GetMulti
 	datastorePutMulti    = datastore.PutMulti
+	datastoreCount       = (*datastore.Query).Count
+	datastoreGetAll      = (*datastore.Query).GetAll
 
 	memcacheAddMulti            = memcache.AddMulti
 	memcacheCompareAndSwapMulti = memcache.CompareAndSwapMulti
@@ -61,15 +70,51 @@ const (
 	noneItem uint32 = iota
 	entityItem
 	lockItem
+
+	// chunkedEntityItem is an entity too large for a single memcache item.
+	// Its value is a manifest of the chunkItem items holding the entity.
+	chunkedEntityItem
+	chunkItem
+
+	// countItem is a query count cached by Count.
+	countItem
+
+	// queryItem is a query result cached by GetAll.
+	queryItem
+
+	// tooLargeItem records that the entity is too large to cache, so that
+	// reads go to the datastore without waiting for or taking a lock.
+	tooLargeItem
 )
 
-func init() {
-	gob.Register(time.Time{})
-	gob.Register(datastore.ByteString{})
-	gob.Register(&datastore.Key{})
-	gob.Register(appengine.BlobKey(""))
-	gob.Register(appengine.GeoPoint{})
-}
+// The flags of the memcache items nds stores. They allow tools that inspect
+// memcache to tell what an item holds. Values can change between versions of
+// nds along with the memcache prefix.
+const (
+	// ItemFlagNone records that the entity does not exist.
+	ItemFlagNone = noneItem
+
+	// ItemFlagEntity is an entity that can be decoded with DecodeCacheItem.
+	ItemFlagEntity = entityItem
+
+	// ItemFlagLock is a lock held while an entity is read or changed.
+	ItemFlagLock = lockItem
+
+	// ItemFlagChunkedEntity is a manifest of the ItemFlagChunk items holding
+	// an entity too large for one memcache item.
+	ItemFlagChunkedEntity = chunkedEntityItem
+	ItemFlagChunk         = chunkItem
+
+	// ItemFlagCount is a query count cached by Count.
+	ItemFlagCount = countItem
+
+	// ItemFlagQuery is a query result cached by GetAll.
+	ItemFlagQuery = queryItem
+
+	// ItemFlagTooLarge records that the entity is larger than the size set
+	// with SetMaxCachedEntitySize.
+	ItemFlagTooLarge = tooLargeItem
+)
 
 type valueType int
 
@@ -103,7 +148,7 @@ func checkValueType(valType reflect.Type) valueType {
 
 func checkKeysValues(keys []*datastore.Key, values reflect.Value) error {
 	if values.Kind() != reflect.Slice {
-		return errors.New("nds: valus is not a slice")
+		return errors.New("nds: vals is not a slice")
 	}
 
 	if len(keys) != values.Len() {
@@ -131,29 +176,151 @@ func checkKeysValues(keys []*datastore.Key, values reflect.Value) error {
 	return nil
 }
 
-func createMemcacheKey(key *datastore.Key) string {
-	memcacheKey := memcachePrefix + key.Encode()
-	if len(memcacheKey) > memcacheMaxKeySize {
-		hash := sha1.Sum([]byte(memcacheKey))
-		memcacheKey = hex.EncodeToString(hash[:])
+// checkNilInterfaces returns an appengine.MultiError reporting
+// datastore.ErrInvalidEntityType for each nil element of values if it is a
+// slice of interfaces. Nothing can be allocated for such elements as their
+// type is unknown.
+func checkNilInterfaces(values reflect.Value) error {
+	if values.Type().Elem().Kind() != reflect.Interface {
+		return nil
 	}
-	return memcacheKey
+
+	isNilErr, nilErr := false, make(appengine.MultiError, values.Len())
+	for i := range nilErr {
+		if values.Index(i).IsNil() {
+			isNilErr = true
+			nilErr[i] = datastore.ErrInvalidEntityType
+		}
+	}
+	if isNilErr {
+		return nilErr
+	}
+	return nil
 }
 
-func memcacheContext(c context.Context) (context.Context, error) {
-	return appengine.Namespace(c, memcacheNamespace)
+// KeyHasher creates a short memcache key for a datastore key whose encoded
+// form is too large to be used as a memcache key. The result is prefixed with
+// the memcache prefix of the context and a "#" marker. It must always return
+// the same value for the same key and should make collisions between keys
+// unlikely. Keys that differ only in their namespace, app ID or parent are
+// different keys, so hashing key.Encode() is a good choice.
+type KeyHasher func(key *datastore.Key) string
+
+// SetKeyHasher sets the function used to shorten memcache keys that would
+// otherwise be over the memcache key size limit. Such keys are replaced with
+// the memcache prefix, a "#" marker and the result of h. By default the result
+// is the hex encoded SHA-1 hash of key.Encode(). SHA256KeyHasher uses SHA-256
+// instead. The marker never appears in an encoded key, so a hashed memcache key
+// cannot equal an unhashed one. A nil h restores the default. Hashed keys that
+// are still too long are cut short and end with the SHA-1 hash of the whole
+// key, keeping the memcache prefix.
+//
+// All instances of an application must use the same KeyHasher so that they
+// all find the same memcache items.
+//
+// SetKeyHasher should be called during initialization, before any other nds
+// function.
+func SetKeyHasher(h KeyHasher) {
+	updateConfig(func(cfg *config) {
+		cfg.keyHasher = h
+	})
 }
 
-func marshalPropertyList(pl datastore.PropertyList) ([]byte, error) {
-	buf := bytes.Buffer{}
-	if err := gob.NewEncoder(&buf).Encode(&pl); err != nil {
-		return nil, err
+// SHA256KeyHasher is a KeyHasher that returns the hex encoded SHA-256 hash of
+// key.Encode(), for deployments that must not hash keys with SHA-1. Use it with
+// SetKeyHasher(SHA256KeyHasher). Its results are never long enough to be cut
+// short.
+//
+// Changing the KeyHasher changes the memcache keys of all hashed keys, so the
+// entities already cached for them are no longer found and must be read from
+// the datastore again. Keys short enough not to be hashed keep their cached
+// entities. As instances with different KeyHashers do not invalidate each
+// other's items, switch all instances of an application at once.
+func SHA256KeyHasher(key *datastore.Key) string {
+	hash := sha256.Sum256([]byte(key.Encode()))
+	return hex.EncodeToString(hash[:])
+}
+
+// MemcacheKey returns the memcache key nds stores the entity of key under for
+// contexts like c. It takes into account the memcache prefix of c and the
+// KeyHasher set with SetKeyHasher. Items are stored in the default memcache
+// namespace whatever the namespace of c. This allows other systems to
+// inspect or coordinate with the items nds stores.
+func MemcacheKey(c context.Context, key *datastore.Key) string {
+	return createMemcacheKey(c, key)
+}
+
+// MemcacheKeys returns the memcache keys of keys, in the same way as
+// MemcacheKey, so that tools such as cache warmers can compute the memcache
+// keys of many entities in one pass. The result is aligned with keys, and nil
+// and incomplete keys, which have no memcache items, get an empty string.
+func MemcacheKeys(c context.Context, keys []*datastore.Key) []string {
+	memcacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		if key != nil && !key.Incomplete() {
+			memcacheKeys[i] = createMemcacheKey(c, key)
+		}
+	}
+	return memcacheKeys
+}
+
+// WillHashKey reports whether MemcacheKey hashes key for contexts like c,
+// because the memcache prefix of c and the encoded key are together longer
+// than the 250 bytes memcache allows. The hashed memcache keys of such keys
+// cost a hash each time they are used and no longer show the datastore key, so
+// key design tooling can use WillHashKey to warn about them.
+func WillHashKey(c context.Context, key *datastore.Key) bool {
+	prefix := optionsFromContext(c).memcachePrefix
+	return len(prefix)+len(key.Encode()) > memcacheMaxKeySize
+}
+
+// createMemcacheKey creates the memcache key of key. key.Encode() includes the
+// namespace and app ID of key, so keys in different namespaces never share
+// memcache items even though every item is stored in memcacheNamespace.
+func createMemcacheKey(c context.Context, key *datastore.Key) string {
+	prefix := optionsFromContext(c).memcachePrefix
+	memcacheKey := prefix + key.Encode()
+	if len(memcacheKey) <= memcacheMaxKeySize {
+		return memcacheKey
+	}
+
+	logEvent(c, LogDebug, "nds:createMemcacheKey hashed oversized key",
+		"size", len(memcacheKey))
+	var hashed string
+	// The keyHasher is nil when the default SHA-1 hashing is used.
+	if h := loadConfig().keyHasher; h != nil {
+		hashed = h(key)
+	} else {
+		hash := sha1.Sum([]byte(key.Encode()))
+		hashed = hex.EncodeToString(hash[:])
+	}
+	return limitMemcacheKey(prefix + hashedKeyMarker + hashed)
+}
+
+// hashedKeyMarker marks the hashed part of a memcache key. It is not a URL
+// safe base64 character so it never appears in key.Encode().
+const hashedKeyMarker = "#"
+
+// limitedKeySize is the size of the start of an oversized memcache key kept
+// by limitMemcacheKey. It is longer than any memcache prefix.
+const limitedKeySize = memcacheMaxKeySize - len(hashedKeyMarker) -
+	2*sha1.Size
+
+// limitMemcacheKey shortens memcacheKey if it is too large to be used as a
+// memcache item key. Its end is replaced with a marker and the SHA-1 hash of
+// the whole key, so the memcache prefix it starts with is kept and keys of
+// different prefixes never share items.
+func limitMemcacheKey(memcacheKey string) string {
+	if len(memcacheKey) > memcacheMaxKeySize {
+		hash := sha1.Sum([]byte(memcacheKey))
+		memcacheKey = memcacheKey[:limitedKeySize] + hashedKeyMarker +
+			hex.EncodeToString(hash[:])
 	}
-	return buf.Bytes(), nil
+	return memcacheKey
 }
 
-func unmarshalPropertyList(data []byte, pl *datastore.PropertyList) error {
-	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(pl)
+func memcacheContext(c context.Context) (context.Context, error) {
+	return appengine.Namespace(c, memcacheNamespace)
 }
 
 func setValue(val reflect.Value, pl datastore.PropertyList) error {
@@ -164,8 +331,15 @@ func setValue(val reflect.Value, pl datastore.PropertyList) error {
 		val = val.Addr()
 	}
 
+	// Allocate nil struct pointers, including those held by interfaces, so
+	// callers can pass slices of nil pointers.
 	if valType == valueTypeStructPtr && val.IsNil() {
 		val.Set(reflect.New(val.Type().Elem()))
+	} else if valType == valueTypeInterface {
+		if e := val.Elem(); e.Kind() == reflect.Ptr && e.IsNil() &&
+			e.Type().Elem().Kind() == reflect.Struct {
+			val.Set(reflect.New(e.Type().Elem()))
+		}
 	}
 
 	if pls, ok := val.Interface().(datastore.PropertyLoadSaver); ok {
@@ -202,3 +376,22 @@ func groupErrors(errs []error, total, limit int) error {
 	}
 	return groupedErrs
 }
+
+// batchItems splits items into batches that each respect the memcache limit
+// on the total size of item values written by a single call.
+func batchItems(items []*memcache.Item) [][]*memcache.Item {
+	batches := [][]*memcache.Item{}
+	lo, size := 0, 0
+	for hi, item := range items {
+		itemSize := len(item.Key) + len(item.Value)
+		if hi > lo && size+itemSize > memcacheMaxBatchSize {
+			batches = append(batches, items[lo:hi])
+			lo, size = hi, 0
+		}
+		size += itemSize
+	}
+	if lo < len(items) {
+		batches = append(batches, items[lo:])
+	}
+	return batches
+}
@@ -1,10 +1,17 @@
 package nds_test
 
 import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"math/rand"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -121,6 +128,40 @@ func TestPutGetDelete(t *testing.T) {
 	}
 }
 
+func TestPutGetDeletePropertyLoadSaver(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	pl := datastore.PropertyList{
+		datastore.Property{Name: "IntVal", Value: int64(12)},
+	}
+	if _, err := nds.Put(c, key, &pl); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from datastore then from cache.
+	for i := 0; i < 2; i++ {
+		getPl := datastore.PropertyList{}
+		if err := nds.Get(c, key, &getPl); err != nil {
+			t.Fatal(err)
+		}
+		if len(getPl) != 1 || getPl[0].Value != int64(12) {
+			t.Fatal("incorrect PropertyList", getPl)
+		}
+	}
+
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors must not be wrapped in an appengine.MultiError.
+	err := nds.Get(c, key, &datastore.PropertyList{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
+
 func TestInterfaces(t *testing.T) {
 	c, closeFunc := NewContext(t)
 	defer closeFunc()
@@ -613,6 +654,113 @@ func TestMartialPropertyListError(t *testing.T) {
 	}
 }
 
+func TestMarshalUnmarshalCompressed(t *testing.T) {
+
+	largeVal := strings.Repeat("compressible ", 4096)
+	pl := datastore.PropertyList{
+		datastore.Property{Name: "Large", Value: largeVal, NoIndex: true},
+	}
+
+	compressed, err := nds.MarshalPropertyList(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(largeVal) {
+		t.Fatal("expected compressed data", len(compressed))
+	}
+
+	nds.SetCompressionThreshold(-1)
+	defer nds.SetCompressionThreshold(16 << 10)
+
+	uncompressed, err := nds.MarshalPropertyList(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uncompressed) <= len(largeVal) {
+		t.Fatal("expected uncompressed data", len(uncompressed))
+	}
+
+	for _, data := range [][]byte{compressed, uncompressed} {
+		getPl := datastore.PropertyList{}
+		if err := nds.UnmarshalPropertyList(data, &getPl); err != nil {
+			t.Fatal(err)
+		}
+		if len(getPl) != 1 || getPl[0].Value != largeVal {
+			t.Fatal("incorrect PropertyList")
+		}
+	}
+
+	if err := nds.UnmarshalPropertyList([]byte{},
+		&datastore.PropertyList{}); err == nil {
+		t.Fatal("expected empty data error")
+	}
+
+	if err := nds.UnmarshalPropertyList([]byte{0xff},
+		&datastore.PropertyList{}); err == nil {
+		t.Fatal("expected unknown tag error")
+	}
+}
+
+func TestMarshalIncompressibleBytes(t *testing.T) {
+
+	blob := make([]byte, 64<<10)
+	if _, err := crand.Read(blob); err != nil {
+		t.Fatal(err)
+	}
+	if !nds.LooksIncompressible(blob) {
+		t.Fatal("expected random bytes to look incompressible")
+	}
+	text := []byte(strings.Repeat("compressible ", 4096))
+	if nds.LooksIncompressible(text) {
+		t.Fatal("expected text to look compressible")
+	}
+
+	pl := datastore.PropertyList{
+		datastore.Property{Name: "Blob", Value: blob, NoIndex: true},
+	}
+	data, err := nds.MarshalPropertyList(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[1] != 0 {
+		t.Fatal("expected uncompressed data, got tag", data[1])
+	}
+
+	getPl := datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(data, &getPl); err != nil {
+		t.Fatal(err)
+	}
+	if len(getPl) != 1 || !bytes.Equal(getPl[0].Value.([]byte), blob) {
+		t.Fatal("incorrect PropertyList")
+	}
+}
+
+// BenchmarkMarshalBytes measures the cost of marshalling entities holding
+// large []byte properties, with and without compression.
+func BenchmarkMarshalBytes(b *testing.B) {
+	random := make([]byte, 256<<10)
+	if _, err := crand.Read(random); err != nil {
+		b.Fatal(err)
+	}
+	blobs := map[string][]byte{
+		"Random":       random,
+		"Compressible": bytes.Repeat([]byte("compressible "), 20<<10),
+	}
+	for name, blob := range blobs {
+		pl := datastore.PropertyList{
+			datastore.Property{Name: "Blob", Value: blob, NoIndex: true},
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(blob)))
+			for i := 0; i < b.N; i++ {
+				if _, err := nds.MarshalPropertyList(pl); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func randHexString(length int) string {
 	bytes := make([]byte, length)
 	for i := range bytes {
@@ -621,6 +769,56 @@ func randHexString(length int) string {
 	return hex.EncodeToString(bytes)
 }
 
+func TestMemcacheKeys(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		nil,
+		datastore.NewKey(c, "Entity", randHexString(
+			nds.MemcacheMaxKeySize+10), 0, nil),
+		datastore.NewIncompleteKey(c, "Entity", nil),
+	}
+	tc, err := nds.WithMemcachePrefix(c, "prefix:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKeys := nds.MemcacheKeys(tc, keys)
+	expected := []string{
+		nds.MemcacheKey(tc, keys[0]),
+		"",
+		nds.MemcacheKey(tc, keys[2]),
+		"",
+	}
+	if !reflect.DeepEqual(memcacheKeys, expected) {
+		t.Fatalf("expected %v, got %v", expected, memcacheKeys)
+	}
+	if !strings.HasPrefix(memcacheKeys[0], "prefix:") ||
+		!strings.HasPrefix(memcacheKeys[2], "prefix:#") {
+		t.Fatal("incorrect memcache keys", memcacheKeys)
+	}
+
+	// GetMulti caches entities under the same keys.
+	type testEntity struct {
+		IntVal int
+	}
+	if _, err := nds.Put(tc, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(tc, keys[0], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := memcache.Get(c, memcacheKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.EntityItem {
+		t.Fatal("expected entity item, got flags", item.Flags)
+	}
+}
+
 func TestCreateMemcacheKey(t *testing.T) {
 	c, closeFunc := NewContext(t)
 	defer closeFunc()
@@ -630,10 +828,147 @@ func TestCreateMemcacheKey(t *testing.T) {
 	key := datastore.NewKey(c, "TestEntity",
 		randHexString(maxKeySize+10), 0, nil)
 
-	memcacheKey := nds.CreateMemcacheKey(key)
+	if !nds.WillHashKey(c, key) {
+		t.Fatal("expected key to be hashed")
+	}
+	memcacheKey := nds.MemcacheKey(c, key)
 	if len(memcacheKey) > maxKeySize {
 		t.Fatal("incorrect memcache key size")
 	}
+
+	// Hashed keys are marked so they never equal unhashed keys.
+	hash := sha1.Sum([]byte(key.Encode()))
+	if expected := "NDS4:#" + hex.EncodeToString(hash[:]); memcacheKey !=
+		expected {
+		t.Fatal("incorrect memcache key", memcacheKey)
+	}
+}
+
+func TestMemcacheKey(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if nds.WillHashKey(c, key) {
+		t.Fatal("expected key not to be hashed")
+	}
+	memcacheKey := nds.MemcacheKey(c, key)
+	if memcacheKey != "NDS4:"+key.Encode() {
+		t.Fatal("incorrect memcache key", memcacheKey)
+	}
+	if item, err := memcache.Get(c, memcacheKey); err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.ItemFlagEntity {
+		t.Fatal("expected entity item", item.Flags)
+	}
+}
+
+func TestSetKeyHasher(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	pc, err := nds.WithMemcachePrefix(c, "prefix:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetKeyHasher(func(key *datastore.Key) string {
+		hash := sha256.Sum256([]byte(key.Encode()))
+		return base64.RawURLEncoding.EncodeToString(hash[:])
+	})
+	defer nds.SetKeyHasher(nil)
+
+	// Short keys are not hashed.
+	key := datastore.NewKey(c, "TestEntity", "", 1, nil)
+	if memcacheKey := nds.MemcacheKey(pc, key); memcacheKey !=
+		"prefix:"+key.Encode() {
+		t.Fatal("incorrect memcache key", memcacheKey)
+	}
+
+	maxKeySize := nds.MemcacheMaxKeySize
+	key = datastore.NewKey(c, "TestEntity",
+		randHexString(maxKeySize+10), 0, nil)
+
+	hash := sha256.Sum256([]byte(key.Encode()))
+	expected := "prefix:#" + base64.RawURLEncoding.EncodeToString(hash[:])
+	if memcacheKey := nds.MemcacheKey(pc, key); memcacheKey != expected {
+		t.Fatal("incorrect memcache key", memcacheKey)
+	}
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	if _, err := nds.Put(pc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(pc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := memcache.Get(c, expected); err != nil {
+		t.Fatal("expected hashed key in memcache", err)
+	}
+}
+
+func TestSetKeyHasherLongHash(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	nds.SetKeyHasher(func(key *datastore.Key) string {
+		return strings.Repeat("a", nds.MemcacheMaxKeySize)
+	})
+	defer nds.SetKeyHasher(nil)
+
+	key := datastore.NewKey(c, "TestEntity",
+		randHexString(nds.MemcacheMaxKeySize+10), 0, nil)
+
+	// Hashes that are too long keep the prefix of the memcache key.
+	memcacheKeys := map[string]bool{}
+	for _, prefix := range []string{"one:", "two:"} {
+		pc, err := nds.WithMemcachePrefix(c, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memcacheKey := nds.MemcacheKey(pc, key)
+		if len(memcacheKey) > nds.MemcacheMaxKeySize {
+			t.Fatal("incorrect memcache key size", len(memcacheKey))
+		}
+		if !strings.HasPrefix(memcacheKey, prefix) {
+			t.Fatal("expected memcache prefix", memcacheKey)
+		}
+		memcacheKeys[memcacheKey] = true
+	}
+	if len(memcacheKeys) != 2 {
+		t.Fatal("expected different memcache keys")
+	}
+}
+
+func TestSHA256KeyHasher(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	nds.SetKeyHasher(nds.SHA256KeyHasher)
+	defer nds.SetKeyHasher(nil)
+
+	key := datastore.NewKey(c, "TestEntity",
+		randHexString(nds.MemcacheMaxKeySize+10), 0, nil)
+	hash := sha256.Sum256([]byte(key.Encode()))
+	expected := "NDS4:#" + hex.EncodeToString(hash[:])
+	if memcacheKey := nds.MemcacheKey(c, key); memcacheKey != expected {
+		t.Fatal("incorrect memcache key", memcacheKey)
+	}
 }
 
 func TestMemcacheNamespace(t *testing.T) {
@@ -669,3 +1004,114 @@ func TestMemcacheNamespace(t *testing.T) {
 
 	nds.SetMemcacheNamespace("")
 }
+
+func TestBatchItems(t *testing.T) {
+	value := make([]byte, 1000000)
+	items := make([]*memcache.Item, 70)
+	for i := range items {
+		items[i] = &memcache.Item{Key: strconv.Itoa(i), Value: value}
+	}
+
+	batches := nds.BatchItems(items)
+	if len(batches) != 3 {
+		t.Fatal("expected 3 batches", len(batches))
+	}
+
+	count := 0
+	for _, batch := range batches {
+		size := 0
+		for _, item := range batch {
+			if item != items[count] {
+				t.Fatal("items out of order")
+			}
+			size += len(item.Key) + len(item.Value)
+			count++
+		}
+		if size > nds.MemcacheMaxBatchSize {
+			t.Fatal("batch too large", size)
+		}
+	}
+	if count != len(items) {
+		t.Fatal("missing items", count)
+	}
+
+	if len(nds.BatchItems(nil)) != 0 {
+		t.Fatal("expected no batches")
+	}
+}
+
+func TestMemcacheKeyNamespace(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	namespaces := []string{"", "a", "b"}
+	keys := make([]*datastore.Key, len(namespaces))
+	for i, namespace := range namespaces {
+		nc, err := appengine.Namespace(c, namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = datastore.NewKey(nc, "Entity", "", 1, nil)
+	}
+
+	// Keys differing only by namespace have different memcache keys.
+	memcacheKeys := map[string]bool{}
+	for _, key := range keys {
+		memcacheKeys[nds.MemcacheKey(c, key)] = true
+	}
+	if len(memcacheKeys) != len(keys) {
+		t.Fatal("memcache keys collide", memcacheKeys)
+	}
+
+	// Cache each entity and a missing entity in another namespace.
+	if _, err := nds.PutMulti(c, keys[:2],
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		entities := make([]testEntity, len(keys))
+		err := nds.GetMulti(c, keys, entities)
+		if me, ok := err.(appengine.MultiError); !ok {
+			t.Fatal("expected appengine.MultiError", err)
+		} else if me[0] != nil || me[1] != nil ||
+			me[2] != datastore.ErrNoSuchEntity {
+			t.Fatal("incorrect errors", me)
+		}
+		if entities[0].IntVal != 1 || entities[1].IntVal != 2 {
+			t.Fatal("incorrect entities", entities)
+		}
+	}
+}
+
+func TestItemLockUnique(t *testing.T) {
+	const goroutines, locks = 10, 1000
+
+	var mu sync.Mutex
+	seen := make(map[string]bool, goroutines*locks)
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < locks; j++ {
+				lock := nds.ItemLock()
+				mu.Lock()
+				seen[string(lock)] = true
+				mu.Unlock()
+				if len(lock) != 16 {
+					t.Error("incorrect lock length", len(lock))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != goroutines*locks {
+		t.Fatal("duplicate locks", goroutines*locks-len(seen))
+	}
+}
@@ -0,0 +1,195 @@
+// Package ndstest provides helpers for testing code that uses nds without the
+// App Engine memcache service.
+package ndstest
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// Cache is an in-memory nds.Cache with the compare and swap and expiration
+// semantics of App Engine memcache. Expiration is measured by a fake clock
+// that only moves when Advance is called, so tests can expire locks and
+// entities deterministically. Use it with nds.SetCache. It is safe for
+// concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	offset  time.Duration
+	items   map[string]entry
+	version uint64
+}
+
+// entry is a stored item. expires is zero for items that never expire.
+type entry struct {
+	value   []byte
+	flags   uint32
+	expires time.Time
+	version uint64
+}
+
+// casVersion is kept in the Object field of got items to identify the version
+// compare and swap expects.
+type casVersion uint64
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache {
+	start := time.Unix(0, 0)
+	return NewCacheWithClock(func() time.Time { return start })
+}
+
+// NewCacheWithClock returns an empty Cache whose clock reads the time from
+// now, such as time.Now or a fake clock also used by the code under test, so
+// that items expire as that clock moves. Advance still moves the clock of the
+// cache further forward.
+func NewCacheWithClock(now func() time.Time) *Cache {
+	return &Cache{
+		now:   now,
+		items: map[string]entry{},
+	}
+}
+
+// Advance moves the clock of the cache forward by d, expiring the items whose
+// expiration has passed.
+func (m *Cache) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offset += d
+}
+
+// clock returns the time of now moved forward by Advance. m.mu must be held.
+func (m *Cache) clock() time.Time {
+	return m.now().Add(m.offset)
+}
+
+// Flush removes every item from the cache.
+func (m *Cache) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items = map[string]entry{}
+}
+
+// get returns the unexpired entry of key. m.mu must be held.
+func (m *Cache) get(key string) (entry, bool) {
+	e, ok := m.items[key]
+	if ok && !e.expires.IsZero() && !m.clock().Before(e.expires) {
+		delete(m.items, key)
+		return entry{}, false
+	}
+	return e, ok
+}
+
+// store stores item as a new version. m.mu must be held.
+func (m *Cache) store(item *memcache.Item) {
+	m.version++
+	e := entry{
+		value:   append([]byte(nil), item.Value...),
+		flags:   item.Flags,
+		version: m.version,
+	}
+	if item.Expiration > 0 {
+		e.expires = m.clock().Add(item.Expiration)
+	}
+	m.items[item.Key] = e
+}
+
+// multiError returns errs, or nil if all of them are nil.
+func multiError(errs appengine.MultiError) error {
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+// AddMulti stores each item only if its key is not in the cache.
+func (m *Cache) AddMulti(c context.Context, items []*memcache.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs := make(appengine.MultiError, len(items))
+	for i, item := range items {
+		if _, ok := m.get(item.Key); ok {
+			errs[i] = memcache.ErrNotStored
+			continue
+		}
+		m.store(item)
+	}
+	return multiError(errs)
+}
+
+// CompareAndSwapMulti stores each item only if its key has not changed since
+// the item was got by GetMulti.
+func (m *Cache) CompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs := make(appengine.MultiError, len(items))
+	for i, item := range items {
+		e, ok := m.get(item.Key)
+		switch {
+		case !ok:
+			errs[i] = memcache.ErrNotStored
+		case item.Object != casVersion(e.version):
+			errs[i] = memcache.ErrCASConflict
+		default:
+			m.store(item)
+		}
+	}
+	return multiError(errs)
+}
+
+// DeleteMulti deletes each key.
+func (m *Cache) DeleteMulti(c context.Context, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs := make(appengine.MultiError, len(keys))
+	for i, key := range keys {
+		if _, ok := m.get(key); !ok {
+			errs[i] = memcache.ErrCacheMiss
+			continue
+		}
+		delete(m.items, key)
+	}
+	return multiError(errs)
+}
+
+// GetMulti returns the items of the keys that are in the cache.
+func (m *Cache) GetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := make(map[string]*memcache.Item, len(keys))
+	for _, key := range keys {
+		if e, ok := m.get(key); ok {
+			items[key] = &memcache.Item{
+				Key:    key,
+				Value:  append([]byte(nil), e.value...),
+				Flags:  e.flags,
+				Object: casVersion(e.version),
+			}
+		}
+	}
+	return items, nil
+}
+
+// SetMulti stores each item unconditionally.
+func (m *Cache) SetMulti(c context.Context, items []*memcache.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, item := range items {
+		m.store(item)
+	}
+	return nil
+}
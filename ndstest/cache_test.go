@@ -0,0 +1,144 @@
+package ndstest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+var _ nds.Cache = (*ndstest.Cache)(nil)
+
+func TestCacheCompareAndSwap(t *testing.T) {
+	c := context.Background()
+	m := ndstest.NewCache()
+
+	if err := m.AddMulti(c, []*memcache.Item{
+		{Key: "a", Value: []byte("1")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err := m.AddMulti(c, []*memcache.Item{{Key: "a", Value: []byte("2")}})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrNotStored {
+		t.Fatal("expected memcache.ErrNotStored", err)
+	}
+
+	items, err := m.GetMulti(c, []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || string(items["a"].Value) != "1" {
+		t.Fatal("incorrect items", items)
+	}
+	got := items["a"]
+
+	// A changed item makes compare and swap fail.
+	if err := m.SetMulti(c, []*memcache.Item{
+		{Key: "a", Value: []byte("3")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got.Value = []byte("4")
+	err = m.CompareAndSwapMulti(c, []*memcache.Item{got})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrCASConflict {
+		t.Fatal("expected memcache.ErrCASConflict", err)
+	}
+
+	items, err = m.GetMulti(c, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items["a"].Value = []byte("5")
+	if err := m.CompareAndSwapMulti(c,
+		[]*memcache.Item{items["a"]}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A deleted item makes compare and swap fail.
+	if err := m.DeleteMulti(c, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	err = m.CompareAndSwapMulti(c, []*memcache.Item{items["a"]})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrNotStored {
+		t.Fatal("expected memcache.ErrNotStored", err)
+	}
+	err = m.DeleteMulti(c, []string{"a"})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrCacheMiss {
+		t.Fatal("expected memcache.ErrCacheMiss", err)
+	}
+}
+
+func TestCacheAdvance(t *testing.T) {
+	c := context.Background()
+	m := ndstest.NewCache()
+
+	if err := m.SetMulti(c, []*memcache.Item{
+		{Key: "a", Value: []byte("1"), Expiration: time.Minute},
+		{Key: "b", Value: []byte("2")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Advance(time.Minute - time.Second)
+	if items, err := m.GetMulti(c, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 2 {
+		t.Fatal("incorrect items", items)
+	}
+
+	m.Advance(time.Second)
+	if items, err := m.GetMulti(c, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 1 || items["b"] == nil {
+		t.Fatal("incorrect items", items)
+	}
+
+	// Expired items can be added again.
+	if err := m.AddMulti(c, []*memcache.Item{
+		{Key: "a", Value: []byte("3")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Flush()
+	if items, err := m.GetMulti(c, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 0 {
+		t.Fatal("incorrect items", items)
+	}
+}
+
+func TestCacheWithClock(t *testing.T) {
+	c := context.Background()
+	now := time.Unix(1000, 0)
+	m := ndstest.NewCacheWithClock(func() time.Time { return now })
+
+	if err := m.SetMulti(c, []*memcache.Item{
+		{Key: "a", Value: []byte("1"), Expiration: time.Minute},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Minute - time.Second)
+	if items, err := m.GetMulti(c, []string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 1 {
+		t.Fatal("incorrect items", items)
+	}
+
+	// Advance moves the clock on from now.
+	m.Advance(time.Second)
+	if items, err := m.GetMulti(c, []string{"a"}); err != nil {
+		t.Fatal(err)
+	} else if len(items) != 0 {
+		t.Fatal("incorrect items", items)
+	}
+}
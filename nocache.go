@@ -0,0 +1,180 @@
+package nds
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// noCacheTypes holds the []string returned by noCacheNames for each struct
+// type already seen.
+var noCacheTypes sync.Map
+
+var (
+	typeOfTime     = reflect.TypeOf(time.Time{})
+	typeOfGeoPoint = reflect.TypeOf(appengine.GeoPoint{})
+)
+
+// noCacheKinds holds the []string of nocache property names registered for
+// each kind with RegisterNoCacheKind.
+var noCacheKinds sync.Map
+
+// RegisterNoCacheKind registers the struct type of src, a struct or struct
+// pointer, as the type of the entities of kind so that its fields tagged with
+// nds:"nocache" are also kept out of memcache by the calls that cache entities
+// of kind without loading them into that type. These are PrimeCache,
+// GetMultiRaw, GetOrCompute and GetMulti into a []datastore.PropertyList. The
+// registered properties are removed as well as those of the destination type
+// wherever entities of kind are cached.
+//
+// RegisterNoCacheKind should be called during initialization, before any other
+// nds function.
+func RegisterNoCacheKind(kind string, src interface{}) {
+	noCacheKinds.Store(kind, noCacheProperties(reflect.ValueOf(src)))
+}
+
+// keyNoCacheProperties returns the nocache property names of the entity of
+// key, which are names together with those registered for the kind of key.
+func keyNoCacheProperties(key *datastore.Key, names []string) []string {
+	if key == nil {
+		return names
+	}
+	registered, ok := noCacheKinds.Load(key.Kind())
+	if !ok || len(registered.([]string)) == 0 {
+		return names
+	}
+	return mergeNoCacheProperties(names, registered.([]string))
+}
+
+// mergeNoCacheProperties returns the names in a or b. Neither is modified.
+func mergeNoCacheProperties(a, b []string) []string {
+	if len(a) == 0 {
+		return b
+	} else if len(b) == 0 {
+		return a
+	}
+	merged := append([]string{}, a...)
+	for _, name := range b {
+		found := false
+		for _, n := range a {
+			found = found || n == name
+		}
+		if !found {
+			merged = append(merged, name)
+		}
+	}
+	return merged
+}
+
+// noCacheProperties returns the names of the properties of val whose struct
+// fields are tagged with nds:"nocache", as described in the package
+// documentation. It returns nil if val is not a struct, or a pointer to one, or
+// implements datastore.PropertyLoadSaver.
+func noCacheProperties(val reflect.Value) []string {
+	if val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+	if !val.IsValid() {
+		return nil
+	}
+	t := val.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct ||
+		reflect.PtrTo(t).Implements(typeOfPropertyLoadSaver) {
+		return nil
+	}
+
+	if names, ok := noCacheTypes.Load(t); ok {
+		return names.([]string)
+	}
+	names := noCacheNames(t, "", false, map[reflect.Type]bool{})
+	noCacheTypes.Store(t, names)
+	return names
+}
+
+// noCacheNames returns the names of the nocache properties of struct type t,
+// each preceded by prefix. If all is true every property of t is nocache.
+// seen holds the struct types being walked so recursive types end.
+func noCacheNames(t reflect.Type, prefix string, all bool,
+	seen map[reflect.Type]bool) []string {
+
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		// Property names follow the rules of the datastore package.
+		name := strings.Split(f.Tag.Get("datastore"), ",")[0]
+		if name == "-" {
+			continue
+		} else if name == "" && !f.Anonymous {
+			name = f.Name
+		}
+
+		noCache := all
+		for _, opt := range strings.Split(f.Tag.Get("nds"), ",") {
+			noCache = noCache || opt == "nocache"
+		}
+		if noCache && name != "" {
+			names = append(names, prefix+name)
+			continue
+		}
+
+		subType := f.Type
+		if subType.Kind() == reflect.Slice {
+			subType = subType.Elem()
+		}
+		if subType.Kind() != reflect.Struct || subType == typeOfTime ||
+			subType == typeOfGeoPoint {
+			continue
+		}
+		subPrefix := prefix
+		if name != "" {
+			subPrefix += name + "."
+		}
+		names = append(names, noCacheNames(subType, subPrefix, noCache,
+			seen)...)
+	}
+	return names
+}
+
+// removeNoCacheProperties returns pl without the properties named by names or
+// nested in them. pl is not modified.
+func removeNoCacheProperties(pl datastore.PropertyList,
+	names []string) datastore.PropertyList {
+
+	if len(names) == 0 {
+		return pl
+	}
+
+	kept := make(datastore.PropertyList, 0, len(pl))
+	for _, p := range pl {
+		if !isNoCacheProperty(p.Name, names) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+func isNoCacheProperty(name string, names []string) bool {
+	for _, n := range names {
+		if name == n || strings.HasPrefix(name, n+".") {
+			return true
+		}
+	}
+	return false
+}
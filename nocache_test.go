@@ -0,0 +1,199 @@
+package nds_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestNoCacheTag(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type inner struct {
+		A string
+		B string `nds:"nocache"`
+	}
+	type testEntity struct {
+		Name    string
+		Token   string `nds:"nocache"`
+		Secret  string `datastore:"secret,noindex" nds:"nocache"`
+		Inner   inner
+		Skipped inner `nds:"nocache"`
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	entity := &testEntity{
+		Name:    "name",
+		Token:   "token",
+		Secret:  "secret",
+		Inner:   inner{"a", "b"},
+		Skipped: inner{"c", "d"},
+	}
+	if _, err := nds.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	// Datastore reads load every field.
+	got := &testEntity{}
+	if err := nds.Get(c, key, got); err != nil {
+		t.Fatal(err)
+	}
+	if *got != *entity {
+		t.Fatalf("expected %+v, got %+v", entity, got)
+	}
+
+	item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.EntityItem {
+		t.Fatalf("expected entity item, got flags %d", item.Flags)
+	}
+	pl := datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(item.Value, &pl); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pl {
+		switch p.Name {
+		case "Name", "Inner.A":
+		default:
+			t.Fatalf("unexpected cached property %q", p.Name)
+		}
+	}
+
+	// Cache hits leave the uncached fields zero.
+	got = &testEntity{}
+	if err := nds.Get(c, key, got); err != nil {
+		t.Fatal(err)
+	}
+	expected := testEntity{Name: "name", Inner: inner{A: "a"}}
+	if *got != expected {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+
+	// The datastore still holds every field.
+	got = &testEntity{}
+	if err := datastore.Get(c, key, got); err != nil {
+		t.Fatal(err)
+	}
+	if *got != *entity {
+		t.Fatalf("expected %+v, got %+v", entity, got)
+	}
+}
+
+// cachedProperties returns the names of the properties of the entity cached
+// for key.
+func cachedProperties(t *testing.T, c context.Context,
+	key *datastore.Key) []string {
+
+	item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.EntityItem {
+		t.Fatalf("expected entity item, got flags %d", item.Flags)
+	}
+	pl := datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(item.Value, &pl); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, p := range pl {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+type noCacheEntity struct {
+	Name  string
+	Token string `nds:"nocache"`
+}
+
+func TestNoCacheTagCASRetry(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key,
+		&noCacheEntity{"name", "token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the first compare and swap so the entity is cached by a retry.
+	nds.SetCASRetries(1, nil)
+	defer nds.SetCASRetries(0, nil)
+	casCalls := 0
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		casCalls++
+		if casCalls == 1 {
+			return appengine.MultiError{memcache.ErrCASConflict}
+		}
+		return memcache.CompareAndSwapMulti(c, items)
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	if err := nds.Get(c, key, &noCacheEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if casCalls != 2 {
+		t.Fatal("expected a retry", casCalls)
+	}
+	if names := cachedProperties(t, c, key); !reflect.DeepEqual(names,
+		[]string{"Name"}) {
+		t.Fatal("incorrect cached properties", names)
+	}
+}
+
+func TestNoCacheTagBatcher(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key,
+		&noCacheEntity{"name", "token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := nds.NewBatcher(c, time.Millisecond)
+	got := &noCacheEntity{}
+	if err := b.Get(key, got); err != nil {
+		t.Fatal(err)
+	}
+	if *got != (noCacheEntity{"name", "token"}) {
+		t.Fatal("incorrect entity", got)
+	}
+	if names := cachedProperties(t, c, key); !reflect.DeepEqual(names,
+		[]string{"Name"}) {
+		t.Fatal("incorrect cached properties", names)
+	}
+}
+
+func TestRegisterNoCacheKind(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	nds.RegisterNoCacheKind("NoCacheEntity", &noCacheEntity{})
+
+	key := datastore.NewKey(c, "NoCacheEntity", "", 1, nil)
+	if _, err := nds.Put(c, key,
+		&noCacheEntity{"name", "token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entities cached without their type still leave out its properties.
+	if err := nds.PrimeCache(c, []*datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+	if names := cachedProperties(t, c, key); !reflect.DeepEqual(names,
+		[]string{"Name"}) {
+		t.Fatal("incorrect cached properties", names)
+	}
+}
@@ -0,0 +1,235 @@
+package nds
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// memcacheMaxPrefixSize is the maximum length of a memcache prefix set with
+// WithMemcachePrefix. It keeps plenty of room within memcacheMaxKeySize for
+// the encoded datastore key.
+const memcacheMaxPrefixSize = 32
+
+var optionsKey = "used for *options"
+
+// options holds the settings that can be scoped to a context. A context
+// without options uses defaultOptions.
+type options struct {
+	memcachePrefix string
+	lockTime       time.Duration
+
+	// entityExpiration is the expiration of cached entityItem and
+	// chunkedEntityItem items and their chunks.
+	entityExpiration time.Duration
+
+	// noSuchEntityExpiration is the expiration of cached noneItem items.
+	noSuchEntityExpiration time.Duration
+
+	noCache bool
+
+	// unlocked makes GetMulti cache entities without locking memcache.
+	unlocked bool
+
+	ignoreFieldMismatch bool
+
+	// strictCache makes GetMulti return memcache read errors.
+	strictCache bool
+
+	// seedEntities makes GetAll cache the entities it reads by key.
+	seedEntities bool
+
+	// memcacheGetTimeout is how long GetMulti waits for memcache before
+	// reading the datastore instead, or zero to always wait.
+	memcacheGetTimeout time.Duration
+
+	// statsTag is the Tag of the Stats of calls.
+	statsTag string
+}
+
+var defaultOptions = &options{
+	memcachePrefix: memcachePrefix,
+	lockTime:       memcacheLockTime,
+}
+
+func optionsFromContext(c context.Context) *options {
+	if o, ok := c.Value(&optionsKey).(*options); ok {
+		return o
+	}
+	return defaultOptions
+}
+
+// withOptions returns a copy of c with a copy of its options modified by f.
+// The options of c itself are never modified.
+func withOptions(c context.Context, f func(o *options)) context.Context {
+	o := *optionsFromContext(c)
+	f(&o)
+	return context.WithValue(c, &optionsKey, &o)
+}
+
+// WithMemcachePrefix returns a replacement context that uses prefix instead of
+// the default "NDS4:" for all memcache keys created by nds. This allows
+// logically separate applications sharing one memcache to avoid key
+// collisions. The prefix must not be empty and must be no longer than 32
+// bytes.
+//
+// All code reading and writing the same entities must use the same prefix,
+// otherwise stale cache values can be returned.
+func WithMemcachePrefix(c context.Context, prefix string) (
+	context.Context, error) {
+
+	if prefix == "" {
+		return nil, errors.New("nds: memcache prefix is empty")
+	}
+	if len(prefix) > memcacheMaxPrefixSize {
+		return nil, errors.New("nds: memcache prefix is too long")
+	}
+	return withOptions(c, func(o *options) {
+		o.memcachePrefix = prefix
+	}), nil
+}
+
+// WithMemcacheLockTime returns a replacement context that locks memcache items
+// for d instead of the default 32 seconds while they are being updated. The
+// lock time bounds how long a failed request can stop an entity from being
+// cached.
+//
+// The default is chosen because the datastore can continue to retry a write
+// for up to 30 seconds after reporting success. A lock time shorter than that
+// allows a reader to cache a value that the datastore is about to overwrite,
+// so only shorten it for writes that are known to complete quickly. d must
+// be at least one second as that is the memcache expiration granularity.
+//
+// Locks are held for up to 10% longer than d, and locks taken by GetMulti for
+// up to 10% shorter, so that many locks of a hot key do not expire together.
+func WithMemcacheLockTime(c context.Context, d time.Duration) (
+	context.Context, error) {
+
+	if d < time.Second {
+		return nil, errors.New("nds: memcache lock time is less than a second")
+	}
+	return withOptions(c, func(o *options) {
+		o.lockTime = d
+	}), nil
+}
+
+// WithEntityExpiration returns a replacement context that caches entities for
+// at most d. By default GetMulti caches entities until they are evicted from
+// memcache or changed with nds, so use d as a safety net against stale
+// entities of kinds that other applications change without using nds. A d of
+// zero, the default, means entities never expire. Otherwise d must be at
+// least one second as that is the memcache expiration granularity. The
+// expiration of memcache locks is still set with WithMemcacheLockTime.
+func WithEntityExpiration(c context.Context, d time.Duration) (
+	context.Context, error) {
+
+	if d != 0 && d < time.Second {
+		return nil, errors.New("nds: entity expiration is less than a second")
+	}
+	return withOptions(c, func(o *options) {
+		o.entityExpiration = d
+	}), nil
+}
+
+// WithNoSuchEntityExpiration returns a replacement context that caches the
+// absence of entities for d. By default GetMulti caches the absence of an
+// entity until it is evicted from memcache or the entity is put, so repeated
+// gets of keys with no entity are served from memcache. Use a short d to
+// bound how long memcache is trusted about missing entities, for example if
+// other applications write them without using nds. A d of zero, the default,
+// means the absence never expires. Otherwise d must be at least one second as
+// that is the memcache expiration granularity.
+func WithNoSuchEntityExpiration(c context.Context, d time.Duration) (
+	context.Context, error) {
+
+	if d != 0 && d < time.Second {
+		return nil, errors.New(
+			"nds: no such entity expiration is less than a second")
+	}
+	return withOptions(c, func(o *options) {
+		o.noSuchEntityExpiration = d
+	}), nil
+}
+
+// WithNoCache returns a replacement context that reads entities directly from
+// the datastore, ignoring memcache and any local cache. This is useful for
+// repair scripts that must see the authoritative datastore state.
+//
+// Put, PutMulti, Delete and DeleteMulti never write entities to memcache, but
+// they still lock and invalidate the memcache items of the keys they change
+// when used with this context. This ensures memcache is not left stale after
+// a repair.
+func WithNoCache(c context.Context) context.Context {
+	return withOptions(c, func(o *options) {
+		o.noCache = true
+	})
+}
+
+// WithIgnoreFieldMismatch returns a replacement context for which Get and
+// GetMulti treat datastore.ErrFieldMismatch as benign, such as after a field
+// has been removed from a struct but not from the stored entities. Entities
+// giving the error are loaded as far as possible and are not read from the
+// datastore again when they were got from a cache.
+//
+// If the only errors of a call are field mismatches, a *FieldMismatchError
+// holding them is returned instead of an appengine.MultiError so that it can
+// be ignored. Otherwise an appengine.MultiError of all the errors is returned,
+// still holding the *datastore.ErrFieldMismatch of each key that gave one.
+func WithIgnoreFieldMismatch(c context.Context) context.Context {
+	return withOptions(c, func(o *options) {
+		o.ignoreFieldMismatch = true
+	})
+}
+
+// WithStrictCache returns a replacement context for which Get and GetMulti
+// return an error wrapped in a *CacheError for each key, instead of reading
+// the datastore, when memcache fails to return the cached entities of the
+// keys. Without it such failures, such as memcache.ErrServerError during a
+// memcache outage, are only logged and the entities are read from the
+// datastore without being cached.
+//
+// Calls made while the circuit breaker set with SetCircuitBreaker is open do
+// not read memcache so never give the error.
+func WithStrictCache(c context.Context) context.Context {
+	return withOptions(c, func(o *options) {
+		o.strictCache = true
+	})
+}
+
+// WithQueryEntityCache returns a replacement context for which GetAll also
+// caches each whole entity it reads from the datastore under its key, so that
+// later Get and GetMulti calls of the same entities are served from memcache.
+// Entities are cached in the same way as by Run, with the same caveat that any
+// query can cache a stale entity, which is therefore given the same bounded
+// expiration. Keys only and projection queries return partial entities so
+// their results are never cached by key.
+func WithQueryEntityCache(c context.Context) context.Context {
+	return withOptions(c, func(o *options) {
+		o.seedEntities = true
+	})
+}
+
+// WithMemcacheGetTimeout returns a replacement context for which Get and
+// GetMulti stop waiting for memcache to return cached entities after d and read
+// the entities from the datastore instead, so a slow but working memcache does
+// not add more than d to their latency. Entities read after a timeout are not
+// cached, in the same way as when memcache fails, and the late memcache results
+// are ignored. A d of zero or less, the default, waits for memcache for as long
+// as it takes.
+func WithMemcacheGetTimeout(c context.Context,
+	d time.Duration) context.Context {
+
+	return withOptions(c, func(o *options) {
+		o.memcacheGetTimeout = d
+	})
+}
+
+// WithStatsTag returns a replacement context whose calls pass tag in the Tag of
+// their Stats, so that the stats recorder set with SetStatsRecorder can break
+// down cache usage by feature or endpoint. The default tag is empty.
+func WithStatsTag(c context.Context, tag string) context.Context {
+	return withOptions(c, func(o *options) {
+		o.statsTag = tag
+	})
+}
@@ -0,0 +1,450 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithMemcachePrefix(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	if _, err := nds.WithMemcachePrefix(c, ""); err == nil {
+		t.Fatal("expected empty prefix error")
+	}
+
+	if _, err := nds.WithMemcachePrefix(c,
+		strings.Repeat("a", 33)); err == nil {
+		t.Fatal("expected long prefix error")
+	}
+
+	pc, err := nds.WithMemcachePrefix(c, "APP2:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if nds.MemcacheKey(c, key) == nds.MemcacheKey(pc, key) {
+		t.Fatal("expected different memcache keys")
+	}
+
+	memcacheKey := nds.MemcacheKey(pc, key)
+	if !strings.HasPrefix(memcacheKey, "APP2:") {
+		t.Fatal("expected APP2: prefix", memcacheKey)
+	}
+
+	if _, err := nds.Put(pc, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.Get(pc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := memcache.Get(pc, memcacheKey); err != nil {
+		t.Fatal("expected prefixed item in memcache", err)
+	}
+
+	if _, err := memcache.Get(c,
+		nds.MemcacheKey(c, key)); err != memcache.ErrCacheMiss {
+		t.Fatal("expected no default prefixed item in memcache", err)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(pc, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.IntVal != 3 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+}
+
+func TestWithMemcachePrefixKeySize(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	pc, err := nds.WithMemcachePrefix(c, strings.Repeat("p", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The prefix counts towards the maximum memcache key size.
+	maxKeySize := nds.MemcacheMaxKeySize
+	key := datastore.NewKey(c, "TestEntity",
+		randHexString(maxKeySize/2-10), 0, nil)
+
+	memcacheKey := nds.MemcacheKey(pc, key)
+	if len(memcacheKey) > maxKeySize {
+		t.Fatal("incorrect memcache key size")
+	}
+}
+
+func TestWithMemcacheLockTime(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	if _, err := nds.WithMemcacheLockTime(c, time.Millisecond); err == nil {
+		t.Fatal("expected short lock time error")
+	}
+
+	lc, err := nds.WithMemcacheLockTime(c, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expirations []time.Duration
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			expirations = append(expirations, item.Expiration)
+		}
+		return memcache.SetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expirations) != 2 {
+		t.Fatal("expected two locks", expirations)
+	}
+	if expirations[0] != 5*time.Second {
+		t.Fatal("incorrect lock time", expirations[0])
+	}
+	// Write locks are never shortened by jitter.
+	if expirations[1] < 32*time.Second || expirations[1] > 35*time.Second {
+		t.Fatal("incorrect default lock time", expirations[1])
+	}
+}
+
+func TestLockTimeJitter(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	var expirations []time.Duration
+	nds.SetMemcacheAddMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			expirations = append(expirations, item.Expiration)
+		}
+		return memcache.AddMulti(c, items)
+	})
+	defer nds.SetMemcacheAddMulti(memcache.AddMulti)
+
+	keys := make([]*datastore.Key, 100)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+	}
+	nds.GetMulti(c, keys, make([]testEntity, len(keys)))
+
+	different := false
+	for _, expiration := range expirations {
+		if expiration < 29*time.Second || expiration > 35*time.Second {
+			t.Fatal("incorrect lock time", expiration)
+		}
+		if expiration%time.Second != 0 {
+			t.Fatal("expected whole seconds", expiration)
+		}
+		different = different || expiration != expirations[0]
+	}
+	if len(expirations) != len(keys) || !different {
+		t.Fatal("expected jittered lock times", expirations)
+	}
+}
+
+func TestWithNoSuchEntityExpiration(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	if _, err := nds.WithNoSuchEntityExpiration(c,
+		time.Millisecond); err == nil {
+		t.Fatal("expected short expiration error")
+	}
+
+	ec, err := nds.WithNoSuchEntityExpiration(c, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if err := nds.Get(ec, key,
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity", err)
+	}
+
+	item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.NoneItem {
+		t.Fatal("expected none item", item.Flags)
+	}
+
+	var expiration time.Duration
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			expiration = item.Expiration
+		}
+		return memcache.CompareAndSwapMulti(c, items)
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	otherKey := datastore.NewKey(c, "Entity", "", 2, nil)
+	if err := nds.Get(ec, otherKey,
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity", err)
+	}
+	if expiration != 10*time.Second {
+		t.Fatal("incorrect expiration", expiration)
+	}
+
+	// A put must make the entity visible immediately.
+	if _, err := nds.Put(ec, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(ec, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithEntityExpiration(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	if _, err := nds.WithEntityExpiration(c,
+		time.Millisecond); err == nil {
+		t.Fatal("expected short expiration error")
+	}
+
+	ec, err := nds.WithEntityExpiration(c, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Locks taken by puts are unaffected.
+	var lockExpiration time.Duration
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			lockExpiration = item.Expiration
+		}
+		return memcache.SetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(ec, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if lockExpiration < 32*time.Second || lockExpiration > 35*time.Second {
+		t.Fatal("incorrect lock expiration", lockExpiration)
+	}
+
+	var expiration time.Duration
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			expiration = item.Expiration
+		}
+		return memcache.CompareAndSwapMulti(c, items)
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	if err := nds.Get(ec, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if expiration != time.Hour {
+		t.Fatal("incorrect expiration", expiration)
+	}
+
+	// The default is no expiration.
+	otherKey := datastore.NewKey(c, "Entity", "", 2, nil)
+	if _, err := nds.Put(c, otherKey, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, otherKey, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if expiration != 0 {
+		t.Fatal("incorrect expiration", expiration)
+	}
+}
+
+func TestWithNoCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the datastore behind the cache's back.
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	nc := nds.WithNoCache(c)
+
+	memcacheCalled := false
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		memcacheCalled = true
+		return memcache.GetMulti(c, keys)
+	})
+	entity := &testEntity{}
+	err := nds.Get(nc, key, entity)
+	nds.SetMemcacheGetMulti(memcache.GetMulti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memcacheCalled {
+		t.Fatal("expected memcache not to be used")
+	}
+	if entity.IntVal != 2 {
+		t.Fatal("expected datastore entity", entity.IntVal)
+	}
+
+	// Writes must still invalidate memcache.
+	if _, err := nds.Put(nc, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	entity = &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 3 {
+		t.Fatal("expected memcache to be invalidated", entity.IntVal)
+	}
+}
+
+func TestWithStrictCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		return nil, memcache.ErrServerError
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 1 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	err := nds.Get(nds.WithStrictCache(c), key, &testEntity{})
+	if cacheErr, ok := err.(*nds.CacheError); !ok {
+		t.Fatal("expected *nds.CacheError", err)
+	} else if cacheErr.Err != memcache.ErrServerError {
+		t.Fatal("expected memcache.ErrServerError", cacheErr.Err)
+	}
+}
+
+func TestWithMemcacheGetTimeout(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	sl := &statsLog{}
+	nds.SetStatsRecorder(sl.record)
+	defer nds.SetStatsRecorder(nil)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make memcache slow until the test is done with it.
+	release, finished := make(chan struct{}), make(chan struct{})
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		defer close(finished)
+		<-release
+		return memcache.GetMulti(c, keys)
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	tc := nds.WithMemcacheGetTimeout(c, 10*time.Millisecond)
+	entity := &testEntity{}
+	if err := nds.Get(tc, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 1 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+	if s := sl.last(); s.CacheHits != 0 || s.CacheMisses != 1 ||
+		s.CacheWriteBytes != 0 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+	close(release)
+	<-finished
+
+	// The cached entity was left alone.
+	item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Flags != nds.EntityItem {
+		t.Fatalf("expected entity item, got flags %d", item.Flags)
+	}
+}
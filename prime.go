@@ -0,0 +1,41 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// PrimeCache gets the entities for keys from the datastore and stores them in
+// memcache in exactly the same way as GetMulti, but without returning them. It
+// is intended for warming memcache with entities that are about to be in
+// demand. Keys already cached in memcache are not got from the datastore or
+// written to memcache again.
+//
+// Keys with no entity are cached as such and are not reported as errors. Any
+// other errors are returned in an appengine.MultiError aligned with keys.
+func PrimeCache(c context.Context, keys []*datastore.Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	vals := make([]datastore.PropertyList, len(keys))
+	err := GetMulti(c, keys, vals)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+
+	errsNil := true
+	for i, e := range me {
+		if e == datastore.ErrNoSuchEntity {
+			me[i] = nil
+		} else if e != nil {
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return me
+}
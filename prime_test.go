@@ -0,0 +1,96 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestPrimeCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.Put(c, keys[2], &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the first key so it is not written again.
+	if err := nds.Get(c, keys[0], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var casKeys []string
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			casKeys = append(casKeys, item.Key)
+		}
+		return memcache.CompareAndSwapMulti(c, items)
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	if err := nds.PrimeCache(c, keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(casKeys) != 2 {
+		t.Fatal("expected two memcache items to be saved", casKeys)
+	}
+
+	// All entities must now come from memcache.
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		return errors.New("unexpected datastore get")
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	entities := make([]testEntity, len(keys))
+	err := nds.GetMulti(c, keys, entities)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != datastore.ErrNoSuchEntity ||
+		me[2] != nil {
+		t.Fatal("incorrect errors", me)
+	}
+	if entities[0].IntVal != 1 || entities[2].IntVal != 3 {
+		t.Fatal("incorrect entities", entities)
+	}
+}
+
+func TestPrimeCacheDatastoreFail(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+	}
+
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		return appengine.MultiError{errors.New("expected error")}
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	err := nds.PrimeCache(c, keys)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] == nil {
+		t.Fatal("expected error", me)
+	}
+}
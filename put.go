@@ -1,14 +1,13 @@
 package nds
 
 import (
+	"fmt"
 	"reflect"
 	"sync"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
 )
 
 // putMultiLimit is the App Engine datastore limit for the maximum number
@@ -19,10 +18,19 @@ const putMultiLimit = 500
 // except it interacts appropriately with NDS's caching strategy. It also
 // removes the API limit of 500 entities per request by calling the datastore as
 // many times as required to put all the keys. It does this efficiently and
-// concurrently.
+// concurrently. vals can be any type accepted by GetMulti, including
+// []datastore.PropertyList.
+//
+// PutMulti does not cache the entities it puts. They are cached by the first
+// GetMulti of their keys. Incomplete keys have no memcache items so they are
+// not locked, and the entities put with them are cached under the complete
+// keys that PutMulti returns.
 func PutMulti(c context.Context,
 	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
 
+	c, record := startStats(c, Stats{Op: OpPut, Keys: len(keys)})
+	defer record()
+
 	if len(keys) == 0 {
 		return nil, nil
 	}
@@ -36,6 +44,7 @@ func PutMulti(c context.Context,
 	putKeys := make([][]*datastore.Key, callCount)
 	errs := make([]error, callCount)
 
+	limiter := newCallLimiter(callCount)
 	var wg sync.WaitGroup
 	wg.Add(callCount)
 	for i := 0; i < callCount; i++ {
@@ -45,14 +54,29 @@ func PutMulti(c context.Context,
 			hi = len(keys)
 		}
 
+		limiter <- struct{}{}
 		go func(i int, keys []*datastore.Key, vals reflect.Value) {
 			putKeys[i], errs[i] = putMulti(c, keys, vals.Interface())
+			<-limiter
 			wg.Done()
 		}(i, keys[lo:hi], v.Slice(lo, hi))
 	}
 	wg.Wait()
 
-	if isErrorsNil(errs) {
+	// Cache errors do not stop the keys from being returned.
+	var cacheErr error
+	errsNil := true
+	for _, err := range errs {
+		if _, ok := err.(*CacheError); ok {
+			if cacheErr == nil {
+				cacheErr = err
+			}
+		} else if err != nil {
+			errsNil = false
+		}
+	}
+
+	if errsNil {
 		groupedKeys := make([]*datastore.Key, len(keys))
 		for i, k := range putKeys {
 			lo := i * putMultiLimit
@@ -62,7 +86,7 @@ func PutMulti(c context.Context,
 			}
 			copy(groupedKeys[lo:hi], k)
 		}
-		return groupedKeys, nil
+		return groupedKeys, cacheErr
 	}
 
 	groupedKeys := make([]*datastore.Key, len(keys))
@@ -81,6 +105,11 @@ func PutMulti(c context.Context,
 					groupedErrs[lo+j] = e
 				}
 			}
+		} else if _, ok := err.(*CacheError); ok {
+			copy(groupedKeys[lo:hi], putKeys[i])
+			for j := lo; j < hi; j++ {
+				groupedErrs[j] = err
+			}
 		} else if err != nil {
 			for j := lo; j < hi; j++ {
 				groupedErrs[j] = err
@@ -92,12 +121,17 @@ func PutMulti(c context.Context,
 }
 
 // Put saves the entity val into the datastore with key. val must be a struct
-// pointer; if a struct pointer then any unexported fields of that struct will
-// be skipped. If key is an incomplete key, the returned key will be a unique
-// key generated by the datastore.
+// pointer or implement datastore.PropertyLoadSaver; if a struct pointer then
+// any unexported fields of that struct will be skipped. If key is an
+// incomplete key, the returned key will be a unique key generated by the
+// datastore. Put locks memcache in the same way as PutMulti and returns a
+// plain error rather than an appengine.MultiError.
 func Put(c context.Context,
 	key *datastore.Key, val interface{}) (*datastore.Key, error) {
 
+	c, record := startStats(c, Stats{Op: OpPut, Keys: 1})
+	defer record()
+
 	keys := []*datastore.Key{key}
 	vals := []interface{}{val}
 	if err := checkKeysValues(keys, reflect.ValueOf(vals)); err != nil {
@@ -108,6 +142,8 @@ func Put(c context.Context,
 	switch e := err.(type) {
 	case nil:
 		return keys[0], nil
+	case *CacheError:
+		return keys[0], e
 	case appengine.MultiError:
 		return nil, e[0]
 	default:
@@ -115,50 +151,449 @@ func Put(c context.Context,
 	}
 }
 
-// putMulti puts the entities into the datastore and then its local cache.
-func putMulti(c context.Context,
-	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+// PutMultiValidate checks that PutMulti would be able to put vals and cache
+// them, without writing anything to the datastore or memcache. It checks keys
+// and vals in the same way as PutMulti then saves and marshals each entity as
+// if it were being cached. The errors of entities that would fail, such as
+// those with property value types that cannot be marshalled, are returned in
+// an appengine.MultiError, with a *CodecError for each entity that cannot be
+// marshalled. Entities too large for a single memcache item are valid as they
+// are cached in chunks. Errors found only by the datastore, such as an entity
+// exceeding its size limit, are not detected.
+func PutMultiValidate(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
 
-	lockMemcacheKeys := make([]string, 0, len(keys))
-	lockMemcacheItems := make([]*memcache.Item, 0, len(keys))
-	for _, key := range keys {
-		if !key.Incomplete() {
-			item := &memcache.Item{
-				Key:        createMemcacheKey(key),
-				Flags:      lockItem,
-				Value:      itemLock(),
-				Expiration: memcacheLockTime,
+	v := reflect.ValueOf(vals)
+	if err := checkKeysValues(keys, v); err != nil {
+		return err
+	}
+
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	for i := range keys {
+		pl, err := saveValue(v.Index(i))
+		if err == nil {
+			if _, err = marshal(pl); err != nil {
+				err = &CodecError{keys[i], err}
 			}
-			lockMemcacheItems = append(lockMemcacheItems, item)
-			lockMemcacheKeys = append(lockMemcacheKeys, item.Key)
+		}
+		if err != nil {
+			errs[i] = err
+			errsNil = false
 		}
 	}
 
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+// saveValue returns the properties of val, which must be a valid element of
+// vals, in the same way as the datastore does when val is put.
+func saveValue(val reflect.Value) (datastore.PropertyList, error) {
+	switch checkValueType(val.Type()) {
+	case valueTypePropertyLoadSaver, valueTypeStruct:
+		val = val.Addr()
+	case valueTypeInterface:
+		val = val.Elem()
+	}
+
+	if !val.IsValid() || val.Kind() == reflect.Ptr && val.IsNil() {
+		return nil, datastore.ErrInvalidEntityType
+	}
+
+	if pls, ok := val.Interface().(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	return datastore.SaveStruct(val.Interface())
+}
+
+// putMulti puts the entities into the datastore and then its local cache. A
+// *CacheError is returned if the entities were put but their memcache locks
+// could not be removed.
+func putMulti(c context.Context, keys []*datastore.Key,
+	vals interface{}) (putKeys []*datastore.Key, err error) {
+
+	lockMemcacheItems := createLockItems(c, keys)
+	lockMemcacheKeys := make([]string, len(lockMemcacheItems))
+	for i, item := range lockMemcacheItems {
+		lockMemcacheKeys[i] = item.Key
+	}
+
 	memcacheCtx, err := memcacheContext(c)
 	if err != nil {
 		return nil, err
 	}
 
 	defer func() {
-		if _, ok := transactionFromContext(c); !ok {
-			// Remove the locks.
-			if err := memcacheDeleteMulti(memcacheCtx,
-				lockMemcacheKeys); err != nil {
-				log.Warningf(c, "putMulti memcache.DeleteMulti %s", err)
-			}
+		if _, ok := transactionFromContext(c); ok {
+			return
+		}
+
+		// Remove the locks.
+		unlockErr := tracedMemcacheDeleteMulti(memcacheCtx, lockMemcacheKeys)
+		if unlockErr == nil {
+			return
+		}
+		logEvent(c, LogWarning, "nds:putMulti DeleteMulti",
+			"error", unlockErr)
+		if err == nil && !isCacheMissErrors(unlockErr) {
+			err = &CacheError{Err: unlockErr}
 		}
 	}()
 
 	if tx, ok := transactionFromContext(c); ok {
-		tx.Lock()
-		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
-			lockMemcacheItems...)
-		tx.Unlock()
-	} else if err := memcacheSetMulti(memcacheCtx,
+		tx.add(lockMemcacheItems, keys)
+	} else if err := tracedMemcacheSetMulti(memcacheCtx,
 		lockMemcacheItems); err != nil {
 		return nil, err
+	} else {
+		defer invalidateLocalCache(c, keys)
 	}
 
+	// Invalidate the local cache both before and after saving so that no
+	// concurrent GetMulti can store the old entities in it. Within a
+	// transaction the entities only change when it commits, so
+	// RunInTransaction invalidates them again then.
+	invalidateLocalCache(c, keys)
+
 	// Save to the datastore.
-	return datastorePutMulti(c, keys, vals)
+	return tracedDatastorePutMulti(c, keys, vals)
+}
+
+// PutMultiNX puts each entity of vals only if no entity already exists for its
+// key. The returned slice is aligned with keys and reports which entities were
+// created; existing entities are left unchanged and reported as false without
+// an error. keys must be complete.
+//
+// Each key is checked and put within its own transaction so that concurrent
+// calls for the same key create the entity at most once. Memcache is locked for
+// the created entities in the same way as RunInTransaction. If c is already a
+// transaction context then every key is checked and put within that
+// transaction instead, and the created entities only exist once it commits.
+func PutMultiNX(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]bool, error) {
+
+	c, record := startStats(c, Stats{Op: OpPut, Keys: len(keys)})
+	defer record()
+
+	v := reflect.ValueOf(vals)
+	if err := checkKeysValues(keys, v); err != nil {
+		return nil, err
+	}
+
+	if err := checkCompleteKeys(keys); err != nil {
+		return nil, err
+	}
+
+	created := make([]bool, len(keys))
+	if len(keys) == 0 {
+		return created, nil
+	}
+
+	if _, ok := transactionFromContext(c); ok {
+		return created, putMultiNX(c, keys, v, created)
+	}
+
+	err := perKeyTransactions(c, len(keys),
+		func(tc context.Context, i int) error {
+			return putMultiNX(tc, keys[i:i+1], v.Slice(i, i+1),
+				created[i:i+1])
+		})
+	if me, ok := err.(appengine.MultiError); ok {
+		for i, e := range me {
+			if e != nil {
+				created[i] = false
+			}
+		}
+	}
+	return created, err
+}
+
+// checkCompleteKeys returns an appengine.MultiError with
+// datastore.ErrInvalidKey for each incomplete key.
+func checkCompleteKeys(keys []*datastore.Key) error {
+	isIncompleteErr := false
+	incompleteErr := make(appengine.MultiError, len(keys))
+	for i, key := range keys {
+		if key.Incomplete() {
+			isIncompleteErr = true
+			incompleteErr[i] = datastore.ErrInvalidKey
+		}
+	}
+	if isIncompleteErr {
+		return incompleteErr
+	}
+	return nil
+}
+
+// perKeyTransactions concurrently calls f for each of count keys within its
+// own transaction. The errors are returned in an appengine.MultiError aligned
+// with the keys, with each single key appengine.MultiError returned by f
+// replaced by its error.
+func perKeyTransactions(c context.Context, count int,
+	f func(tc context.Context, i int) error) error {
+
+	errs, errsNil := make(appengine.MultiError, count), true
+	limiter := newCallLimiter(count)
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		limiter <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-limiter }()
+			errs[i] = RunInTransaction(c, func(tc context.Context) error {
+				return f(tc, i)
+			}, nil)
+			if me, ok := errs[i].(appengine.MultiError); ok {
+				errs[i] = me[0]
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			errsNil = false
+			break
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+// putMultiNX puts the entities of vals that do not exist within the
+// transaction context tc and records which were put in created.
+func putMultiNX(tc context.Context, keys []*datastore.Key, vals reflect.Value,
+	created []bool) error {
+
+	// created is shared by every attempt of a retried transaction, so only
+	// the puts of this attempt are reported.
+	for i := range created {
+		created[i] = false
+	}
+
+	presences := make([]presence, len(keys))
+	err := tracedDatastoreGetMulti(tc, keys, presences)
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+
+	putKeys := make([]*datastore.Key, 0, len(keys))
+	putVals := reflect.MakeSlice(vals.Type(), 0, len(keys))
+	putIndex := make([]int, 0, len(keys))
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, key := range keys {
+		switch {
+		case err == nil || me[i] == nil:
+			// The entity exists.
+		case me[i] == datastore.ErrNoSuchEntity:
+			putKeys = append(putKeys, key)
+			putVals = reflect.Append(putVals, vals.Index(i))
+			putIndex = append(putIndex, i)
+		default:
+			errs[i] = me[i]
+			errsNil = false
+		}
+	}
+	if !errsNil {
+		return errs
+	}
+
+	if len(putKeys) == 0 {
+		return nil
+	}
+
+	_, err = putMulti(tc, putKeys, putVals.Interface())
+	putErrs, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+	for j, i := range putIndex {
+		if err == nil || putErrs[j] == nil {
+			created[i] = true
+		} else {
+			errs[i] = putErrs[j]
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
+}
+
+// PutMultiCAS puts each entity of vals only if the int field of its struct
+// named versionField holds the same version as the entity already stored for
+// its key, and stores the entity with the version incremented. A key with no
+// entity has version zero. The returned slice is aligned with keys and
+// reports which entities were put; entities rejected because of a different
+// version are reported as false without an error. vals must be a []S or []*S
+// for some struct type S and keys must be complete. versionField must be
+// exported and must not be promoted through an embedded pointer.
+//
+// vals itself is not changed, so callers must increment the versions of the
+// applied entities themselves before putting them again. Each key is checked
+// and put within its own transaction, in the same way as PutMultiNX, and
+// memcache is only locked for the entities that are put.
+func PutMultiCAS(c context.Context, keys []*datastore.Key, vals interface{},
+	versionField string) ([]bool, error) {
+
+	c, record := startStats(c, Stats{Op: OpPut, Keys: len(keys)})
+	defer record()
+
+	v := reflect.ValueOf(vals)
+	if err := checkKeysValues(keys, v); err != nil {
+		return nil, err
+	}
+	if err := checkCompleteKeys(keys); err != nil {
+		return nil, err
+	}
+
+	structType := v.Type().Elem()
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("nds: vals must be a slice of structs or "+
+			"struct pointers not %s", v.Type())
+	}
+	field, ok := structType.FieldByName(versionField)
+	if !ok {
+		return nil, fmt.Errorf("nds: %s has no field %s", structType,
+			versionField)
+	}
+	if field.PkgPath != "" {
+		return nil, fmt.Errorf("nds: field %s of %s is unexported",
+			versionField, structType)
+	}
+	// Fields promoted through embedded pointers cannot be set when the
+	// pointer is nil.
+	t := structType
+	for _, i := range field.Index[:len(field.Index)-1] {
+		if t = t.Field(i).Type; t.Kind() == reflect.Ptr {
+			return nil, fmt.Errorf("nds: field %s of %s is promoted through "+
+				"an embedded pointer", versionField, structType)
+		}
+	}
+	switch field.Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+	default:
+		return nil, fmt.Errorf("nds: field %s of %s is not an int",
+			versionField, structType)
+	}
+
+	applied := make([]bool, len(keys))
+	if len(keys) == 0 {
+		return applied, nil
+	}
+
+	if _, ok := transactionFromContext(c); ok {
+		return applied, putMultiCAS(c, keys, v, structType, field.Index,
+			applied)
+	}
+
+	err := perKeyTransactions(c, len(keys),
+		func(tc context.Context, i int) error {
+			return putMultiCAS(tc, keys[i:i+1], v.Slice(i, i+1), structType,
+				field.Index, applied[i:i+1])
+		})
+	if me, ok := err.(appengine.MultiError); ok {
+		for i, e := range me {
+			if e != nil {
+				applied[i] = false
+			}
+		}
+	}
+	return applied, err
+}
+
+// putMultiCAS puts the entities of vals whose versions match the stored
+// entities within the transaction context tc and records which were put in
+// applied. index is the index of the version field of structType.
+func putMultiCAS(tc context.Context, keys []*datastore.Key, vals reflect.Value,
+	structType reflect.Type, index []int, applied []bool) error {
+
+	// applied is shared by every attempt of a retried transaction, so only
+	// the puts of this attempt are reported.
+	for i := range applied {
+		applied[i] = false
+	}
+
+	stored := reflect.MakeSlice(reflect.SliceOf(structType), len(keys),
+		len(keys))
+	err := tracedDatastoreGetMulti(tc, keys, stored.Interface())
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+
+	putKeys := make([]*datastore.Key, 0, len(keys))
+	putVals := make([]interface{}, 0, len(keys))
+	putIndex := make([]int, 0, len(keys))
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, key := range keys {
+		var version int64
+		switch {
+		case err == nil || me[i] == nil || isFieldMismatch(me[i]):
+			version = stored.Index(i).FieldByIndex(index).Int()
+		case me[i] == datastore.ErrNoSuchEntity:
+		default:
+			errs[i] = me[i]
+			errsNil = false
+			continue
+		}
+
+		val := vals.Index(i)
+		if val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				errs[i] = datastore.ErrInvalidEntityType
+				errsNil = false
+				continue
+			}
+			val = val.Elem()
+		}
+		if val.FieldByIndex(index).Int() != version {
+			continue
+		}
+
+		// Put a copy so that vals is unchanged if the transaction is retried.
+		put := reflect.New(structType)
+		put.Elem().Set(val)
+		put.Elem().FieldByIndex(index).SetInt(version + 1)
+
+		putKeys = append(putKeys, key)
+		putVals = append(putVals, put.Interface())
+		putIndex = append(putIndex, i)
+	}
+	if !errsNil {
+		return errs
+	}
+
+	if len(putKeys) == 0 {
+		return nil
+	}
+
+	_, err = putMulti(tc, putKeys, putVals)
+	putErrs, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+	for j, i := range putIndex {
+		if err == nil || putErrs[j] == nil {
+			applied[i] = true
+		} else {
+			errs[i] = putErrs[j]
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
 }
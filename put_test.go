@@ -2,7 +2,9 @@ package nds_test
 
 import (
 	"errors"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/qedus/nds"
@@ -80,6 +82,45 @@ func TestPutMultiError(t *testing.T) {
 	}
 }
 
+func TestPutMultiIncompleteKeysCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewIncompleteKey(c, "Entity", nil),
+		datastore.NewIncompleteKey(c, "Entity", nil),
+	}
+	putKeys, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first GetMulti caches the entities under the put keys.
+	if err := nds.GetMulti(c, putKeys,
+		make([]testEntity, len(putKeys))); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		t.Fatal("entities not got from memcache")
+		return nil
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	entities := make([]testEntity, len(putKeys))
+	if err := nds.GetMulti(c, putKeys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].IntVal != 1 || entities[1].IntVal != 2 {
+		t.Fatal("incorrect entities", entities)
+	}
+}
+
 func TestPutMultiNoPropertyList(t *testing.T) {
 	c, closeFunc := NewContext(t)
 	defer closeFunc()
@@ -162,7 +203,8 @@ func TestPutMultiLockFailure(t *testing.T) {
 	}
 }
 
-// Make sure PutMulti still works if we have a memcache unlock failure.
+// Make sure PutMulti still works if we have a memcache unlock failure and
+// reports it as a cache error.
 func TestPutMultiUnlockMemcacheSuccess(t *testing.T) {
 	c, closeFunc := NewContext(t)
 	defer closeFunc()
@@ -182,7 +224,47 @@ func TestPutMultiUnlockMemcacheSuccess(t *testing.T) {
 	keys := []*datastore.Key{datastore.NewKey(c, "Test", "", 1, nil)}
 	vals := []testEntity{{42}}
 
-	if _, err := nds.PutMulti(c, keys, vals); err != nil {
+	putKeys, err := nds.PutMulti(c, keys, vals)
+	if _, ok := err.(*nds.CacheError); !ok {
+		t.Fatal("expected nds.CacheError", err)
+	}
+	if len(putKeys) != 1 || !putKeys[0].Equal(keys[0]) {
+		t.Fatal("expected put keys", putKeys)
+	}
+
+	key, err := nds.Put(c, keys[0], &vals[0])
+	if _, ok := err.(*nds.CacheError); !ok {
+		t.Fatal("expected nds.CacheError", err)
+	}
+	if !key.Equal(keys[0]) {
+		t.Fatal("expected put key", key)
+	}
+
+	entity := &testEntity{}
+	if err := datastore.Get(c, keys[0], entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 42 {
+		t.Fatal("expected entity to be put", entity.IntVal)
+	}
+}
+
+// Make sure expired locks are not reported as cache errors.
+func TestPutMultiUnlockCacheMiss(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	nds.SetMemcacheDeleteMulti(func(c context.Context, keys []string) error {
+		return appengine.MultiError{memcache.ErrCacheMiss}
+	})
+	defer nds.SetMemcacheDeleteMulti(memcache.DeleteMulti)
+
+	key := datastore.NewKey(c, "Test", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{42}); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -225,3 +307,457 @@ func TestPutMultiZeroKeys(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPutMultiErrorIndices(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type TestEntity struct {
+		Value int
+	}
+
+	// Fail the last key of every datastore.PutMulti call.
+	expectedErr := errors.New("expected error")
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		me := make(appengine.MultiError, len(keys))
+		me[len(keys)-1] = expectedErr
+		return keys, me
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	count := 1200
+	keys := make([]*datastore.Key, count)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "TestEntity", "", int64(i+1), nil)
+	}
+
+	putKeys, err := nds.PutMulti(c, keys, make([]TestEntity, count))
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if len(me) != count {
+		t.Fatal("incorrect MultiError length", len(me))
+	}
+
+	for i, e := range me {
+		shouldFail := i == 499 || i == 999 || i == count-1
+		if shouldFail && e != expectedErr {
+			t.Fatal("expected error at", i)
+		} else if !shouldFail && e != nil {
+			t.Fatal("unexpected error at", i, e)
+		}
+		if !shouldFail && !putKeys[i].Equal(keys[i]) {
+			t.Fatal("incorrect key at", i)
+		}
+	}
+}
+
+type unmarshallableValue struct {
+	Ch chan int
+}
+
+// unmarshallableEntity saves a property value that cannot be gob encoded.
+type unmarshallableEntity struct{}
+
+func (*unmarshallableEntity) Load([]datastore.Property) error {
+	return nil
+}
+
+func (*unmarshallableEntity) Save() ([]datastore.Property, error) {
+	return []datastore.Property{
+		{Name: "Value", Value: unmarshallableValue{}, NoIndex: true},
+	}, nil
+}
+
+func TestPutMultiValidate(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewIncompleteKey(c, "Entity", nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+		datastore.NewKey(c, "Entity", "", 4, nil),
+	}
+	vals := []interface{}{
+		&testEntity{1},
+		&testEntity{2},
+		&unmarshallableEntity{},
+		(*testEntity)(nil),
+	}
+
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		return nil, errors.New("unexpected datastore put")
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		return errors.New("unexpected memcache set")
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	err := nds.PutMultiValidate(c, keys, vals)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil || me[1] != nil || me[2] == nil ||
+		me[3] != datastore.ErrInvalidEntityType {
+		t.Fatal("incorrect errors", me)
+	}
+
+	if err := nds.PutMultiValidate(c, keys[:2], vals[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.PutMultiValidate(c, keys, vals[:2]); err == nil {
+		t.Fatal("expected length error")
+	}
+}
+
+func TestPutMultiNX(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+
+	if _, err := nds.Put(c, keys[1], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the existing entity and that the others do not exist.
+	response := make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, response); err == nil {
+		t.Fatal("expected error")
+	}
+
+	entities := []testEntity{{10}, {20}, {30}}
+	created, err := nds.PutMultiNX(c, keys, entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created[0] || created[1] || !created[2] {
+		t.Fatal("incorrect created", created)
+	}
+
+	// Memcache must not return the old nonexistent entities.
+	response = make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, response); err != nil {
+		t.Fatal(err)
+	}
+	if response[0].IntVal != 10 || response[1].IntVal != 2 ||
+		response[2].IntVal != 30 {
+		t.Fatal("incorrect entities", response)
+	}
+
+	// Nothing is created the second time.
+	created, err = nds.PutMultiNX(c, keys, []testEntity{{11}, {21}, {31}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ok := range created {
+		if ok {
+			t.Fatal("unexpected created", i)
+		}
+	}
+
+	response = make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, response); err != nil {
+		t.Fatal(err)
+	}
+	if response[0].IntVal != 10 || response[1].IntVal != 2 ||
+		response[2].IntVal != 30 {
+		t.Fatal("incorrect entities", response)
+	}
+
+	// Incomplete keys are rejected.
+	incompleteKeys := []*datastore.Key{
+		datastore.NewIncompleteKey(c, "Entity", nil),
+	}
+	if _, err := nds.PutMultiNX(c, incompleteKeys,
+		[]testEntity{{1}}); err == nil {
+		t.Fatal("expected error")
+	} else if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != datastore.ErrInvalidKey {
+		t.Fatal("expected datastore.ErrInvalidKey", me[0])
+	}
+}
+
+func TestPutMultiNXTransaction(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	var created []bool
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		var err error
+		created, err = nds.PutMultiNX(tc, []*datastore.Key{key},
+			[]testEntity{{1}})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !created[0] {
+		t.Fatal("expected entity to be created")
+	}
+
+	entity := testEntity{}
+	if err := nds.Get(c, key, &entity); err != nil {
+		t.Fatal(err)
+	} else if entity.IntVal != 1 {
+		t.Fatal("incorrect entity", entity)
+	}
+}
+
+func TestPutMultiNXRetry(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	// The first attempt conflicts with a create made outside of it, so the
+	// second attempt finds the entity and puts nothing.
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	puts := 0
+	nds.SetDatastorePutMulti(func(tc context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		puts++
+		if puts == 1 {
+			if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+				return nil, err
+			}
+		}
+		return datastore.PutMulti(tc, keys, vals)
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	created, err := nds.PutMultiNX(c, []*datastore.Key{key},
+		[]testEntity{{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if puts != 1 {
+		t.Fatal("expected one put", puts)
+	}
+	if created[0] {
+		t.Fatal("unexpected created")
+	}
+
+	entity := testEntity{}
+	if err := nds.Get(c, key, &entity); err != nil {
+		t.Fatal(err)
+	} else if entity.IntVal != 2 {
+		t.Fatal("incorrect entity", entity)
+	}
+}
+
+// unregisteredValue is never registered with gob.
+type unregisteredValue struct {
+	IntVal int
+}
+
+// unregisteredEntity saves a property value whose type is not registered.
+type unregisteredEntity struct{}
+
+func (*unregisteredEntity) Load([]datastore.Property) error {
+	return nil
+}
+
+func (*unregisteredEntity) Save() ([]datastore.Property, error) {
+	return []datastore.Property{
+		{Name: "Value", Value: unregisteredValue{1}, NoIndex: true},
+	}, nil
+}
+
+func TestPutMultiValidateCodecError(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	vals := []interface{}{&unregisteredEntity{}, &testEntity{2}}
+
+	err := nds.PutMultiValidate(c, keys, vals)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[1] != nil {
+		t.Fatal("unexpected error", me[1])
+	}
+
+	codecErr, ok := me[0].(*nds.CodecError)
+	if !ok {
+		t.Fatal("expected *nds.CodecError", me[0])
+	}
+	if !codecErr.Key.Equal(keys[0]) || codecErr.Err == nil {
+		t.Fatal("incorrect codec error", codecErr)
+	}
+	if msg := codecErr.Error(); !strings.Contains(msg, keys[0].String()) ||
+		!strings.Contains(msg, "RegisterCacheType") {
+		t.Fatal("incorrect codec error message", msg)
+	}
+}
+
+func TestPutMultiCAS(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Version int
+		Val     string
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2], []testEntity{
+		{Version: 1, Val: "a"},
+		{Version: 5, Val: "b"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the entities so the applied puts are seen to invalidate them.
+	if err := nds.GetMulti(c, keys[:2], make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := nds.PutMultiCAS(c, keys, []*testEntity{
+		{Version: 1, Val: "c"},
+		{Version: 4, Val: "d"},
+		{Version: 0, Val: "e"},
+	}, "Version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !applied[0] || applied[1] || !applied[2] {
+		t.Fatal("incorrect applied", applied)
+	}
+
+	entities := make([]testEntity, 3)
+	if err := nds.GetMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	expected := []testEntity{
+		{Version: 2, Val: "c"},
+		{Version: 5, Val: "b"},
+		{Version: 1, Val: "e"},
+	}
+	if !reflect.DeepEqual(entities, expected) {
+		t.Fatal("incorrect entities", entities)
+	}
+
+	if _, err := nds.PutMultiCAS(c, keys, make([]testEntity, 3),
+		"Val"); err == nil {
+		t.Fatal("expected error for non int version field")
+	}
+	if _, err := nds.PutMultiCAS(c, keys, make([]testEntity, 3),
+		"Missing"); err == nil {
+		t.Fatal("expected error for missing version field")
+	}
+}
+
+func TestPutMultiCASInvalidVersionField(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type versioned struct {
+		Version int
+	}
+	type testEntity struct {
+		*versioned
+		version int
+	}
+
+	keys := []*datastore.Key{datastore.NewKey(c, "Entity", "", 1, nil)}
+	if _, err := nds.PutMultiCAS(c, keys, make([]testEntity, 1),
+		"version"); err == nil {
+		t.Fatal("expected error for unexported version field")
+	}
+	if _, err := nds.PutMultiCAS(c, keys, make([]testEntity, 1),
+		"Version"); err == nil {
+		t.Fatal("expected error for version field of embedded pointer")
+	}
+}
+
+func TestPutMultiCASRetry(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Version int
+		Val     string
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key,
+		&testEntity{Version: 1, Val: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first attempt conflicts with a write made outside of it that
+	// changes the version, so the second attempt rejects the entity.
+	puts := 0
+	nds.SetDatastorePutMulti(func(tc context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		puts++
+		if puts == 1 {
+			if _, err := datastore.Put(c, key,
+				&testEntity{Version: 2, Val: "b"}); err != nil {
+				return nil, err
+			}
+		}
+		return datastore.PutMulti(tc, keys, vals)
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	applied, err := nds.PutMultiCAS(c, []*datastore.Key{key},
+		[]testEntity{{Version: 1, Val: "c"}}, "Version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if puts != 1 {
+		t.Fatal("expected one put", puts)
+	}
+	if applied[0] {
+		t.Fatal("unexpected applied")
+	}
+
+	entity := testEntity{}
+	if err := nds.Get(c, key, &entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Version != 2 || entity.Val != "b" {
+		t.Fatal("incorrect entity", entity)
+	}
+}
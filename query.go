@@ -0,0 +1,409 @@
+package nds
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// cachedQuery is the memcache value of a query result cached by GetAll.
+// Entities are marshalled in the same way as cached entities so they use the
+// codec set with SetCodec.
+type cachedQuery struct {
+	Keys     []*datastore.Key
+	Entities [][]byte
+}
+
+// GetAll runs q, appending its results to dst and returning their keys just
+// like q.GetAll, but caches the results in memcache for ttl. It is intended
+// for queries that are run often and whose results can be up to ttl old,
+// such as the projection queries of list views. Results are cached under a
+// hash of the whole query, including its projected properties, and the
+// namespace of c. Each result of a projection on a multi-valued property is
+// cached separately so the results are the same as those of the datastore.
+//
+// Cached results are not invalidated by Put, PutMulti, Delete and DeleteMulti.
+// This is no worse than the eventual consistency of queries without an
+// ancestor, but ancestor queries lose their strong consistency. Results too
+// large for one memcache item are not cached. ttl must be at least one second
+// as that is the memcache expiration granularity.
+//
+// dst must be a *[]S, *[]*S or *[]P, for some struct type S or some
+// non-interface non-pointer type P such that P or *P implements
+// datastore.PropertyLoadSaver. dst can be nil for keys only queries. GetAll
+// does not cache results within transactions or contexts created with
+// WithNoCache. Use WithQueryEntityCache to also cache each entity under its
+// key.
+func GetAll(c context.Context, q *datastore.Query, dst interface{},
+	ttl time.Duration) ([]*datastore.Key, error) {
+
+	if ttl < time.Second {
+		return nil, errors.New("nds: query ttl is less than a second")
+	}
+
+	var dv reflect.Value
+	if dst != nil {
+		var err error
+		if dv, err = checkQueryDst(dst); err != nil {
+			return nil, err
+		}
+	}
+
+	_, useDatastore := transactionFromContext(c)
+	if useDatastore || optionsFromContext(c).noCache ||
+		!memcacheAllowed() {
+		return datastoreGetAll(q, c, dst)
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	memcacheKey, ok := createQueryKey(c, "query", q)
+	if !ok {
+		return datastoreGetAll(q, c, dst)
+	}
+	items, err := tracedMemcacheGetMulti(memcacheCtx, []string{memcacheKey})
+	if err != nil {
+		logEvent(c, LogWarning, "nds:GetAll GetMulti", "error", err)
+	} else if item, ok := items[memcacheKey]; ok && item.Flags == queryItem {
+		cq := cachedQuery{}
+		err := gob.NewDecoder(bytes.NewReader(item.Value)).Decode(&cq)
+		if err == nil {
+			// Results cached by another codec or cache version are misses.
+			var keys []*datastore.Key
+			keys, err = loadQueryResult(cq, dv)
+			if _, ok := err.(*CodecError); !ok {
+				return keys, err
+			}
+		}
+		logEvent(c, LogWarning, "nds:GetAll decode", "error", err)
+	}
+
+	pls := []datastore.PropertyList{}
+	keys, err := datastoreGetAll(q, c, &pls)
+	if err != nil {
+		return nil, err
+	}
+
+	cq := cachedQuery{
+		Keys:     keys,
+		Entities: make([][]byte, len(pls)),
+	}
+	var noCache []string
+	if dv.IsValid() {
+		noCache = noCacheProperties(
+			reflect.New(dv.Elem().Type().Elem()).Elem())
+	}
+	for i, pl := range pls {
+		pl = removeNoCacheProperties(pl,
+			keyNoCacheProperties(keys[i], noCache))
+		if cq.Entities[i], err = marshal(pl); err != nil {
+			return nil, &CodecError{keys[i], err}
+		}
+	}
+
+	if optionsFromContext(c).seedEntities && queryReturnsEntities(q) {
+		if err := addEntityItems(c, memcacheCtx, keys, cq.Entities,
+			queryEntityExpiration(c)); err != nil {
+			logEvent(c, LogWarning, "nds:GetAll AddMulti", "error", err)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(&cq); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() > memcacheMaxItemSize {
+		logEvent(c, LogDebug, "nds:GetAll result too large to cache",
+			"size", buf.Len())
+	} else if err := tracedMemcacheSetMulti(memcacheCtx, []*memcache.Item{{
+		Key:        memcacheKey,
+		Flags:      queryItem,
+		Value:      buf.Bytes(),
+		Expiration: ttl,
+	}}); err != nil {
+		logEvent(c, LogWarning, "nds:GetAll SetMulti", "error", err)
+	}
+
+	return loadQueryResult(cq, dv)
+}
+
+// checkQueryDst checks that dst is a valid query destination and returns its
+// value.
+func checkQueryDst(dst interface{}) (reflect.Value, error) {
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() ||
+		dv.Elem().Kind() != reflect.Slice {
+		return dv, errors.New("nds: dst is not a slice pointer")
+	}
+	switch checkValueType(dv.Elem().Type().Elem()) {
+	case valueTypeStruct, valueTypeStructPtr, valueTypePropertyLoadSaver:
+		return dv, nil
+	}
+	return dv, errors.New("nds: unsupported dst type")
+}
+
+// GetMultiWithCursor gets a page of the results of q, such as the entities of
+// a large entity group. It runs q as a keys only query, then gets the entities
+// of the returned keys with GetMulti so they are read from and saved to the
+// cache. The entities are appended to dst, which must be of a type accepted by
+// GetAll other than nil, and their keys are returned along with the cursor
+// after the page.
+//
+// Set the page size with q.Limit and pass the returned cursor to q.Start to
+// get the next page. The cursor is that of the keys only query so it is the
+// same whether or not the entities are cached. Use an ancestor query so the
+// page is strongly consistent, as the keys of other queries might not yet
+// reflect recent writes.
+//
+// If GetMulti fails for some keys, such as for an entity deleted after the
+// query ran, the appengine.MultiError of GetMulti is returned along with the
+// keys, cursor and every entity in dst, aligned with the keys.
+func GetMultiWithCursor(c context.Context, q *datastore.Query,
+	dst interface{}) ([]*datastore.Key, datastore.Cursor, error) {
+
+	dv, err := checkQueryDst(dst)
+	if err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+
+	keys := []*datastore.Key{}
+	t := q.KeysOnly().Run(c)
+	for {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, datastore.Cursor{}, err
+		}
+		keys = append(keys, key)
+	}
+
+	cursor, err := t.Cursor()
+	if err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+
+	vals := reflect.MakeSlice(dv.Elem().Type(), len(keys), len(keys))
+	err = GetMulti(c, keys, vals.Interface())
+	dv.Elem().Set(reflect.AppendSlice(dv.Elem(), vals))
+	return keys, cursor, err
+}
+
+// loadQueryResult appends the entities of cq to dv, if it is valid, and
+// returns the keys of cq. Like q.GetAll it loads every entity even if one
+// gives datastore.ErrFieldMismatch, which is then returned.
+func loadQueryResult(cq cachedQuery, dv reflect.Value) (
+	[]*datastore.Key, error) {
+
+	if !dv.IsValid() {
+		return cq.Keys, nil
+	}
+
+	var errFieldMismatch error
+	sv := dv.Elem()
+	elemType := sv.Type().Elem()
+	for i, data := range cq.Entities {
+		pl := datastore.PropertyList{}
+		if err := unmarshal(data, &pl); err != nil {
+			return nil, &CodecError{cq.Keys[i], err}
+		}
+
+		ev := reflect.New(elemType).Elem()
+		if err := setValue(ev, pl); err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return nil, err
+			} else if errFieldMismatch == nil {
+				errFieldMismatch = err
+			}
+		}
+		sv = reflect.Append(sv, ev)
+	}
+	dv.Elem().Set(sv)
+	return cq.Keys, errFieldMismatch
+}
+
+// createQueryKey creates the memcache key of the cached kind of result of q,
+// such as "count". The colon can never appear in an encoded datastore key so
+// query keys and entity keys never collide. It returns false if the fields of
+// datastore.Query are not those it knows how to describe, in which case the
+// result of q must not be cached.
+func createQueryKey(c context.Context, kind string,
+	q *datastore.Query) (string, bool) {
+
+	if !queryFieldsKnown {
+		logEvent(c, LogWarning, "nds:createQueryKey unknown query fields")
+		return "", false
+	}
+
+	buf := &bytes.Buffer{}
+
+	// Queries without an ancestor run in the namespace of c.
+	buf.WriteString(datastore.NewKey(c, "Count", "", 1, nil).Namespace())
+	buf.WriteByte(0)
+	writeQueryValue(buf, reflect.ValueOf(q))
+
+	hash := sha1.Sum(buf.Bytes())
+	return limitMemcacheKey(optionsFromContext(c).memcachePrefix + kind + ":" +
+		hex.EncodeToString(hash[:])), true
+}
+
+// queryField is the name and kind of a field of datastore.Query or of its
+// filters.
+type queryField struct {
+	name string
+	kind reflect.Kind
+}
+
+// queryFields and filterFields are the fields of datastore.Query and of its
+// filters as of the App Engine SDK in use. writeQueryValue describes a query
+// from its fields and reads filter values through their address, so queries
+// are only cached while the fields are the same.
+var (
+	queryFields = []queryField{
+		{"kind", reflect.String},
+		{"ancestor", reflect.Ptr},
+		{"filter", reflect.Slice},
+		{"order", reflect.Slice},
+		{"projection", reflect.Slice},
+		{"distinct", reflect.Bool},
+		{"distinctOn", reflect.Slice},
+		{"keysOnly", reflect.Bool},
+		{"eventual", reflect.Bool},
+		{"limit", reflect.Int32},
+		{"offset", reflect.Int32},
+		{"count", reflect.Int32},
+		{"start", reflect.Ptr},
+		{"end", reflect.Ptr},
+		{"err", reflect.Interface},
+	}
+	filterFields = []queryField{
+		{"FieldName", reflect.String},
+		{"Op", reflect.Int},
+		{"Value", reflect.Interface},
+	}
+
+	queryFieldsKnown = hasQueryFields(reflect.TypeOf(datastore.Query{}))
+)
+
+// hasQueryFields reports whether the struct type t has exactly the fields of
+// queryFields, and its filters those of filterFields.
+func hasQueryFields(t reflect.Type) bool {
+	if !hasFields(t, queryFields) {
+		return false
+	}
+	filter, _ := t.FieldByName("filter")
+	return filter.Type.Elem().Kind() == reflect.Struct &&
+		hasFields(filter.Type.Elem(), filterFields)
+}
+
+func hasFields(t reflect.Type, fields []queryField) bool {
+	if t.Kind() != reflect.Struct || t.NumField() != len(fields) {
+		return false
+	}
+	for i, f := range fields {
+		if field := t.Field(i); field.Name != f.name ||
+			field.Type.Kind() != f.kind {
+			return false
+		}
+	}
+	return true
+}
+
+// writeQueryValue writes a description of v to buf. datastore.Query has no
+// exported fields so reflection is used to describe its kind, ancestor,
+// filters, orders, projection, limit, offset and cursors, which must be
+// checked with hasQueryFields first. Pointers are
+// followed rather than written so the description is the same on every
+// instance. Times are written as Unix nanoseconds, as equal times can differ in
+// their location and monotonic clock reading.
+func writeQueryValue(buf *bytes.Buffer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("nil")
+			return
+		}
+		if v.Kind() == reflect.Interface {
+			buf.WriteString(v.Elem().Type().String())
+		}
+		buf.WriteByte('(')
+		if t, ok := queryTime(v); ok {
+			buf.WriteString(strconv.FormatInt(t.UTC().UnixNano(), 10))
+		} else {
+			writeQueryValue(buf, v.Elem())
+		}
+		buf.WriteByte(')')
+	case reflect.Struct:
+		if t, ok := queryTime(v); ok {
+			buf.WriteString(strconv.FormatInt(t.UTC().UnixNano(), 10))
+			return
+		}
+		buf.WriteByte('{')
+		for i := 0; i < v.NumField(); i++ {
+			buf.WriteString(v.Type().Field(i).Name)
+			buf.WriteByte(':')
+			writeQueryValue(buf, v.Field(i))
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('}')
+	case reflect.Slice, reflect.Array:
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			writeQueryValue(buf, v.Index(i))
+			buf.WriteByte(',')
+		}
+		buf.WriteByte(']')
+	case reflect.Map:
+		// Map iteration order is random so only the size is stable.
+		fmt.Fprintf(buf, "map%d", v.Len())
+	case reflect.String:
+		buf.WriteString(strconv.Quote(v.String()))
+	case reflect.Bool:
+		buf.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		buf.WriteString(strconv.FormatFloat(v.Float(), 'g', -1, 64))
+	default:
+		buf.WriteString(v.Kind().String())
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// queryTime returns the time.Time held by v, or by the interface v, if there
+// is one. The values of unexported fields cannot be used, so addressable
+// values are read through their address instead.
+func queryTime(v reflect.Value) (time.Time, bool) {
+	if v.Kind() == reflect.Interface && v.Elem().Type() != timeType ||
+		v.Kind() != reflect.Interface && v.Type() != timeType {
+		return time.Time{}, false
+	}
+	if !v.CanInterface() {
+		if !v.CanAddr() {
+			return time.Time{}, false
+		}
+		v = reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+	}
+	t, ok := v.Interface().(time.Time)
+	return t, ok
+}
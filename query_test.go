@@ -0,0 +1,267 @@
+package nds_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetAllProjection(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+		Tags   []string
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{
+		{1, []string{"a", "b"}},
+		{2, []string{"c"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	type projection struct {
+		Tags string
+	}
+
+	q := datastore.NewQuery("Entity").Ancestor(parent).Project("Tags").
+		Order("Tags")
+
+	// Get from the datastore.
+	var projections []projection
+	resultKeys, err := nds.GetAll(c, q, &projections, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(resultKeys []*datastore.Key, projections []projection) {
+		expected := []string{"a", "b", "c"}
+		if len(projections) != len(expected) ||
+			len(resultKeys) != len(expected) {
+			t.Fatal("incorrect results", resultKeys, projections)
+		}
+		for i, p := range projections {
+			if p.Tags != expected[i] {
+				t.Fatal("incorrect projection", projections)
+			}
+		}
+		if !resultKeys[0].Equal(keys[0]) || !resultKeys[1].Equal(keys[0]) ||
+			!resultKeys[2].Equal(keys[1]) {
+			t.Fatal("incorrect keys", resultKeys)
+		}
+	}
+	check(resultKeys, projections)
+
+	// Get from memcache.
+	nds.SetDatastoreGetAll(func(q *datastore.Query, c context.Context,
+		dst interface{}) ([]*datastore.Key, error) {
+		return nil, errors.New("unexpected datastore query")
+	})
+	defer nds.SetDatastoreGetAll((*datastore.Query).GetAll)
+
+	projections = nil
+	resultKeys, err = nds.GetAll(c, q, &projections, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(resultKeys, projections)
+
+	// Property lists can be got too.
+	var pls []datastore.PropertyList
+	if _, err := nds.GetAll(c, q, &pls, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(pls) != 3 || pls[2][0].Name != "Tags" || pls[2][0].Value != "c" {
+		t.Fatal("incorrect property lists", pls)
+	}
+
+	// A different projection is a different query.
+	if _, err := nds.GetAll(c, q.Project("IntVal"), &projections,
+		time.Minute); err == nil {
+		t.Fatal("expected datastore query")
+	}
+}
+
+func TestGetAllArgs(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	q := datastore.NewQuery("Entity")
+	if _, err := nds.GetAll(c, q, nil, time.Millisecond); err == nil {
+		t.Fatal("expected ttl error")
+	}
+
+	var notSlice int
+	if _, err := nds.GetAll(c, q, &notSlice, time.Minute); err == nil {
+		t.Fatal("expected dst error")
+	}
+
+	var interfaces []interface{}
+	if _, err := nds.GetAll(c, q, &interfaces, time.Minute); err == nil {
+		t.Fatal("expected dst type error")
+	}
+}
+
+func TestGetMultiWithCursor(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := make([]*datastore.Key, 5)
+	entities := make([]testEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), parent)
+		entities[i] = testEntity{int64(i + 1)}
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	getPages := func() ([]*datastore.Key, []testEntity) {
+		var resultKeys []*datastore.Key
+		var results []testEntity
+		q := datastore.NewQuery("Entity").Ancestor(parent).Limit(2)
+		for {
+			page := []testEntity{}
+			pageKeys, cursor, err := nds.GetMultiWithCursor(c, q, &page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pageKeys) != len(page) || len(page) > 2 {
+				t.Fatal("incorrect page", pageKeys, page)
+			}
+			if len(page) == 0 {
+				return resultKeys, results
+			}
+			resultKeys = append(resultKeys, pageKeys...)
+			results = append(results, page...)
+			q = q.Start(cursor)
+		}
+	}
+
+	check := func(resultKeys []*datastore.Key, results []testEntity) {
+		if len(results) != len(keys) {
+			t.Fatal("incorrect results", results)
+		}
+		for i, result := range results {
+			if !resultKeys[i].Equal(keys[i]) || result.IntVal != int64(i+1) {
+				t.Fatal("incorrect result", resultKeys[i], result)
+			}
+		}
+	}
+	check(getPages())
+
+	// The entities are now got from memcache.
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		return errors.New("unexpected datastore get")
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+	check(getPages())
+
+	if _, _, err := nds.GetMultiWithCursor(c,
+		datastore.NewQuery("Entity"), nil); err == nil {
+		t.Fatal("expected dst error")
+	}
+}
+
+func TestGetAllQueryEntityCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := datastore.NewQuery("Entity").Ancestor(parent)
+	var entities []testEntity
+	if _, err := nds.GetAll(nds.WithQueryEntityCache(c), q, &entities,
+		time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		t.Fatal("entities not got from memcache")
+		return nil
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	entities = make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].IntVal != 1 || entities[1].IntVal != 2 {
+		t.Fatal("incorrect entities", entities)
+	}
+}
+
+func TestQueryKeyTime(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	// Equal times in other locations and without a monotonic clock reading
+	// create the same query key.
+	now := time.Now()
+	other := now.Round(0).In(time.FixedZone("Other", 60*60))
+	key := nds.CreateQueryKey(c, "query",
+		datastore.NewQuery("Entity").Filter("Time =", now))
+	if otherKey := nds.CreateQueryKey(c, "query",
+		datastore.NewQuery("Entity").Filter("Time =", other)); otherKey != key {
+		t.Fatal("expected the same query key", otherKey, key)
+	}
+
+	later := now.Add(time.Nanosecond)
+	if laterKey := nds.CreateQueryKey(c, "query",
+		datastore.NewQuery("Entity").Filter("Time =", later)); laterKey == key {
+		t.Fatal("expected a different query key")
+	}
+}
+
+func TestQueryFields(t *testing.T) {
+	// Query keys describe datastore.Query from its unexported fields, so a
+	// change to them disables the query cache rather than give wrong keys.
+	if !nds.HasQueryFields(reflect.TypeOf(datastore.Query{})) {
+		t.Fatal("unknown datastore.Query fields")
+	}
+
+	type filter struct {
+		FieldName string
+		Op        int
+		Value     interface{}
+	}
+	type query struct {
+		kind     string
+		ancestor *datastore.Key
+		filter   []filter
+	}
+	if nds.HasQueryFields(reflect.TypeOf(query{})) {
+		t.Fatal("expected unknown query fields")
+	}
+}
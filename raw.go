@@ -0,0 +1,122 @@
+package nds
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// GetMultiRaw gets the entities of keys in the same way as GetMulti and
+// returns each one marshalled exactly as nds stores entities in memcache,
+// including the codec and cache version header, so they can be copied to
+// another memcache with PrimeCacheRaw. Cache hits return the bytes held by
+// memcache unchanged, and entities read from the datastore the bytes cached
+// for them. Entities larger than a memcache item are still returned whole.
+//
+// Errors are returned in an appengine.MultiError aligned with keys, and the
+// data of keys giving an error is nil. Keys with no entity give
+// datastore.ErrNoSuchEntity and entities that cannot be marshalled give a
+// *CodecError.
+func GetMultiRaw(c context.Context, keys []*datastore.Key) ([][]byte,
+	error) {
+
+	pls := make([]datastore.PropertyList, len(keys))
+	data := make([][]byte, len(keys))
+	err := getMultiSources(c, keys, pls, getMultiExtras{data: data})
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	if !ok {
+		me = make(appengine.MultiError, len(keys))
+	}
+
+	errsNil := true
+	for i := range keys {
+		if me[i] != nil {
+			data[i] = nil
+		} else if data[i] == nil {
+			// Entities got without memcache, such as from the local cache,
+			// are marshalled as they would be cached.
+			pl := removeNoCacheProperties(pls[i],
+				keyNoCacheProperties(keys[i], nil))
+			if data[i], err = marshal(pl); err != nil {
+				me[i] = &CodecError{keys[i], err}
+			}
+		}
+		if me[i] != nil {
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return data, nil
+	}
+	return data, me
+}
+
+// PrimeCacheRaw stores entities marshalled by GetMultiRaw in memcache under
+// keys, such as to seed a standby memcache in another region. Like Run, an
+// entity is only stored if nothing is cached for its key, so no cached entity
+// or lock taken by a concurrent Put or Delete is ever overwritten. An entity
+// that changes after it was got by GetMultiRaw can therefore be cached stale,
+// so, as with Run, entities are cached for the entity expiration of c or five
+// minutes, whichever is shorter. Entities too large for a single memcache item
+// are not stored, as chunks can only be stored under a lock, and neither are
+// those larger than the size set with SetMaxCachedEntitySize.
+//
+// Entities that the codec and cache version in use cannot unmarshal are not
+// stored either and give a *CodecError in an appengine.MultiError aligned with
+// keys.
+func PrimeCacheRaw(c context.Context, keys []*datastore.Key,
+	data [][]byte) error {
+
+	if len(keys) != len(data) {
+		return errors.New("nds: keys and data slices have different length")
+	}
+
+	memcacheCtx, err := memcacheContext(c)
+	if err != nil {
+		return err
+	}
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	addKeys := make([]*datastore.Key, 0, len(keys))
+	addData := make([][]byte, 0, len(keys))
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			me[i], errsNil = datastore.ErrInvalidKey, false
+			continue
+		}
+		pl := datastore.PropertyList{}
+		if err := unmarshal(data[i], &pl); err != nil {
+			me[i], errsNil = &CodecError{key, err}, false
+			continue
+		}
+
+		// Entities from a memcache that did not register the nocache
+		// properties of their kinds still have them.
+		entity := data[i]
+		if noCache := keyNoCacheProperties(key, nil); len(noCache) > 0 {
+			var err error
+			pl = removeNoCacheProperties(pl, noCache)
+			if entity, err = marshal(pl); err != nil {
+				me[i], errsNil = &CodecError{key, err}, false
+				continue
+			}
+		}
+		addKeys = append(addKeys, key)
+		addData = append(addData, entity)
+	}
+
+	if err := addEntityItems(c, memcacheCtx, addKeys, addData,
+		queryEntityExpiration(c)); err != nil {
+		return err
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
@@ -0,0 +1,148 @@
+package nds_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestGetMultiRawPrimeCacheRaw(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := nds.GetMultiRaw(c, keys)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if data[0] == nil || data[1] != nil {
+		t.Fatal("incorrect data", data)
+	}
+
+	if err := memcache.Flush(c); err != nil {
+		t.Fatal(err)
+	}
+
+	err = nds.PrimeCacheRaw(c, keys, [][]byte{data[0], []byte("bad")})
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if _, ok := me[1].(*nds.CodecError); me[0] != nil || !ok {
+		t.Fatal("incorrect errors", me)
+	}
+
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		t.Fatal("entity not got from memcache")
+		return nil
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	entity := &testEntity{}
+	if err := nds.Get(c, keys[0], entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 1 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	// Cached entities are never overwritten.
+	if err := nds.PrimeCacheRaw(c, keys[:1], data[:1]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetMultiRawCacheHit(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		StringVal string `datastore:",noindex"`
+	}
+
+	// Cache a compressible entity uncompressed.
+	nds.SetCompressionThreshold(-1)
+	defer nds.SetCompressionThreshold(16 << 10)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key,
+		&testEntity{strings.Repeat("a", 1000)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached bytes are returned, not the entity marshalled again.
+	nds.SetCompressionThreshold(0)
+	data, err := nds.GetMultiRaw(c, []*datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[0], item.Value) {
+		t.Fatal("expected the cached bytes")
+	}
+}
+
+func TestPrimeCacheRawExpiration(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := nds.GetMultiRaw(c, []*datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := memcache.Flush(c); err != nil {
+		t.Fatal(err)
+	}
+
+	var expirations []time.Duration
+	nds.SetMemcacheAddMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		for _, item := range items {
+			expirations = append(expirations, item.Expiration)
+		}
+		return memcache.AddMulti(c, items)
+	})
+	defer nds.SetMemcacheAddMulti(memcache.AddMulti)
+
+	// Primed entities can be stale so they always expire.
+	if err := nds.PrimeCacheRaw(c, []*datastore.Key{key}, data); err != nil {
+		t.Fatal(err)
+	}
+	if len(expirations) != 1 || expirations[0] != 5*time.Minute {
+		t.Fatal("incorrect expirations", expirations)
+	}
+}
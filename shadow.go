@@ -0,0 +1,91 @@
+package nds
+
+import (
+	"math/rand"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// SetShadowReadRate sets the fraction of entities served from memcache by Get
+// and GetMulti that are also read from the datastore to check that memcache
+// was not stale. It is meant for debugging suspected invalidation bugs and
+// adds a datastore read to sampled calls, so keep the rate low. The cached
+// and datastore entities are compared as datastore.PropertyList values. Each
+// difference is logged as a LogWarning message and counted in the
+// ShadowReadMismatches of Stats.
+//
+// A write made between the memcache and datastore reads also gives a
+// difference, so only differences that persist point to a bug. A rate of zero
+// or less, the default, turns shadow reads off and a rate of one or more reads
+// every cached entity again.
+func SetShadowReadRate(rate float64) {
+	updateConfig(func(cfg *config) {
+		cfg.shadowReadRate = rate
+	})
+}
+
+// shadowRead reads a sample of the entities of cacheItems served from memcache
+// from the datastore again and compares them. It returns the number of
+// entities read and how many of them differed.
+func shadowRead(c context.Context, cacheItems []cacheItem) (int, int) {
+	rate := loadConfig().shadowReadRate
+	if rate <= 0 {
+		return 0, 0
+	}
+
+	keys := []*datastore.Key{}
+	cached := []datastore.PropertyList{}
+	noCache := [][]string{}
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state != done || cacheItem.source != SourceMemcache ||
+			cacheItem.pl == nil {
+			continue
+		}
+		if rate < 1 && rand.Float64() >= rate {
+			continue
+		}
+		keys = append(keys, cacheItem.key)
+		cached = append(cached, cacheItem.pl)
+		noCache = append(noCache, cacheItem.noCache)
+	}
+	if len(keys) == 0 {
+		return 0, 0
+	}
+
+	vals := make([]datastore.PropertyList, len(keys))
+	var me appengine.MultiError
+	if err := tracedDatastoreGetMulti(c, keys, vals); err == nil {
+		me = make(appengine.MultiError, len(keys))
+	} else if e, ok := err.(appengine.MultiError); ok {
+		me = e
+	} else {
+		logEvent(c, LogWarning, "nds:shadowRead GetMulti", "error", err)
+		return 0, 0
+	}
+
+	reads, mismatches := 0, 0
+	for i, key := range keys {
+		switch me[i] {
+		case nil:
+			reads++
+			pl := removeNoCacheProperties(vals[i], noCache[i])
+			if !reflect.DeepEqual(cached[i], pl) {
+				mismatches++
+				logEvent(c, LogWarning, "nds:shadowRead entity mismatch",
+					"key", key)
+			}
+		case datastore.ErrNoSuchEntity:
+			reads++
+			mismatches++
+			logEvent(c, LogWarning, "nds:shadowRead entity mismatch",
+				"key", key, "error", me[i])
+		default:
+			logEvent(c, LogWarning, "nds:shadowRead GetMulti",
+				"key", key, "error", me[i])
+		}
+	}
+	return reads, mismatches
+}
@@ -0,0 +1,78 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestSetShadowReadRate(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	sl := &statsLog{}
+	nds.SetStatsRecorder(sl.record)
+	defer nds.SetStatsRecorder(nil)
+
+	nds.SetShadowReadRate(1)
+	defer nds.SetShadowReadRate(0)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the entity. Datastore reads are not shadow read.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.ShadowReads != 0 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.CacheHits != 1 || s.ShadowReads != 1 ||
+		s.ShadowReadMismatches != 0 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+
+	// Change the entity without invalidating memcache.
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 1 {
+		t.Fatalf("expected cached entity, got %+v", entity)
+	}
+	if s := sl.last(); s.ShadowReads != 1 || s.ShadowReadMismatches != 1 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+
+	if err := datastore.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.ShadowReads != 1 || s.ShadowReadMismatches != 1 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+
+	nds.SetShadowReadRate(0)
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.CacheHits != 1 || s.ShadowReads != 0 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+}
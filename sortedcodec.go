@@ -0,0 +1,68 @@
+package nds
+
+import (
+	"sort"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// SortedCodec is a Codec that sorts the properties of entities by name before
+// marshalling them with Codec, so that entities holding the same properties
+// always marshal to the same bytes whatever the order of their properties. It
+// suits tools that address or deduplicate cached entities by their bytes. Set
+// it with SetCodec(SortedCodec{}).
+//
+// The values of a property with several values keep their order, as do the
+// properties of nested entities once sorted in the same way. A nil Codec uses
+// JSONCodec, as the default gob codec numbers the types it encodes in the order
+// a process first encodes them, so its bytes can differ between processes.
+// Compressed entities are only the same as long as the compress/flate package
+// is, so disable compression with SetCompressionThreshold for bytes that must
+// not change between Go releases.
+//
+// Sorted entities unmarshal as usual so the ID of Codec is used, and entities
+// cached by Codec itself are still read.
+type SortedCodec struct {
+	Codec Codec
+}
+
+func (s SortedCodec) codec() Codec {
+	if s.Codec == nil {
+		return JSONCodec{}
+	}
+	return s.Codec
+}
+
+// ID returns the ID of Codec.
+func (s SortedCodec) ID() byte {
+	return s.codec().ID()
+}
+
+// Marshal marshals a sorted copy of pl with Codec. pl is not modified.
+func (s SortedCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	return s.codec().Marshal(sortProperties(pl))
+}
+
+// Unmarshal unmarshals data with Codec.
+func (s SortedCodec) Unmarshal(data []byte, pl *datastore.PropertyList) error {
+	return s.codec().Unmarshal(data, pl)
+}
+
+// sortProperties returns a copy of ps, and of the properties of any nested
+// entities, stably sorted by name.
+func sortProperties(ps []datastore.Property) []datastore.Property {
+	sorted := make([]datastore.Property, len(ps))
+	copy(sorted, ps)
+	for i, p := range sorted {
+		if e, ok := p.Value.(*datastore.Entity); ok && e != nil {
+			sorted[i].Value = &datastore.Entity{
+				Key:        e.Key,
+				Properties: sortProperties(e.Properties),
+			}
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
@@ -0,0 +1,75 @@
+package nds_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestSortedCodec(t *testing.T) {
+	pl := datastore.PropertyList{
+		{Name: "B", Value: "b1", Multiple: true},
+		{Name: "A", Value: int64(1)},
+		{Name: "B", Value: "b2", Multiple: true},
+		{Name: "E", Value: &datastore.Entity{
+			Properties: []datastore.Property{
+				{Name: "Y", Value: true},
+				{Name: "X", Value: 1.5},
+			},
+		}},
+	}
+	reordered := datastore.PropertyList{
+		{Name: "E", Value: &datastore.Entity{
+			Properties: []datastore.Property{
+				{Name: "X", Value: 1.5},
+				{Name: "Y", Value: true},
+			},
+		}},
+		{Name: "B", Value: "b1", Multiple: true},
+		{Name: "B", Value: "b2", Multiple: true},
+		{Name: "A", Value: int64(1)},
+	}
+
+	codec := nds.SortedCodec{}
+	if id := codec.ID(); id != (nds.JSONCodec{}).ID() {
+		t.Fatalf("expected the JSONCodec ID, got %d", id)
+	}
+
+	data, err := codec.Marshal(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reorderedData, err := codec.Marshal(reordered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, reorderedData) {
+		t.Fatalf("expected equal bytes, got %s and %s", data, reorderedData)
+	}
+	if pl[0].Name != "B" || pl[3].Value.(*datastore.Entity).
+		Properties[0].Name != "Y" {
+		t.Fatal("pl was modified")
+	}
+
+	got := datastore.PropertyList{}
+	if err := codec.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := datastore.PropertyList{
+		{Name: "A", Value: int64(1)},
+		{Name: "B", Value: "b1", Multiple: true},
+		{Name: "B", Value: "b2", Multiple: true},
+		{Name: "E", Value: &datastore.Entity{
+			Properties: []datastore.Property{
+				{Name: "X", Value: 1.5},
+				{Name: "Y", Value: true},
+			},
+		}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+}
@@ -0,0 +1,91 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Source describes where GetMultiSource got the entity of a key from.
+type Source int
+
+const (
+	// SourceNone means the entity was not got because of an error.
+	SourceNone Source = iota
+
+	// SourceLocalCache means the entity was got from the cache of a context
+	// created with WithLocalCache.
+	SourceLocalCache
+
+	// SourceMemcache means the entity was got from memcache.
+	SourceMemcache
+
+	// SourceDatastore means the entity was read from the datastore.
+	SourceDatastore
+
+	// SourceNotFound means there is no entity for the key, whether memcache
+	// or the datastore reported it.
+	SourceNotFound
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceNone:
+		return "None"
+	case SourceLocalCache:
+		return "LocalCache"
+	case SourceMemcache:
+		return "Memcache"
+	case SourceDatastore:
+		return "Datastore"
+	case SourceNotFound:
+		return "NotFound"
+	default:
+		return "Unknown"
+	}
+}
+
+// GetMultiSource works just like GetMulti but also returns where the entity of
+// each key was got from. The returned slice is always aligned with keys, even
+// if an error is returned. Keys that could not be got are SourceNone.
+func GetMultiSource(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]Source, error) {
+
+	sources := make([]Source, len(keys))
+	err := getMultiSources(c, keys, vals, getMultiExtras{sources: sources})
+	return sources, err
+}
+
+// resultSource returns the Source of cacheItem once getMulti has finished.
+func (cacheItem *cacheItem) resultSource() Source {
+	switch {
+	case cacheItem.err == nil:
+		return cacheItem.source
+	case cacheItem.err == datastore.ErrNoSuchEntity:
+		return SourceNotFound
+	case isFieldMismatch(cacheItem.err):
+		// The entity was still loaded as far as possible.
+		return cacheItem.source
+	}
+	return SourceNone
+}
+
+// setDatastoreSources sets sources for keys read straight from the datastore
+// with the result err.
+func setDatastoreSources(sources []Source, err error) {
+	me, isMultiErr := err.(appengine.MultiError)
+	for i := range sources {
+		switch {
+		case err == nil:
+			sources[i] = SourceDatastore
+		case !isMultiErr:
+			sources[i] = SourceNone
+		case me[i] == nil:
+			sources[i] = SourceDatastore
+		case me[i] == datastore.ErrNoSuchEntity:
+			sources[i] = SourceNotFound
+		default:
+			sources[i] = SourceNone
+		}
+	}
+}
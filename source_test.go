@@ -0,0 +1,90 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetMultiSource(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, []*datastore.Key{keys[0], keys[2]},
+		[]testEntity{{1}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the first key only.
+	if err := nds.Get(c, keys[0], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := nds.GetMultiSource(c, keys, make([]testEntity, 3))
+	if err == nil {
+		t.Fatal("expected no such entity error")
+	}
+	expected := []nds.Source{
+		nds.SourceMemcache, nds.SourceNotFound, nds.SourceDatastore,
+	}
+	for i, source := range sources {
+		if source != expected[i] {
+			t.Fatal("incorrect sources", sources)
+		}
+	}
+
+	lc := nds.WithLocalCache(c)
+	if err := nds.Get(lc, keys[0], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	sources, err = nds.GetMultiSource(lc, keys[:1], make([]testEntity, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sources[0] != nds.SourceLocalCache {
+		t.Fatal("incorrect source", sources[0])
+	}
+}
+
+func TestGetMultiSourceDatastoreFail(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		return errors.New("expected error")
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	for _, c := range []context.Context{c, nds.WithNoCache(c)} {
+		sources, err := nds.GetMultiSource(c, keys, make([]testEntity, 2))
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if len(sources) != 2 || sources[0] != nds.SourceNone ||
+			sources[1] != nds.SourceNone {
+			t.Fatal("incorrect sources", sources)
+		}
+	}
+}
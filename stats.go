@@ -0,0 +1,247 @@
+package nds
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Operation identifies the kind of nds call a Stats value describes, or the
+// kind of codec call a CodecStats value describes.
+type Operation string
+
+// Operations reported in Stats. Get and GetMulti both report OpGet, Put and
+// PutMulti report OpPut and Delete and DeleteMulti report OpDelete.
+const (
+	OpGet    Operation = "Get"
+	OpPut    Operation = "Put"
+	OpDelete Operation = "Delete"
+)
+
+// Stats describes how the cache was used by a single nds call.
+type Stats struct {
+	Op Operation
+
+	// Tag is the tag of the context of the call, set with WithStatsTag.
+	Tag string
+
+	// Keys is the number of keys passed to the call.
+	Keys int
+
+	// CacheHits is the number of keys served from memcache.
+	CacheHits int
+
+	// CacheMisses is the number of keys that required a datastore read.
+	CacheMisses int
+
+	// LockedKeys is the number of keys that were locked by another call and so
+	// were read from the datastore without updating memcache. It is a subset
+	// of CacheMisses.
+	LockedKeys int
+
+	// CASFailures is the number of keys read from the datastore whose
+	// memcache item could not be updated by CompareAndSwap. This usually
+	// means another call put, deleted or locked the key in the meantime.
+	// It is a subset of CacheMisses. A count that grows alongside LockedKeys
+	// indicates contention on the same keys.
+	CASFailures int
+
+	// CASRetries is the number of times keys were locked and read from the
+	// datastore again after a failed CompareAndSwap. See SetCASRetries.
+	CASRetries int
+
+	// CacheHitBytes is the total size of the entities served from memcache,
+	// as stored after any compression. Keys cached as having no entity and
+	// entities served from the local cache add nothing.
+	CacheHitBytes int
+
+	// CacheWriteBytes is the total size of the entities read from the
+	// datastore and saved to memcache, as stored after any compression.
+	// Entities that could not be saved because of a failed CompareAndSwap add
+	// nothing. Only Get and GetMulti save entities as Put, PutMulti and the
+	// delete calls only invalidate memcache, so they always report 0. The
+	// size of entities before compression is reported in the CodecSize of
+	// CodecStats, see SetCodecRecorder.
+	CacheWriteBytes int
+
+	// ShadowReads is the number of entities served from memcache that were
+	// also read from the datastore to check them. See SetShadowReadRate.
+	ShadowReads int
+
+	// ShadowReadMismatches is the number of shadow read entities that
+	// differed from the cached entities. It is a subset of ShadowReads.
+	ShadowReadMismatches int
+
+	// MemcacheCalls is the number of memcache calls made by the call,
+	// including retries and the calls for chunks of large entities.
+	MemcacheCalls MemcacheCalls
+}
+
+// MemcacheCalls counts memcache calls by their kind. Each count is the number
+// of calls made to the Cache set with SetCache, whatever the number of items
+// of each call. Calls with no items do not contact memcache so are not
+// counted.
+type MemcacheCalls struct {
+	Get            int
+	Add            int
+	Set            int
+	CompareAndSwap int
+	Delete         int
+}
+
+func (m *MemcacheCalls) add(o *MemcacheCalls) {
+	m.Get += o.Get
+	m.Add += o.Add
+	m.Set += o.Set
+	m.CompareAndSwap += o.CompareAndSwap
+	m.Delete += o.Delete
+}
+
+func (s *Stats) add(o *Stats) {
+	s.Keys += o.Keys
+	s.CacheHits += o.CacheHits
+	s.CacheMisses += o.CacheMisses
+	s.LockedKeys += o.LockedKeys
+	s.CASFailures += o.CASFailures
+	s.CASRetries += o.CASRetries
+	s.CacheHitBytes += o.CacheHitBytes
+	s.CacheWriteBytes += o.CacheWriteBytes
+	s.ShadowReads += o.ShadowReads
+	s.ShadowReadMismatches += o.ShadowReadMismatches
+	s.MemcacheCalls.add(&o.MemcacheCalls)
+}
+
+// SetStatsRecorder sets a function that is called once at the end of every
+// Get, GetMulti, Put, PutMulti, Delete and DeleteMulti call with the Stats
+// of that call. The recorder may be called concurrently so it must be safe
+// for concurrent use. A nil recorder, the default, disables stats. Calls in
+// progress when the recorder is changed may still pass their Stats to the
+// previous recorder.
+func SetStatsRecorder(recorder func(s Stats)) {
+	updateConfig(func(cfg *config) {
+		cfg.statsRecorder = recorder
+	})
+}
+
+// recordStats passes s to the stats recorder if there is one.
+func recordStats(s Stats) {
+	if recorder := loadConfig().statsRecorder; recorder != nil {
+		recorder(s)
+	}
+}
+
+// startStats returns a copy of c that counts the memcache calls made with it
+// and a function that records s along with those counts. Use it as
+//
+//	c, record := startStats(c, Stats{Op: OpPut, Keys: len(keys)})
+//	defer record()
+//
+// Without a stats recorder c is returned with a function that does nothing,
+// so that calls cost no allocations.
+func startStats(c context.Context, s Stats) (context.Context, func()) {
+	if loadConfig().statsRecorder == nil {
+		return c, noStats
+	}
+	return recordingStats(c, s)
+}
+
+// recordingStats is startStats with a stats recorder. It is separate so that
+// s is only moved to the heap when it is recorded.
+func recordingStats(c context.Context, s Stats) (context.Context, func()) {
+	s.Tag = optionsFromContext(c).statsTag
+	c, counter := withMemcacheCallCounter(c)
+	return c, func() {
+		s.MemcacheCalls = counter.load()
+		recordStats(s)
+	}
+}
+
+// noStats is the function returned by startStats without a stats recorder.
+func noStats() {}
+
+var memcacheCallCounterKey = "used for *memcacheCallCounter"
+
+// memcacheCallCounter counts the memcache calls made with a context. Calls are
+// also counted by the counter of the parent context, if any, so that an nds
+// call made by another one counts towards both.
+type memcacheCallCounter struct {
+	mu     sync.Mutex
+	calls  MemcacheCalls
+	parent *memcacheCallCounter
+}
+
+// withMemcacheCallCounter returns a copy of c that counts the memcache calls
+// made with it, and its counter. c and a nil counter are returned if there is
+// no stats recorder.
+func withMemcacheCallCounter(c context.Context) (context.Context,
+	*memcacheCallCounter) {
+
+	if loadConfig().statsRecorder == nil {
+		return c, nil
+	}
+	parent, _ := c.Value(&memcacheCallCounterKey).(*memcacheCallCounter)
+	counter := &memcacheCallCounter{parent: parent}
+	return context.WithValue(c, &memcacheCallCounterKey, counter), counter
+}
+
+// countMemcacheCall counts a memcache call of size keys or items made with c by
+// calling count with the counts of each counter of c. Calls with no keys do
+// not contact memcache so are not counted.
+func countMemcacheCall(c context.Context, size int,
+	count func(m *MemcacheCalls)) {
+
+	if size == 0 {
+		return
+	}
+	counter, _ := c.Value(&memcacheCallCounterKey).(*memcacheCallCounter)
+	for ; counter != nil; counter = counter.parent {
+		counter.mu.Lock()
+		count(&counter.calls)
+		counter.mu.Unlock()
+	}
+}
+
+// load returns the counts so far. A nil counter has no counts.
+func (m *memcacheCallCounter) load() MemcacheCalls {
+	if m == nil {
+		return MemcacheCalls{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+// Operations reported in CodecStats.
+const (
+	OpMarshal   Operation = "Marshal"
+	OpUnmarshal Operation = "Unmarshal"
+)
+
+// CodecStats describes a single successful marshal or unmarshal of an entity
+// cached in memcache.
+type CodecStats struct {
+	Op Operation
+
+	// Size is the size in bytes of the marshalled entity as stored in
+	// memcache.
+	Size int
+
+	// CodecSize is the size in bytes of the codec output or input within the
+	// marshalled entity. It is larger than Size for compressed entities.
+	CodecSize int
+
+	// Duration is how long the call took, including any compression.
+	Duration time.Duration
+}
+
+// SetCodecRecorder sets a function that is called with the CodecStats of
+// every entity marshalled or unmarshalled for memcache, such as to measure how
+// much time the codec costs. The recorder may be called concurrently so it must
+// be safe for concurrent use. A nil recorder, the default, disables codec
+// stats and costs nothing.
+func SetCodecRecorder(recorder func(s CodecStats)) {
+	updateConfig(func(cfg *config) {
+		cfg.codecRecorder = recorder
+	})
+}
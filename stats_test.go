@@ -0,0 +1,355 @@
+package nds_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// statsLog records all stats passed to it by nds.
+type statsLog struct {
+	sync.Mutex
+	stats []nds.Stats
+}
+
+func (sl *statsLog) record(s nds.Stats) {
+	sl.Lock()
+	sl.stats = append(sl.stats, s)
+	sl.Unlock()
+}
+
+func (sl *statsLog) last() nds.Stats {
+	sl.Lock()
+	defer sl.Unlock()
+	return sl.stats[len(sl.stats)-1]
+}
+
+func TestStatsRecorder(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	sl := &statsLog{}
+	nds.SetStatsRecorder(sl.record)
+	defer nds.SetStatsRecorder(nil)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.Op != nds.OpPut || s.Keys != 2 {
+		t.Fatalf("incorrect put stats %+v", s)
+	}
+
+	// Get from datastore.
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.Op != nds.OpGet || s.Keys != 2 ||
+		s.CacheHits != 0 || s.CacheMisses != 2 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+
+	// Get from cache.
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.CacheHits != 2 || s.CacheMisses != 0 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+
+	// Lock one key as if another call was updating it.
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.MemcacheKey(c, keys[0]),
+		Flags: nds.LockItem,
+		Value: []byte{1, 2, 3, 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.CacheHits != 1 || s.CacheMisses != 1 ||
+		s.LockedKeys != 1 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+
+	if err := nds.Delete(c, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.Op != nds.OpDelete || s.Keys != 1 {
+		t.Fatalf("incorrect delete stats %+v", s)
+	}
+}
+
+func TestStatsNoRecorderAllocs(t *testing.T) {
+	c := context.Background()
+	stats := nds.Stats{Op: nds.OpPut, Keys: 1}
+	allocs := testing.AllocsPerRun(100, func() {
+		sc, record := nds.StartStats(c, stats)
+		if sc != c {
+			t.Fatal("expected the same context")
+		}
+		record()
+	})
+	if allocs != 0 {
+		t.Fatal("expected no allocations", allocs)
+	}
+}
+
+func TestStatsCASFailures(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	sl := &statsLog{}
+	nds.SetStatsRecorder(sl.record)
+	defer nds.SetStatsRecorder(nil)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the first item as if another call changed it.
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		me := make(appengine.MultiError, len(items))
+		me[0] = memcache.ErrCASConflict
+		if err := memcache.CompareAndSwapMulti(c, items[1:]); err != nil {
+			return err
+		}
+		return me
+	})
+	defer nds.SetMemcacheCompareAndSwapMulti(memcache.CompareAndSwapMulti)
+
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.CacheMisses != 2 || s.CASFailures != 1 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+
+	// The whole batch fails with a non MultiError.
+	nds.SetMemcacheCompareAndSwapMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		return errors.New("expected error")
+	})
+
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.CacheHits != 1 || s.CASFailures != 1 {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+}
+
+func TestStatsCacheBytes(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		StringVal string
+	}
+
+	sl := &statsLog{}
+	nds.SetStatsRecorder(sl.record)
+	defer nds.SetStatsRecorder(nil)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2],
+		[]testEntity{{"one"}, {"two two"}}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.CacheWriteBytes != 0 {
+		t.Fatalf("incorrect put stats %+v", s)
+	}
+
+	// Get from datastore, caching both entities and the missing key.
+	err := nds.GetMulti(c, keys, make([]testEntity, 3))
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatalf("expected missing entity, got %v", err)
+	}
+
+	size := 0
+	for _, key := range keys[:2] {
+		item, err := memcache.Get(c, nds.MemcacheKey(c, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Flags != nds.EntityItem {
+			t.Fatalf("expected entity item, got flags %d", item.Flags)
+		}
+		size += len(item.Value)
+	}
+	if s := sl.last(); s.CacheWriteBytes != size || s.CacheHitBytes != 0 {
+		t.Fatalf("expected %d bytes written, got stats %+v", size, s)
+	}
+
+	// Get from cache.
+	err = nds.GetMulti(c, keys, make([]testEntity, 3))
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatalf("expected missing entity, got %v", err)
+	}
+	if s := sl.last(); s.CacheHits != 3 || s.CacheHitBytes != size ||
+		s.CacheWriteBytes != 0 {
+		t.Fatalf("expected %d bytes read, got stats %+v", size, s)
+	}
+}
+
+func TestStatsMemcacheCalls(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	sl := &statsLog{}
+	nds.SetStatsRecorder(sl.record)
+	defer nds.SetStatsRecorder(nil)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.MemcacheCalls != (nds.MemcacheCalls{
+		Set: 1, Delete: 1}) {
+		t.Fatalf("incorrect put stats %+v", s)
+	}
+
+	// Get from datastore.
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.MemcacheCalls != (nds.MemcacheCalls{
+		Get: 2, Add: 1, CompareAndSwap: 1}) {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+
+	// Get from cache.
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.MemcacheCalls != (nds.MemcacheCalls{Get: 1}) {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+
+	if err := nds.DeleteMulti(c, keys); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.MemcacheCalls != (nds.MemcacheCalls{Set: 1}) {
+		t.Fatalf("incorrect delete stats %+v", s)
+	}
+}
+
+func TestWithStatsTag(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	sl := &statsLog{}
+	nds.SetStatsRecorder(sl.record)
+	defer nds.SetStatsRecorder(nil)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.Tag != "" {
+		t.Fatalf("expected no tag, got stats %+v", s)
+	}
+
+	tc := nds.WithStatsTag(c, "profile")
+	if _, err := nds.Put(tc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.Op != nds.OpPut || s.Tag != "profile" {
+		t.Fatalf("incorrect put stats %+v", s)
+	}
+	if err := nds.Get(tc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.Op != nds.OpGet || s.Tag != "profile" {
+		t.Fatalf("incorrect get stats %+v", s)
+	}
+	if err := nds.Delete(tc, key); err != nil {
+		t.Fatal(err)
+	}
+	if s := sl.last(); s.Op != nds.OpDelete || s.Tag != "profile" {
+		t.Fatalf("incorrect delete stats %+v", s)
+	}
+}
+
+func TestSetCodecRecorder(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	var mu sync.Mutex
+	stats := []nds.CodecStats{}
+	nds.SetCodecRecorder(func(s nds.CodecStats) {
+		mu.Lock()
+		stats = append(stats, s)
+		mu.Unlock()
+	})
+	defer nds.SetCodecRecorder(nil)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := nds.Get(c, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(stats) != 2 {
+		t.Fatal("incorrect codec stats", stats)
+	}
+	if stats[0].Op != nds.OpMarshal || stats[1].Op != nds.OpUnmarshal {
+		t.Fatal("incorrect operations", stats)
+	}
+	for _, s := range stats {
+		if s.Size != stats[0].Size || s.CodecSize != s.Size-3 {
+			t.Fatal("incorrect sizes", s)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package nds
+
+import (
+	"go.opencensus.io/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// The functions in this file wrap every datastore and memcache call made by
+// nds in an OpenCensus span. Memcache calls are made to the Cache set with
+// SetCache. Spans are only started when c already carries a
+// span, so there is no tracing overhead for untraced requests. The results of
+// memcache calls are also passed to the circuit breaker and counted for the
+// MemcacheCalls of Stats.
+
+// startSpan starts a child span of the span in c named name. If c has no span
+// then c and a nil span are returned.
+func startSpan(c context.Context, name string) (context.Context, *trace.Span) {
+	if trace.FromContext(c) == nil {
+		return c, nil
+	}
+	return trace.StartSpan(c, name)
+}
+
+// endSpan ends span recording err, if any. span may be nil.
+func endSpan(span *trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.SetStatus(trace.Status{
+			Code:    trace.StatusCodeUnknown,
+			Message: err.Error(),
+		})
+	}
+	span.End()
+}
+
+func keyCountAttribute(count int) trace.Attribute {
+	return trace.Int64Attribute("nds.keys", int64(count))
+}
+
+func itemsAttributes(items []*memcache.Item) []trace.Attribute {
+	size := 0
+	for _, item := range items {
+		size += len(item.Value)
+	}
+	return []trace.Attribute{
+		keyCountAttribute(len(items)),
+		trace.Int64Attribute("nds.bytes", int64(size)),
+	}
+}
+
+func tracedDatastoreDeleteMulti(c context.Context,
+	keys []*datastore.Key) error {
+
+	c, span := startSpan(c, "nds/datastore.DeleteMulti")
+	if span != nil {
+		span.AddAttributes(keyCountAttribute(len(keys)))
+	}
+	err := datastoreDeleteMulti(c, keys)
+	endSpan(span, err)
+	return err
+}
+
+func tracedDatastoreGetMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+
+	c, span := startSpan(c, "nds/datastore.GetMulti")
+	if span != nil {
+		span.AddAttributes(keyCountAttribute(len(keys)))
+	}
+	err := datastoreGetMulti(c, keys, vals)
+	endSpan(span, err)
+	return err
+}
+
+func tracedDatastorePutMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+
+	c, span := startSpan(c, "nds/datastore.PutMulti")
+	if span != nil {
+		span.AddAttributes(keyCountAttribute(len(keys)))
+	}
+	keys, err := datastorePutMulti(c, keys, vals)
+	endSpan(span, err)
+	return keys, err
+}
+
+func tracedMemcacheAddMulti(c context.Context, items []*memcache.Item) error {
+	c, span := startSpan(c, "nds/memcache.AddMulti")
+	if span != nil {
+		span.AddAttributes(itemsAttributes(items)...)
+	}
+	countMemcacheCall(c, len(items), func(m *MemcacheCalls) {
+		m.Add++
+	})
+	err := loadConfig().cache.AddMulti(c, items)
+	observeMemcache(len(items), err)
+	endSpan(span, err)
+	return err
+}
+
+func tracedMemcacheCompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+
+	c, span := startSpan(c, "nds/memcache.CompareAndSwapMulti")
+	if span != nil {
+		span.AddAttributes(itemsAttributes(items)...)
+	}
+	countMemcacheCall(c, len(items), func(m *MemcacheCalls) {
+		m.CompareAndSwap++
+	})
+	err := loadConfig().cache.CompareAndSwapMulti(c, items)
+	observeMemcache(len(items), err)
+	endSpan(span, err)
+	return err
+}
+
+func tracedMemcacheDeleteMulti(c context.Context, keys []string) error {
+	c, span := startSpan(c, "nds/memcache.DeleteMulti")
+	if span != nil {
+		span.AddAttributes(keyCountAttribute(len(keys)))
+	}
+	countMemcacheCall(c, len(keys), func(m *MemcacheCalls) {
+		m.Delete++
+	})
+	err := loadConfig().cache.DeleteMulti(c, keys)
+	observeMemcache(len(keys), err)
+	endSpan(span, err)
+	return err
+}
+
+func tracedMemcacheGetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+
+	countMemcacheCall(c, len(keys), func(m *MemcacheCalls) {
+		m.Get++
+	})
+	c, span := startSpan(c, "nds/memcache.GetMulti")
+	if span == nil {
+		items, err := loadConfig().cache.GetMulti(c, keys)
+		observeMemcache(len(keys), err)
+		return items, err
+	}
+	span.AddAttributes(keyCountAttribute(len(keys)))
+	items, err := loadConfig().cache.GetMulti(c, keys)
+	observeMemcache(len(keys), err)
+	size := 0
+	for _, item := range items {
+		size += len(item.Value)
+	}
+	span.AddAttributes(trace.Int64Attribute("nds.bytes", int64(size)))
+	endSpan(span, err)
+	return items, err
+}
+
+func tracedMemcacheSetMulti(c context.Context, items []*memcache.Item) error {
+	c, span := startSpan(c, "nds/memcache.SetMulti")
+	if span != nil {
+		span.AddAttributes(itemsAttributes(items)...)
+	}
+	countMemcacheCall(c, len(items), func(m *MemcacheCalls) {
+		m.Set++
+	})
+	err := loadConfig().cache.SetMulti(c, items)
+	observeMemcache(len(items), err)
+	endSpan(span, err)
+	return err
+}
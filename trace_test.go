@@ -0,0 +1,63 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"go.opencensus.io/trace"
+	"google.golang.org/appengine/datastore"
+)
+
+// spanExporter records the names of all exported spans.
+type spanExporter struct {
+	sync.Mutex
+	names map[string]int
+}
+
+func (se *spanExporter) ExportSpan(sd *trace.SpanData) {
+	se.Lock()
+	se.names[sd.Name]++
+	se.Unlock()
+}
+
+func TestTraceSpans(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	se := &spanExporter{names: map[string]int{}}
+	trace.RegisterExporter(se)
+	defer trace.UnregisterExporter(se)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	// No spans should be created without a parent span.
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(se.names) != 0 {
+		t.Fatal("expected no spans", se.names)
+	}
+
+	tc, span := trace.StartSpan(c, "test",
+		trace.WithSampler(trace.AlwaysSample()))
+	if err := nds.Get(tc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	for _, name := range []string{
+		"nds/memcache.GetMulti",
+		"nds/memcache.AddMulti",
+		"nds/datastore.GetMulti",
+		"nds/memcache.CompareAndSwapMulti",
+	} {
+		if se.names[name] == 0 {
+			t.Fatal("expected span", name, se.names)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package nds
 
 import (
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
@@ -13,6 +14,21 @@ var transactionKey = "used for *transaction"
 type transaction struct {
 	sync.Mutex
 	lockMemcacheItems []*memcache.Item
+
+	// keys are the keys put or deleted, which are removed from the local
+	// cache once the transaction has committed.
+	keys []*datastore.Key
+}
+
+// add records the lock items and keys of a put or delete made within the
+// transaction.
+func (tx *transaction) add(lockMemcacheItems []*memcache.Item,
+	keys []*datastore.Key) {
+
+	tx.Lock()
+	defer tx.Unlock()
+	tx.lockMemcacheItems = append(tx.lockMemcacheItems, lockMemcacheItems...)
+	tx.keys = append(tx.keys, keys...)
 }
 
 func transactionFromContext(c context.Context) (*transaction, bool) {
@@ -23,11 +39,85 @@ func transactionFromContext(c context.Context) (*transaction, bool) {
 // RunInTransaction works just like datastore.RunInTransaction however it
 // interacts correctly with memcache. You should always use this method for
 // transactions if you are using the NDS package.
+//
+// opts is passed to datastore.RunInTransaction, so set opts.XG to put and
+// delete entities from more than one entity group. The memcache items of every
+// key put or deleted within the transaction are locked when it commits,
+// whichever entity group the key belongs to.
+//
+// Get, GetMulti and the other reads read the datastore directly within a
+// transaction and never cache what they read, so a read within a transaction
+// that fails or is retried cannot leave a stale entity in memcache. The
+// memcache items of keys that are only read are therefore left unlocked when
+// the transaction commits.
+//
+// A transaction that fails to commit because of a concurrent transaction is
+// tried again with a new transaction context, up to opts.Attempts or three
+// times in all. The locks of an attempt are only taken once f has succeeded,
+// and each attempt starts afresh, so the writes of failed attempts only leave
+// locks that expire, as for any failed write. Set a wait between attempts with
+// SetTransactionBackoff.
 func RunInTransaction(c context.Context, f func(tc context.Context) error,
 	opts *datastore.TransactionOptions) error {
 
-	return datastore.RunInTransaction(c, func(tc context.Context) error {
-		tx := &transaction{}
+	backoff := loadConfig().transactionBackoff
+	if backoff == nil {
+		return runInTransaction(c, f, opts)
+	}
+
+	attempts := defaultTransactionAttempts
+	attemptOpts := datastore.TransactionOptions{}
+	if opts != nil {
+		if opts.Attempts > 0 {
+			attempts = opts.Attempts
+		}
+		attemptOpts = *opts
+	}
+	attemptOpts.Attempts = 1
+
+	for attempt := 1; ; attempt++ {
+		// Only commit failures are tried again, as by the datastore.
+		var fErr error
+		err := runInTransaction(c, func(tc context.Context) error {
+			fErr = f(tc)
+			return fErr
+		}, &attemptOpts)
+		if err != datastore.ErrConcurrentTransaction || fErr != nil ||
+			attempt == attempts {
+			return err
+		}
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-c.Done():
+			return c.Err()
+		}
+	}
+}
+
+// defaultTransactionAttempts is how many times RunInTransaction tries a
+// transaction when opts do not say, which is the same as the datastore.
+const defaultTransactionAttempts = 3
+
+// SetTransactionBackoff sets a function returning how long RunInTransaction
+// waits after attempt failed because of a concurrent transaction before trying
+// again, which gives the other transaction time to finish. A nil backoff, the
+// default, tries again straight away.
+func SetTransactionBackoff(backoff func(attempt int) time.Duration) {
+	updateConfig(func(cfg *config) {
+		cfg.transactionBackoff = backoff
+	})
+}
+
+// runInTransaction runs f in a datastore transaction and locks the memcache
+// items of the keys it changed before committing. The keys are removed from
+// the local cache of c once committed, as a GetMulti made before then can
+// still store the entities they replace.
+func runInTransaction(c context.Context, f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+
+	var tx *transaction
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		tx = &transaction{}
 		tc = context.WithValue(tc, &transactionKey, tx)
 		if err := f(tc); err != nil {
 			return err
@@ -40,6 +130,10 @@ func RunInTransaction(c context.Context, f func(tc context.Context) error,
 		if err != nil {
 			return err
 		}
-		return memcacheSetMulti(memcacheCtx, tx.lockMemcacheItems)
+		return tracedMemcacheSetMulti(memcacheCtx, tx.lockMemcacheItems)
 	}, opts)
+	if err == nil {
+		invalidateLocalCache(c, tx.keys)
+	}
+	return err
 }
@@ -3,11 +3,13 @@ package nds_test
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/qedus/nds"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
 )
 
 func TestTransactionOptions(t *testing.T) {
@@ -99,3 +101,144 @@ func TestClearNamespacedLocks(t *testing.T) {
 		t.Fatal("incorrect val")
 	}
 }
+
+func TestTransactionXGCache(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	// Keys in different entity groups.
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime cache.
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &datastore.TransactionOptions{XG: true}
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.PutMulti(tc, keys, []testEntity{{3}, {4}})
+		return err
+	}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	entities := make([]testEntity, 2)
+	if err := nds.GetMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Val != 3 || entities[1].Val != 4 {
+		t.Fatal("expected updated entities", entities)
+	}
+}
+
+func TestTransactionGetMultiUncached(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	inTransaction := false
+	nds.SetMemcacheGetMulti(func(c context.Context,
+		keys []string) (map[string]*memcache.Item, error) {
+		if inTransaction {
+			t.Fatal("memcache read within transaction")
+		}
+		return memcache.GetMulti(c, keys)
+	})
+	defer nds.SetMemcacheGetMulti(memcache.GetMulti)
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		inTransaction = true
+		defer func() { inTransaction = false }()
+		return nds.Get(tc, key, &testEntity{})
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing read within the transaction is cached or locked.
+	if _, err := memcache.Get(c, nds.MemcacheKey(c, key)); err !=
+		memcache.ErrCacheMiss {
+		t.Fatal("expected memcache.ErrCacheMiss", err)
+	}
+}
+
+func TestSetTransactionBackoff(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	backoffs := []int{}
+	nds.SetTransactionBackoff(func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	})
+	defer nds.SetTransactionBackoff(nil)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first attempt conflicts with a write made outside of it.
+	calls := 0
+	err := nds.RunInTransaction(c, func(tc context.Context) error {
+		calls++
+		entity := &testEntity{}
+		if err := nds.Get(tc, key, entity); err != nil {
+			return err
+		}
+		if calls == 1 {
+			if _, err := nds.Put(c, key, &testEntity{10}); err != nil {
+				return err
+			}
+		}
+		entity.IntVal++
+		_, err := nds.Put(tc, key, entity)
+		return err
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || len(backoffs) != 1 || backoffs[0] != 1 {
+		t.Fatalf("incorrect attempts %d and backoffs %v", calls, backoffs)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 11 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	// Errors returned by f are not tried again.
+	calls = 0
+	err = nds.RunInTransaction(c, func(tc context.Context) error {
+		calls++
+		return datastore.ErrConcurrentTransaction
+	}, &datastore.TransactionOptions{Attempts: 5})
+	if err != datastore.ErrConcurrentTransaction || calls != 1 {
+		t.Fatalf("expected one failed attempt, got %d and %v", calls, err)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build go1.18
+// +build go1.18
+
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// GetMultiOf is a type safe form of GetMulti for entities of a single struct
+// type T. It allocates and returns a []*T aligned with keys, so the type of the
+// entities is checked when compiling rather than when calling. GetMulti is
+// still needed for destinations whose type is only known at run time.
+//
+// As with GetMulti, an appengine.MultiError is returned if any key gives an
+// error. The slots of keys that gave an error, such as
+// datastore.ErrNoSuchEntity, are nil. Keys that only gave a
+// *datastore.ErrFieldMismatch keep their partially loaded entities.
+func GetMultiOf[T any](c context.Context, keys []*datastore.Key) ([]*T,
+	error) {
+
+	vals := make([]*T, len(keys))
+	for i := range vals {
+		vals[i] = new(T)
+	}
+
+	err := GetMulti(c, keys, vals)
+	if me, ok := err.(appengine.MultiError); ok {
+		for i, e := range me {
+			if e != nil && !isFieldMismatch(e) {
+				vals[i] = nil
+			}
+		}
+	}
+	return vals, err
+}
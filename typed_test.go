@@ -0,0 +1,57 @@
+//go:build go1.18
+// +build go1.18
+
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetMultiOf(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, []*datastore.Key{keys[0], keys[2]},
+		[]testEntity{{1}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	entities, err := nds.GetMultiOf[testEntity](c, keys)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil || me[1] != datastore.ErrNoSuchEntity || me[2] != nil {
+		t.Fatal("incorrect errors", me)
+	}
+	if len(entities) != 3 {
+		t.Fatal("incorrect entities length", len(entities))
+	}
+	if entities[0].IntVal != 1 || entities[2].IntVal != 3 {
+		t.Fatal("incorrect entities", entities[0], entities[2])
+	}
+	if entities[1] != nil {
+		t.Fatal("expected nil entity", entities[1])
+	}
+
+	entities, err = nds.GetMultiOf[testEntity](c, keys[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].IntVal != 1 {
+		t.Fatal("incorrect IntVal", entities[0].IntVal)
+	}
+}
@@ -0,0 +1,52 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Update reads the entity of key into dst, calls fn to modify it and puts it
+// back, all within a transaction so that no concurrent write between the read
+// and the put is lost. dst must be a struct pointer or implement
+// datastore.PropertyLoadSaver, and is passed to fn. It is set to its zero value
+// before each read so that nothing is left over from a previous attempt. If fn
+// returns an error the entity is not put and Update returns the error. If key
+// has no entity then Update returns datastore.ErrNoSuchEntity without calling
+// fn.
+//
+// The transaction is retried if it conflicts with another, so fn can be called
+// more than once, each time with the entity as it was then read. fn should not
+// have other side effects. If c is already a transaction context then the read
+// and put are made within that transaction instead.
+//
+// Memcache is not held locked for the whole update as its locks cannot stop
+// concurrent writes. Instead the memcache item of key is locked when the
+// transaction commits, in the same way as RunInTransaction, and the entity is
+// cached again by a GetMulti once that lock has expired.
+func Update(c context.Context, key *datastore.Key, dst interface{},
+	fn func(dst interface{}) error) error {
+
+	v := reflect.ValueOf(dst)
+	if dst == nil || v.Kind() != reflect.Ptr || v.IsNil() {
+		return datastore.ErrInvalidEntityType
+	}
+
+	update := func(tc context.Context) error {
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
+		if err := Get(tc, key, dst); err != nil {
+			return err
+		}
+		if err := fn(dst); err != nil {
+			return err
+		}
+		_, err := Put(tc, key, dst)
+		return err
+	}
+
+	if _, ok := transactionFromContext(c); ok {
+		return update(c)
+	}
+	return RunInTransaction(c, update, nil)
+}
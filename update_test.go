@@ -0,0 +1,76 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestUpdate(t *testing.T) {
+	c, closeFunc := NewContext(t)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	increment := func(dst interface{}) error {
+		dst.(*testEntity).IntVal++
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := nds.Update(c, key, &testEntity{}, increment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 3 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	// An error from fn stops the entity being put.
+	expectedErr := errors.New("expected error")
+	if err := nds.Update(c, key, &testEntity{}, func(dst interface{}) error {
+		dst.(*testEntity).IntVal = 10
+		return expectedErr
+	}); err != expectedErr {
+		t.Fatal("expected error", err)
+	}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 3 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+
+	missingKey := datastore.NewKey(c, "Entity", "", 2, nil)
+	if err := nds.Update(c, missingKey, &testEntity{},
+		increment); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	// Updates within a transaction use that transaction.
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		return nds.Update(tc, key, &testEntity{}, increment)
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	if entity.IntVal != 4 {
+		t.Fatal("incorrect IntVal", entity.IntVal)
+	}
+}